@@ -19,6 +19,8 @@ func newDaemonCommand() *cobra.Command {
 		RunE:  daemonAction,
 	}
 	daemonCommand.Flags().Duration("tick", 3*time.Second, "tick for polling events")
+	daemonCommand.Flags().Bool("watch-bind", true, "watch bind(2) and listen(2) with audit, to detect new listeners without waiting for the tick")
+	daemonCommand.Flags().Duration("stats-interval", 30*time.Second, "interval for sending the memory and disk usage to the host agent")
 	return daemonCommand
 }
 
@@ -30,36 +32,77 @@ func daemonAction(cmd *cobra.Command, args []string) error {
 	if tick == 0 {
 		return errors.New("tick must be specified")
 	}
+	watchBind, err := cmd.Flags().GetBool("watch-bind")
+	if err != nil {
+		return err
+	}
+	statsInterval, err := cmd.Flags().GetDuration("stats-interval")
+	if err != nil {
+		return err
+	}
+	if statsInterval <= 0 {
+		return errors.New("stats-interval must be positive")
+	}
 	if os.Geteuid() != 0 {
 		return errors.New("must run as the root")
 	}
 	logrus.Infof("event tick: %v", tick)
 
-	yamuxListener, err := vsock.Dial(vsock.Host, 47, &vsock.Config{})
-
 	newTicker := func() (<-chan time.Time, func()) {
-		// TODO: use an equivalent of `bpftrace -e 'tracepoint:syscalls:sys_*_bind { printf("tick\n"); }')`,
-		// without depending on `bpftrace` binary.
-		// The agent binary will need CAP_BPF file cap.
+		// The ticker is the fallback of the audit rule for bind(2) and listen(2), see --watch-bind.
 		ticker := time.NewTicker(tick)
 		return ticker.C, ticker.Stop
 	}
 
-	cfg := yamux.DefaultConfig()
+	agent, err := guestagent.New(newTicker, tick*20, watchBind)
+	if err != nil {
+		return err
+	}
+	agent.StartDNS()
+	logrus.Println("Sending Events...")
+	go agent.ListenAndSendEvents()
+	go agent.ListenAndSendStats(statsInterval)
+
+	backoff := minReconnectBackoff
+	for {
+		begin := time.Now()
+		if err := serveSession(agent); err != nil {
+			logrus.WithError(err).Warn("failed to connect to the host agent")
+		} else {
+			logrus.Warn("disconnected from the host agent")
+		}
+		if time.Since(begin) > maxReconnectBackoff {
+			// the session was up for a while, so the host agent is likely to accept a new one
+			backoff = minReconnectBackoff
+		}
+		logrus.Infof("reconnecting to the host agent in %v", backoff)
+		time.Sleep(backoff)
+		backoff *= 2
+		if backoff > maxReconnectBackoff {
+			backoff = maxReconnectBackoff
+		}
+	}
+}
 
-	sess, err := yamux.Server(yamuxListener, cfg)
+const (
+	minReconnectBackoff = 1 * time.Second
+	maxReconnectBackoff = 30 * time.Second
+)
 
-	agent, err := guestagent.New(newTicker, sess, tick*20)
+// serveSession connects to the host agent over vsock, and serves the session until it is closed
+func serveSession(agent guestagent.Agent) error {
+	conn, err := vsock.Dial(vsock.Host, 47, &vsock.Config{})
 	if err != nil {
 		return err
 	}
+	cfg := yamux.DefaultConfig()
+	sess, err := yamux.Server(conn, cfg)
+	if err != nil {
+		_ = conn.Close()
+		return err
+	}
+	defer sess.Close()
 	logrus.Println("Serving at vsock...")
-	logrus.Println("Publishing info...")
-	agent.PublishInfo()
-	logrus.Println("Published info...")
-	logrus.Println("Sending Events...")
-	agent.StartDNS()
-	agent.ListenAndSendEvents()
-	logrus.Println("Stopped sending events")
+	agent.ServeSession(sess)
 	return nil
 }
@@ -0,0 +1,285 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/alessio/shellescape"
+	"github.com/mac-vz/macvz/pkg/hostagent/api"
+	"github.com/mac-vz/macvz/pkg/hostagent/api/client"
+	"github.com/mac-vz/macvz/pkg/socket"
+	"github.com/mac-vz/macvz/pkg/sshutil"
+	"github.com/mac-vz/macvz/pkg/store"
+	"github.com/mac-vz/macvz/pkg/store/filenames"
+	"github.com/mac-vz/macvz/pkg/tarutil"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var copyHelp = `Copy files between the host and an instance
+
+Prefix guest paths with the instance name and a colon, like scp: INSTANCE:path.
+Relative guest paths are relative to the home of the user in the guest.
+Files are streamed as tar archives through the guest agent, or over SSH for the guest agents that do not support exec.
+The permissions and the modification times are preserved.`
+
+func newCopyCommand() *cobra.Command {
+	var copyCmd = &cobra.Command{
+		Use:     "copy SOURCE ... TARGET",
+		Aliases: []string{"cp"},
+		Short:   "Copy files between the host and an instance",
+		Long:    copyHelp,
+		Example: `  Copy a file to the home of the default instance:
+  $ macvz copy ./build.tar.gz default:
+
+  Copy a directory from the default instance:
+  $ macvz copy -r default:/var/log/apt ./logs`,
+		Args: cobra.MinimumNArgs(2),
+		RunE: copyAction,
+	}
+
+	copyCmd.Flags().BoolP("recursive", "r", false, "copy directories recursively")
+	return copyCmd
+}
+
+// copyPath is an operand of macvz copy
+type copyPath struct {
+	// instName is empty for the host
+	instName string
+	path     string
+}
+
+func parseCopyPath(s string) copyPath {
+	// like scp, a colon after a slash is part of a host path
+	i := strings.Index(s, ":")
+	if i <= 0 || strings.Contains(s[:i], "/") {
+		return copyPath{path: s}
+	}
+	p := copyPath{instName: s[:i], path: s[i+1:]}
+	if p.path == "" {
+		p.path = "."
+	}
+	return p
+}
+
+func copyAction(cmd *cobra.Command, args []string) error {
+	recursive, err := cmd.Flags().GetBool("recursive")
+	if err != nil {
+		return err
+	}
+	var sources []copyPath
+	for _, arg := range args[:len(args)-1] {
+		sources = append(sources, parseCopyPath(arg))
+	}
+	target := parseCopyPath(args[len(args)-1])
+
+	instName := target.instName
+	for _, src := range sources {
+		if (src.instName == "") == (target.instName == "") {
+			return errors.New("either the sources or the target must be in an instance (INSTANCE:path), but not both")
+		}
+		if instName == "" {
+			instName = src.instName
+		} else if target.instName == "" && src.instName != instName {
+			return fmt.Errorf("cannot copy from several instances (%q and %q)", instName, src.instName)
+		}
+	}
+
+	inst, err := store.Inspect(instName)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("instance %q does not exist, run `macvz start %s` to create a new instance", instName, instName)
+		}
+		return err
+	}
+	if inst.Status != store.StatusRunning {
+		return fmt.Errorf("instance %q is not running, run `macvz start %s` to start the instance", instName, instName)
+	}
+	g := &guestRunner{inst: inst}
+	if haClient, err := client.NewHostAgentClient(filepath.Join(inst.Dir, filenames.HaSock)); err == nil {
+		g.haClient = haClient
+	} else {
+		logrus.WithError(err).Debug("failed to connect to the host agent, copying over SSH")
+	}
+
+	if target.instName != "" {
+		var paths []string
+		for _, src := range sources {
+			paths = append(paths, src.path)
+		}
+		return copyToGuest(cmd.Context(), g, paths, target.path, recursive)
+	}
+	targetIsDir := false
+	if fi, err := os.Stat(target.path); err == nil {
+		targetIsDir = fi.IsDir()
+	}
+	if len(sources) > 1 && !targetIsDir {
+		return fmt.Errorf("target %q is not a directory", target.path)
+	}
+	for _, src := range sources {
+		if err := copyFromGuest(cmd.Context(), g, src.path, target.path, targetIsDir, recursive); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// copyToGuest streams sources to the tar extracting them in the guest
+func copyToGuest(ctx context.Context, g *guestRunner, sources []string, target string, recursive bool) error {
+	for _, src := range sources {
+		fi, err := os.Stat(src)
+		if err != nil {
+			return err
+		}
+		if fi.IsDir() && !recursive {
+			return fmt.Errorf("%q is a directory (not copied)", src)
+		}
+	}
+	code, err := g.run(ctx, []string{"test", "-d", target}, nil, io.Discard)
+	if err != nil {
+		return err
+	}
+	dir, name := target, ""
+	if code != 0 {
+		if len(sources) > 1 {
+			return fmt.Errorf("target %q is not a directory in the guest", target)
+		}
+		// like cp, a single source is renamed to the target
+		dir, name = path.Dir(target), path.Base(target)
+	}
+
+	pr, pw := io.Pipe()
+	archived := make(chan error, 1)
+	go func() {
+		w := tarutil.NewWriter(pw)
+		var err error
+		for _, src := range sources {
+			srcName := name
+			if srcName == "" {
+				srcName = filepath.Base(src)
+			}
+			if err = w.Add(src, srcName, recursive); err != nil {
+				break
+			}
+		}
+		if err == nil {
+			err = w.Close()
+		}
+		_ = pw.CloseWithError(err)
+		archived <- err
+	}()
+	code, err = g.run(ctx, []string{"tar", "-x", "-p", "-f", "-", "-C", dir}, pr, os.Stdout)
+	// unblock the archive when tar exits early
+	_ = pr.CloseWithError(io.ErrClosedPipe)
+	if archiveErr := <-archived; archiveErr != nil && !errors.Is(archiveErr, io.ErrClosedPipe) {
+		return archiveErr
+	}
+	if err != nil {
+		return err
+	}
+	if code != 0 {
+		return fmt.Errorf("tar exited with %d in the guest", code)
+	}
+	return nil
+}
+
+// copyFromGuest extracts the tar of src created in the guest
+func copyFromGuest(ctx context.Context, g *guestRunner, src, target string, targetIsDir, recursive bool) error {
+	dir, opts := target, tarutil.ExtractOptions{NoDirectories: !recursive}
+	if !targetIsDir {
+		dir, opts.Name = filepath.Dir(target), filepath.Base(target)
+	}
+	if !recursive {
+		code, err := g.run(ctx, []string{"test", "-d", src}, nil, io.Discard)
+		if err != nil {
+			return err
+		}
+		if code == 0 {
+			return fmt.Errorf("%q is a directory in the guest (not copied)", src)
+		}
+	}
+	tarArgs := []string{"tar", "-c", "-f", "-", "-C", path.Dir(src), path.Base(src)}
+
+	pr, pw := io.Pipe()
+	extracted := make(chan error, 1)
+	go func() {
+		err := tarutil.Extract(pr, dir, opts)
+		if err == nil {
+			// tar pads the archive after its end
+			_, _ = io.Copy(io.Discard, pr)
+		}
+		// stop tar when the extraction fails
+		_ = pr.CloseWithError(err)
+		extracted <- err
+	}()
+	code, err := g.run(ctx, tarArgs, nil, pw)
+	_ = pw.Close()
+	if extractErr := <-extracted; extractErr != nil {
+		return extractErr
+	}
+	if err != nil {
+		return err
+	}
+	if code != 0 {
+		return fmt.Errorf("tar exited with %d in the guest", code)
+	}
+	return nil
+}
+
+// guestRunner runs commands in the guest through the guest agent, or over SSH when the guest agent cannot
+type guestRunner struct {
+	inst *store.Instance
+	// haClient is nil once the guest agent failed to execute a command
+	haClient client.HostAgentClient
+}
+
+// run runs args in the guest, and returns its exit code. stderr is written to os.Stderr.
+func (g *guestRunner) run(ctx context.Context, args []string, stdin io.Reader, stdout io.Writer) (int, error) {
+	logrus.Debugf("executing %v in the guest", args)
+	if g.haClient != nil {
+		stream, err := g.haClient.Exec(ctx, api.ExecRequest{Args: args})
+		if err == nil {
+			defer stream.Close()
+			return socket.StreamExec(stream, stdin, stdout, os.Stderr, nil)
+		}
+		logrus.WithError(err).Debug("failed to execute through the guest agent, using SSH")
+		g.haClient = nil
+	}
+
+	y, err := g.inst.LoadYAML()
+	if err != nil {
+		return 0, err
+	}
+	sshOpts, err := sshutil.SSHOpts(g.inst.Dir, *y.User.Name, *y.SSH.Port, true, false)
+	if err != nil {
+		return 0, err
+	}
+	remote, err := sshutil.SSHRemoteUser(g.inst.Dir, *y.MACAddress, *y.User.Name)
+	if err != nil {
+		return 0, err
+	}
+	sshArgs := append(sshutil.SSHArgsFromOpts(sshOpts),
+		"-q",
+		remote,
+		"--",
+		shellescape.QuoteCommand(args),
+	)
+	sshCmd := exec.CommandContext(ctx, "ssh", sshArgs...)
+	sshCmd.Stdin = stdin
+	sshCmd.Stdout = stdout
+	sshCmd.Stderr = os.Stderr
+	err = sshCmd.Run()
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) && exitErr.ExitCode() != 255 {
+		// 255 is the exit code of ssh itself
+		return exitErr.ExitCode(), nil
+	}
+	return 0, err
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/mac-vz/macvz/pkg/lockutil"
+	"github.com/mac-vz/macvz/pkg/store"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+func newDeleteCommand() *cobra.Command {
+	var deleteCommand = &cobra.Command{
+		Use:               "delete NAME [NAME...]",
+		Aliases:           []string{"remove", "rm"},
+		Short:             "Delete an instance of macvz",
+		Args:              cobra.MinimumNArgs(1),
+		RunE:              deleteAction,
+		ValidArgsFunction: deleteBashComplete,
+	}
+
+	deleteCommand.Flags().BoolP("force", "f", false, "forcibly stop the instance when it is running")
+	return deleteCommand
+}
+
+func deleteAction(cmd *cobra.Command, args []string) error {
+	force, err := cmd.Flags().GetBool("force")
+	if err != nil {
+		return err
+	}
+	for _, instName := range args {
+		instDir, err := store.InstanceDir(instName)
+		if err != nil {
+			return err
+		}
+		if _, err := os.Stat(instDir); errors.Is(err, os.ErrNotExist) {
+			logrus.Warnf("Ignoring non-existent instance %q", instName)
+			continue
+		}
+		// Hold the lock of the instance directory, so that `macvz start` cannot launch the instance
+		// between the status check and the removal.
+		if err := lockutil.WithDirLock(instDir, func() error {
+			return deleteInstance(cmd.Context(), instName, force)
+		}); err != nil {
+			return fmt.Errorf("failed to delete instance %q: %w", instName, err)
+		}
+		logrus.Infof("Deleted %q (%q)", instName, instDir)
+	}
+	return nil
+}
+
+func deleteInstance(ctx context.Context, instName string, force bool) error {
+	inst, err := store.Inspect(instName)
+	if err != nil {
+		return err
+	}
+	if inst.Dir == "" {
+		// macvz.yaml is broken, so there is nothing but the directory to clean up
+		inst.Dir, err = store.InstanceDir(instName)
+		if err != nil {
+			return err
+		}
+	} else {
+		if inst.Status == store.StatusRunning && !force {
+			return fmt.Errorf("instance is running, run `macvz stop %s` first (or use `macvz delete -f`)", instName)
+		}
+		stopInstanceForcibly(ctx, inst)
+	}
+
+	if err := os.RemoveAll(inst.Dir); err != nil {
+		return fmt.Errorf("failed to remove %q: %w", inst.Dir, err)
+	}
+	return nil
+}
+
+func deleteBashComplete(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+	return bashCompleteInstanceNames(cmd)
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	"github.com/mac-vz/macvz/pkg/hostagent/api"
+	"github.com/mac-vz/macvz/pkg/hostagent/api/client"
+	"github.com/mac-vz/macvz/pkg/store"
+	"github.com/mac-vz/macvz/pkg/store/filenames"
+	"github.com/spf13/cobra"
+)
+
+var dnsHelp = `Manage the DNS server of the host agent, which answers the queries of the guest.
+
+The static hosts are loaded from hostResolver of macvz.yaml, default.yaml and override.yaml,
+along with hostResolver.hostsFile, and reloaded as these files change.
+The hosts added by "add-host" override them until the instance stops.
+
+"log" shows the latest queries of the guest, with the source of the answer:
+static (the static hosts), cache, system (the system resolver of the host)
+or upstream (hostResolver.upstreams, hostResolver.domains or /etc/resolv.conf).
+The query log is enabled by hostResolver.queryLog.enabled.
+
+"query" resolves a name the same way as the queries of the guest.`
+
+func newDNSCommand() *cobra.Command {
+	var dnsCmd = &cobra.Command{
+		Use:   "dns",
+		Short: "Manage the DNS server of the host agent",
+		Long:  dnsHelp,
+		Example: `  Resolve app.test to 192.168.5.15 in the default instance:
+  $ macvz dns add-host default app.test 192.168.5.15
+
+  Resolve the AAAA records of git.corp.example for the default instance:
+  $ macvz dns query default git.corp.example --type AAAA`,
+	}
+	logCmd := &cobra.Command{
+		Use:               "log INSTANCE",
+		Short:             "Show the latest queries of the guest",
+		Args:              cobra.ExactArgs(1),
+		RunE:              dnsLogAction,
+		ValidArgsFunction: dnsBashComplete,
+	}
+	logCmd.Flags().Bool("json", false, "JSONify output")
+	queryCmd := &cobra.Command{
+		Use:               "query INSTANCE NAME",
+		Short:             "Resolve a name with the DNS server of the host agent",
+		Args:              cobra.ExactArgs(2),
+		RunE:              dnsQueryAction,
+		ValidArgsFunction: dnsBashComplete,
+	}
+	queryCmd.Flags().StringP("type", "t", "A", "type of the records, e.g. AAAA, SRV")
+	queryCmd.Flags().Bool("json", false, "JSONify output")
+	dnsCmd.AddCommand(
+		logCmd,
+		queryCmd,
+		&cobra.Command{
+			Use:               "hosts INSTANCE",
+			Short:             "List the static hosts",
+			Args:              cobra.ExactArgs(1),
+			RunE:              dnsHostsAction,
+			ValidArgsFunction: dnsBashComplete,
+		},
+		&cobra.Command{
+			Use:               "add-host INSTANCE NAME ADDRESS",
+			Short:             "Add a static host, which maps NAME to an IP or a CNAME",
+			Args:              cobra.ExactArgs(3),
+			RunE:              dnsAddHostAction,
+			ValidArgsFunction: dnsBashComplete,
+		},
+		&cobra.Command{
+			Use:               "remove-host INSTANCE NAME",
+			Short:             "Remove a static host added by add-host",
+			Args:              cobra.ExactArgs(2),
+			RunE:              dnsRemoveHostAction,
+			ValidArgsFunction: dnsBashComplete,
+		},
+	)
+	return dnsCmd
+}
+
+// dnsClient returns the client of the host agent of the running instance instName
+func dnsClient(instName string) (client.HostAgentClient, error) {
+	inst, err := store.Inspect(instName)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, fmt.Errorf("instance %q does not exist, run `macvz start %s` to create a new instance", instName, instName)
+		}
+		return nil, err
+	}
+	if inst.Status != store.StatusRunning {
+		return nil, fmt.Errorf("instance %q is not running, run `macvz start %s` to start the instance", instName, instName)
+	}
+	return client.NewHostAgentClient(filepath.Join(inst.Dir, filenames.HaSock))
+}
+
+func dnsHostsAction(cmd *cobra.Command, args []string) error {
+	haClient, err := dnsClient(args[0])
+	if err != nil {
+		return err
+	}
+	hosts, err := haClient.DNSHosts(cmd.Context())
+	if err != nil {
+		return err
+	}
+	names := make([]string, 0, len(hosts))
+	for name := range hosts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	w := tabwriter.NewWriter(cmd.OutOrStdout(), 4, 8, 4, ' ', 0)
+	fmt.Fprintln(w, "NAME\tADDRESS")
+	for _, name := range names {
+		fmt.Fprintf(w, "%s\t%s\n", name, hosts[name])
+	}
+	return w.Flush()
+}
+
+func dnsLogAction(cmd *cobra.Command, args []string) error {
+	jsonFormat, err := cmd.Flags().GetBool("json")
+	if err != nil {
+		return err
+	}
+	haClient, err := dnsClient(args[0])
+	if err != nil {
+		return err
+	}
+	log, err := haClient.DNSQueryLog(cmd.Context())
+	if err != nil {
+		return err
+	}
+	if !log.Enabled {
+		return fmt.Errorf("the query log of instance %q is disabled, set hostResolver.queryLog.enabled to true", args[0])
+	}
+	if jsonFormat {
+		enc := json.NewEncoder(cmd.OutOrStdout())
+		for _, q := range log.Queries {
+			if err := enc.Encode(q); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	w := tabwriter.NewWriter(cmd.OutOrStdout(), 4, 8, 4, ' ', 0)
+	fmt.Fprintln(w, "TIME\tNAME\tTYPE\tSOURCE\tRCODE\tANSWERS\tLATENCY")
+	for _, q := range log.Queries {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%d\t%v\n",
+			q.Time.Format("15:04:05.000"), q.Name, q.Type, q.Source, q.Rcode, q.Answers, q.Latency.Round(time.Microsecond))
+	}
+	return w.Flush()
+}
+
+func dnsQueryAction(cmd *cobra.Command, args []string) error {
+	qtype, err := cmd.Flags().GetString("type")
+	if err != nil {
+		return err
+	}
+	jsonFormat, err := cmd.Flags().GetBool("json")
+	if err != nil {
+		return err
+	}
+	haClient, err := dnsClient(args[0])
+	if err != nil {
+		return err
+	}
+	resp, err := haClient.DNSQuery(cmd.Context(), api.DNSQueryRequest{Name: args[1], Type: qtype})
+	if err != nil {
+		return err
+	}
+	if jsonFormat {
+		return json.NewEncoder(cmd.OutOrStdout()).Encode(resp)
+	}
+	fmt.Fprintf(cmd.OutOrStdout(), ";; %s %s: %s from %s in %v\n",
+		resp.Name, resp.Type, resp.Rcode, resp.Source, resp.Latency.Round(time.Microsecond))
+	for _, record := range resp.Records {
+		fmt.Fprintln(cmd.OutOrStdout(), record)
+	}
+	return nil
+}
+
+func dnsAddHostAction(cmd *cobra.Command, args []string) error {
+	haClient, err := dnsClient(args[0])
+	if err != nil {
+		return err
+	}
+	return haClient.AddDNSHost(cmd.Context(), args[1], args[2])
+}
+
+func dnsRemoveHostAction(cmd *cobra.Command, args []string) error {
+	haClient, err := dnsClient(args[0])
+	if err != nil {
+		return err
+	}
+	return haClient.RemoveDNSHost(cmd.Context(), args[1])
+}
+
+func dnsBashComplete(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+	if len(args) > 0 {
+		return nil, cobra.ShellCompDirectiveNoFileComp
+	}
+	return bashCompleteInstanceNames(cmd)
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+
+	"github.com/mac-vz/macvz/pkg/hostagent/api"
+	"github.com/mac-vz/macvz/pkg/hostagent/api/client"
+	"github.com/mac-vz/macvz/pkg/osutil"
+	"github.com/mac-vz/macvz/pkg/socket"
+	"github.com/mac-vz/macvz/pkg/store"
+	"github.com/mac-vz/macvz/pkg/store/filenames"
+	"github.com/mattn/go-isatty"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var execHelp = `Execute a command in MacVZ through the guest agent, without SSH.
+
+The command is not run by a shell, and exits with the exit code of the command.
+A TTY is allocated when stdin and stdout are terminals, unless --tty=false is specified.`
+
+func newExecCommand() *cobra.Command {
+	var execCmd = &cobra.Command{
+		Use:   "exec INSTANCE COMMAND [ARGS...]",
+		Short: "Execute a command in MacVZ through the guest agent",
+		Long:  execHelp,
+		Example: `  Show the processes of the default instance:
+  $ macvz exec default -- ps aux`,
+		Args:              cobra.MinimumNArgs(2),
+		RunE:              execAction,
+		ValidArgsFunction: execBashComplete,
+		SilenceErrors:     true,
+	}
+
+	execCmd.Flags().SetInterspersed(false)
+
+	execCmd.Flags().String("workdir", "", "working directory (default: the home of the user)")
+	execCmd.Flags().StringArrayP("env", "e", nil, "set an environment variable (KEY=VALUE)")
+	execCmd.Flags().StringP("user", "u", "", "user to run the command as (default: the user of the instance)")
+	execCmd.Flags().BoolP("tty", "t", false, "allocate a TTY (default: true when stdin and stdout are terminals)")
+	return execCmd
+}
+
+func execAction(cmd *cobra.Command, args []string) error {
+	// simulate the behavior of double dash
+	if len(args) >= 2 && args[1] == "--" {
+		args = append(args[:1:1], args[2:]...)
+	}
+	if len(args) < 2 {
+		return errors.New("no command")
+	}
+	instName := args[0]
+
+	inst, err := store.Inspect(instName)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("instance %q does not exist, run `macvz start %s` to create a new instance", instName, instName)
+		}
+		return err
+	}
+	if inst.Status != store.StatusRunning {
+		return fmt.Errorf("instance %q is not running, run `macvz start %s` to start the instance", instName, instName)
+	}
+
+	workDir, err := cmd.Flags().GetString("workdir")
+	if err != nil {
+		return err
+	}
+	env, err := cmd.Flags().GetStringArray("env")
+	if err != nil {
+		return err
+	}
+	user, err := cmd.Flags().GetString("user")
+	if err != nil {
+		return err
+	}
+	tty := isatty.IsTerminal(os.Stdin.Fd()) && isatty.IsTerminal(os.Stdout.Fd())
+	if cmd.Flags().Changed("tty") {
+		if tty, err = cmd.Flags().GetBool("tty"); err != nil {
+			return err
+		}
+	}
+
+	req := api.ExecRequest{
+		Args: args[1:],
+		Env:  env,
+		Dir:  workDir,
+		User: user,
+		TTY:  tty,
+	}
+	stdinFd := int(os.Stdin.Fd())
+	if tty {
+		for _, key := range []string{"TERM", "COLORTERM"} {
+			if v, ok := os.LookupEnv(key); ok {
+				req.Env = append([]string{key + "=" + v}, req.Env...)
+			}
+		}
+		if rows, cols, err := osutil.TerminalSize(stdinFd); err == nil {
+			req.Rows, req.Cols = rows, cols
+		}
+	}
+
+	haClient, err := client.NewHostAgentClient(filepath.Join(inst.Dir, filenames.HaSock))
+	if err != nil {
+		return err
+	}
+	stream, err := haClient.Exec(cmd.Context(), req)
+	if err != nil {
+		return err
+	}
+	defer stream.Close()
+
+	var (
+		stderr io.Writer = os.Stderr
+		resize chan [2]uint16
+	)
+	if tty {
+		stderr = nil
+		if isatty.IsTerminal(os.Stdin.Fd()) {
+			restore, err := osutil.MakeRaw(stdinFd)
+			if err != nil {
+				return fmt.Errorf("failed to put the terminal into raw mode: %w", err)
+			}
+			defer func() {
+				if err := restore(); err != nil {
+					logrus.WithError(err).Warn("failed to restore the terminal")
+				}
+			}()
+
+			resize = make(chan [2]uint16, 1)
+			sigwinch := make(chan os.Signal, 1)
+			signal.Notify(sigwinch, syscall.SIGWINCH)
+			defer signal.Stop(sigwinch)
+			go func() {
+				for range sigwinch {
+					if rows, cols, err := osutil.TerminalSize(stdinFd); err == nil {
+						select {
+						case resize <- [2]uint16{rows, cols}:
+						default:
+						}
+					}
+				}
+			}()
+		}
+	}
+
+	code, err := socket.StreamExec(stream, os.Stdin, os.Stdout, stderr, resize)
+	if err != nil {
+		return err
+	}
+	if code != 0 {
+		return execExitError(code)
+	}
+	return nil
+}
+
+// execExitError is the exit code of the command, with which macvz exits, see handleExitCoder
+type execExitError int
+
+func (e execExitError) Error() string {
+	return fmt.Sprintf("exit status %d", int(e))
+}
+
+func (e execExitError) ExitCode() int {
+	return int(e)
+}
+
+func execBashComplete(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+	return bashCompleteInstanceNames(cmd)
+}
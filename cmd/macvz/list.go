@@ -0,0 +1,176 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"text/template"
+
+	"github.com/docker/go-units"
+	"github.com/mac-vz/macvz/pkg/store"
+	"github.com/mac-vz/macvz/pkg/types"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+func newListCommand() *cobra.Command {
+	var listCommand = &cobra.Command{
+		Use:     "list [flags] [INSTANCE]...",
+		Aliases: []string{"ls"},
+		Short:   "List instances of macvz",
+		Long: `List instances of macvz.
+
+The output can be presented in one of several formats:
+  (default)                 a table of name, status, guest IP, CPUs, memory, disk, disk usage and dir
+  --json                    one JSON object per line
+  --format '{{.Name}}'      a Go template, executed for each instance
+
+The fields available for --format are the ones of store.FormatData, e.g. .Name, .Status,
+.Dir, .CPUs, .Memory, .Disk, .IPAddress, .Guest, .HostOS, .HostArch, .MacVZHome and .IdentityFile.
+.Guest is the latest information reported by the guest agent of a running instance, e.g.
+.Guest.OSRelease.PrettyName, .Guest.Kernel and .Guest.Stats.DiskAvailable; it is nil otherwise.
+
+The disk usage is the one of the root filesystem of the guest, updated every 30 seconds.`,
+		Args:              cobra.ArbitraryArgs,
+		RunE:              listAction,
+		ValidArgsFunction: listBashComplete,
+	}
+
+	listCommand.Flags().StringP("format", "f", "", "Format the output using the given Go template")
+	listCommand.Flags().Bool("json", false, "JSONify output")
+	listCommand.Flags().BoolP("quiet", "q", false, "Only show names")
+	return listCommand
+}
+
+func listAction(cmd *cobra.Command, args []string) error {
+	quiet, err := cmd.Flags().GetBool("quiet")
+	if err != nil {
+		return err
+	}
+	goFormat, err := cmd.Flags().GetString("format")
+	if err != nil {
+		return err
+	}
+	jsonFormat, err := cmd.Flags().GetBool("json")
+	if err != nil {
+		return err
+	}
+	if goFormat != "" && jsonFormat {
+		return errors.New("option --format conflicts with --json")
+	}
+
+	instNames, err := store.Instances()
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			// No instance has been created yet
+			return nil
+		}
+		return err
+	}
+	if len(args) > 0 {
+		instNames, err = filterInstances(instNames, args)
+		if err != nil {
+			return err
+		}
+	}
+
+	if quiet {
+		for _, instName := range instNames {
+			fmt.Fprintln(cmd.OutOrStdout(), instName)
+		}
+		return nil
+	}
+
+	var instances []*store.Instance
+	for _, instName := range instNames {
+		inst, err := store.Inspect(instName)
+		if err != nil {
+			logrus.WithError(err).Errorf("unable to inspect instance %q", instName)
+			continue
+		}
+		for _, instErr := range inst.Errors {
+			logrus.WithError(instErr).Warnf("instance %q has errors", instName)
+		}
+		instances = append(instances, inst)
+	}
+
+	if goFormat != "" {
+		tmpl, err := template.New("format").Parse(goFormat)
+		if err != nil {
+			return fmt.Errorf("invalid format %q: %w", goFormat, err)
+		}
+		for _, inst := range instances {
+			data, err := store.AddGlobalFields(inst)
+			if err != nil {
+				return err
+			}
+			if err := tmpl.Execute(cmd.OutOrStdout(), data); err != nil {
+				return err
+			}
+			fmt.Fprintln(cmd.OutOrStdout())
+		}
+		return nil
+	}
+
+	if jsonFormat {
+		for _, inst := range instances {
+			b, err := json.Marshal(inst)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintln(cmd.OutOrStdout(), string(b))
+		}
+		return nil
+	}
+
+	w := tabwriter.NewWriter(cmd.OutOrStdout(), 4, 8, 4, ' ', 0)
+	fmt.Fprintln(w, "NAME\tSTATUS\tIP\tCPUS\tMEMORY\tDISK\tDISK USED\tDIR")
+	for _, inst := range instances {
+		ip := inst.IPAddress
+		if ip == "" {
+			ip = "-"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%s\t%s\t%s\t%s\n",
+			inst.Name,
+			inst.Status,
+			ip,
+			inst.CPUs,
+			units.BytesSize(float64(inst.Memory)),
+			units.BytesSize(float64(inst.Disk)),
+			diskUsage(inst.Guest),
+			inst.Dir,
+		)
+	}
+	return w.Flush()
+}
+
+// diskUsage formats the usage of the root filesystem of the guest, e.g. "3.2GiB (13%)"
+func diskUsage(guest *types.GuestInfo) string {
+	if guest == nil || guest.Stats == nil || guest.Stats.DiskTotal == 0 {
+		return "-"
+	}
+	used := guest.Stats.DiskTotal - guest.Stats.DiskAvailable
+	return fmt.Sprintf("%s (%d%%)", units.BytesSize(float64(used)), used*100/guest.Stats.DiskTotal)
+}
+
+// filterInstances returns the names in args, in the order of args, failing on unknown names
+func filterInstances(instNames, args []string) ([]string, error) {
+	known := make(map[string]bool, len(instNames))
+	for _, instName := range instNames {
+		known[instName] = true
+	}
+	var res []string
+	for _, arg := range args {
+		if !known[arg] {
+			return nil, fmt.Errorf("instance %q does not exist", arg)
+		}
+		res = append(res, arg)
+	}
+	return res, nil
+}
+
+func listBashComplete(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+	return bashCompleteInstanceNames(cmd)
+}
@@ -31,8 +31,17 @@ func newApp() *cobra.Command {
 		Example: fmt.Sprintf(`  Start the default instance:
   $ macvz start
 
+  Run a command in the default instance:
+  $ macvz exec default -- uname -a
+
   Stop the default instance:
-  $ macvz stop`),
+  $ macvz stop
+
+  List all instances:
+  $ macvz list
+
+  Delete the default instance:
+  $ macvz delete default`),
 		SilenceUsage:  true,
 		SilenceErrors: true,
 	}
@@ -56,7 +65,13 @@ func newApp() *cobra.Command {
 		newStartCommand(),
 		newVZCommand(),
 		newShellCommand(),
+		newExecCommand(),
+		newCopyCommand(),
+		newShowSSHCommand(),
 		newStopCommand(),
+		newListCommand(),
+		newDeleteCommand(),
+		newDNSCommand(),
 	)
 	return rootCmd
 }
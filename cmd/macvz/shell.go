@@ -111,7 +111,12 @@ func shellAction(cmd *cobra.Command, args []string) error {
 		return err
 	}
 
-	sshOpts, err := sshutil.SSHOpts(inst.Dir, true, false)
+	sshOpts, err := sshutil.SSHOpts(inst.Dir, *y.User.Name, *y.SSH.Port, true, false)
+	if err != nil {
+		return err
+	}
+
+	remote, err := sshutil.SSHRemoteUser(inst.Dir, *y.MACAddress, *y.User.Name)
 	if err != nil {
 		return err
 	}
@@ -127,7 +132,7 @@ func shellAction(cmd *cobra.Command, args []string) error {
 	}
 	sshArgs = append(sshArgs, []string{
 		"-q",
-		fmt.Sprintf("%s", sshutil.SSHRemoteUser(*y.MACAddress)),
+		remote,
 		"--",
 		script,
 	}...)
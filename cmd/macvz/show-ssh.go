@@ -0,0 +1,82 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/mac-vz/macvz/pkg/sshutil"
+	"github.com/mac-vz/macvz/pkg/store"
+	"github.com/spf13/cobra"
+)
+
+const showSSHExample = `
+  "cmd" format (default): Full ssh command line.
+  $ macvz show-ssh --format=cmd default
+  ssh -F /dev/null -o 'IdentityFile="/Users/example/.macvz/_config/user"' -o User=example -o Hostname=192.168.64.2 macvz-default
+
+  "args" format: Similar to the cmd format but omits "ssh" and the destination address.
+  $ macvz show-ssh --format=args default
+  -F /dev/null -o 'IdentityFile="/Users/example/.macvz/_config/user"' -o User=example -o Hostname=192.168.64.2
+
+  "options" format: ssh option key value pairs.
+  $ macvz show-ssh --format=options default
+  IdentityFile="/Users/example/.macvz/_config/user"
+  User=example
+  Hostname=192.168.64.2
+
+  "config" format: ssh_config(5) stanza, e.g. for VS Code Remote-SSH or Ansible.
+  $ macvz show-ssh --format=config default >> ~/.ssh/config
+  $ ssh macvz-default
+`
+
+func newShowSSHCommand() *cobra.Command {
+	var showSSHCmd = &cobra.Command{
+		Use:               "show-ssh [flags] INSTANCE",
+		Short:             "Show the ssh command line of an instance",
+		Example:           showSSHExample,
+		Args:              cobra.ExactArgs(1),
+		RunE:              showSSHAction,
+		ValidArgsFunction: showSSHBashComplete,
+		SilenceErrors:     true,
+	}
+
+	showSSHCmd.Flags().StringP("format", "f", sshutil.FormatCmd, "Format: "+strings.Join(sshutil.Formats, ", "))
+	_ = showSSHCmd.RegisterFlagCompletionFunc("format", func(*cobra.Command, []string, string) ([]string, cobra.ShellCompDirective) {
+		return sshutil.Formats, cobra.ShellCompDirectiveNoFileComp
+	})
+	return showSSHCmd
+}
+
+func showSSHAction(cmd *cobra.Command, args []string) error {
+	format, err := cmd.Flags().GetString("format")
+	if err != nil {
+		return err
+	}
+	instName := args[0]
+	inst, err := store.Inspect(instName)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("instance %q does not exist, run `macvz start %s` to create a new instance", instName, instName)
+		}
+		return err
+	}
+	if inst.IPAddress == "" {
+		return fmt.Errorf("the IP address of instance %q is unknown (status %q), run `macvz start %s` to start the instance", instName, inst.Status, instName)
+	}
+	y, err := inst.LoadYAML()
+	if err != nil {
+		return err
+	}
+	opts, err := sshutil.SSHOpts(inst.Dir, *y.User.Name, *y.SSH.Port, true, false)
+	if err != nil {
+		return err
+	}
+	opts = append(opts, "Hostname="+inst.IPAddress)
+	return sshutil.Format(cmd.OutOrStdout(), instName, format, opts)
+}
+
+func showSSHBashComplete(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+	return bashCompleteInstanceNames(cmd)
+}
@@ -1,14 +1,22 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"github.com/mac-vz/macvz/pkg/hostagent"
+	"github.com/mac-vz/macvz/pkg/hostagent/api/client"
+	"github.com/mac-vz/macvz/pkg/hostagent/events"
 	"github.com/mac-vz/macvz/pkg/store"
+	"github.com/mac-vz/macvz/pkg/store/filenames"
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"syscall"
+	"time"
 )
 
 func newStopCommand() *cobra.Command {
@@ -21,6 +29,7 @@ func newStopCommand() *cobra.Command {
 	}
 
 	stopCmd.Flags().BoolP("force", "f", false, "force stop the instance")
+	stopCmd.Flags().Duration("timeout", 3*time.Minute, "duration to wait for the instance to shut down, before stopping it forcibly")
 	return stopCmd
 }
 
@@ -39,28 +48,145 @@ func stopAction(cmd *cobra.Command, args []string) error {
 	if err != nil {
 		return err
 	}
+	timeout, err := cmd.Flags().GetDuration("timeout")
+	if err != nil {
+		return err
+	}
 	if force {
-		stopInstanceForcibly(inst)
+		stopInstanceForcibly(cmd.Context(), inst)
 	} else {
-		err = stopInstanceGracefully(inst)
+		err = stopInstanceGracefully(cmd.Context(), inst, timeout)
 	}
 	return err
 }
 
-func stopInstanceGracefully(inst *store.Instance) error {
+func stopInstanceGracefully(ctx context.Context, inst *store.Instance, timeout time.Duration) error {
 	if inst.Status != store.StatusRunning {
 		return fmt.Errorf("expected status %q, got %q (maybe use `macvz stop -f`?)", store.StatusRunning, inst.Status)
 	}
 
-	logrus.Infof("Sending SIGINT to vz process %d", inst.VZPid)
-	if err := syscall.Kill(inst.VZPid, syscall.SIGINT); err != nil {
-		logrus.Error(err)
+	begin := time.Now() // used for logrus propagation
+	if err := requestStop(ctx, inst); err != nil {
+		logrus.WithError(err).Debug("failed to request the host agent to stop via its API")
+		logrus.Infof("Sending SIGINT to vz process %d", inst.VZPid)
+		if err := syscall.Kill(inst.VZPid, syscall.SIGINT); err != nil {
+			logrus.Error(err)
+		}
+	}
+
+	logrus.Infof("Waiting for the instance to shut down (timeout %v)", timeout)
+	err := waitForShutdown(ctx, inst, begin, timeout)
+	if errors.Is(err, context.DeadlineExceeded) && ctx.Err() == nil {
+		logrus.Warnf("The instance did not shut down in %v, stopping it forcibly", timeout)
+		stopInstanceForcibly(ctx, inst)
+		return fmt.Errorf("instance %q did not shut down in %v and had to be stopped forcibly", inst.Name, timeout)
+	}
+	if err != nil {
+		return fmt.Errorf("instance %q did not shut down cleanly: %w", inst.Name, err)
+	}
+	logrus.Infof("Stopped %q", inst.Name)
+	return nil
+}
+
+// requestStop asks the host agent to stop the instance via the API served on ha.sock
+func requestStop(ctx context.Context, inst *store.Instance) error {
+	haClient, err := client.NewHostAgentClient(filepath.Join(inst.Dir, filenames.HaSock))
+	if err != nil {
+		return err
+	}
+	logrus.Infof("Requesting the host agent (pid %d) to stop the instance", inst.VZPid)
+	return haClient.Stop(ctx)
+}
+
+// waitForShutdown waits for the `exiting` event of the host agent and for the removal of the pid file,
+// which the host agent only does once the guest has reached the stopped state.
+func waitForShutdown(ctx context.Context, inst *store.Instance, begin time.Time, timeout time.Duration) error {
+	ctx2, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	exitingCh := make(chan events.Status, 1)
+	watchErrCh := make(chan error, 1)
+	go func() {
+		haStdoutPath := filepath.Join(inst.Dir, filenames.HaStdoutLog)
+		haStderrPath := filepath.Join(inst.Dir, filenames.HaStderrLog)
+		onEvent := func(ev events.Event) bool {
+			if ev.Status.Exiting {
+				exitingCh <- ev.Status
+				return true
+			}
+			return false
+		}
+		if err := events.Watch(ctx2, haStdoutPath, haStderrPath, begin, onEvent); err != nil {
+			watchErrCh <- err
+		}
+	}()
+
+	var (
+		exiting  *events.Status
+		watching = true
+	)
+	vzPidFile := filepath.Join(inst.Dir, filenames.VZPid)
+	for {
+		if _, err := os.Stat(vzPidFile); errors.Is(err, os.ErrNotExist) {
+			// Without the events, the removal of the pid file is the only sign of completion
+			if exiting != nil || !watching {
+				break
+			}
+		} else if vzExitedUncleanly(vzPidFile) {
+			return fmt.Errorf("vz process %d exited before the guest was stopped", inst.VZPid)
+		}
+
+		select {
+		case <-ctx2.Done():
+			return ctx2.Err()
+		case st := <-exitingCh:
+			exiting = &st
+		case err := <-watchErrCh:
+			logrus.WithError(err).Warn("failed to watch the host agent events, relying on the pid file")
+			watching = false
+		case <-time.After(500 * time.Millisecond):
+		}
+	}
+
+	if exiting != nil && len(exiting.Errors) > 0 {
+		return fmt.Errorf("%+v", exiting.Errors)
 	}
-	//TODO - Check the log for termination
 	return nil
 }
 
-func stopInstanceForcibly(inst *store.Instance) {
+// vzExitedUncleanly returns true when the vz process of pidFile is gone, but its pid file is still there.
+// On a clean stop, the pid file is removed by the vz process before it exits, possibly while it is checked here,
+// so a missing pid file is not treated as a crash. The stale pid file is removed.
+func vzExitedUncleanly(pidFile string) bool {
+	b, err := os.ReadFile(pidFile)
+	if err != nil {
+		return false
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(b)))
+	if err != nil {
+		return false
+	}
+	proc, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	if err := proc.Signal(syscall.Signal(0)); !errors.Is(err, os.ErrProcessDone) {
+		return false
+	}
+	if _, err := os.Stat(pidFile); err != nil {
+		return false
+	}
+	_ = os.Remove(pidFile)
+	return true
+}
+
+func stopInstanceForcibly(ctx context.Context, inst *store.Instance) {
+	// The forwards are still reachable through the SSH control socket, which is removed below
+	logrus.Info("Cancelling the socket forwards and the SSH control master")
+	if err := hostagent.CancelForwards(ctx, inst); err != nil {
+		logrus.WithError(err).Debug("failed to cancel the forwards (negligible if the host agent had already cleaned up)")
+	}
+
 	if inst.VZPid > 0 {
 		logrus.Infof("Sending SIGKILL to the vz process %d", inst.VZPid)
 		if err := syscall.Kill(inst.VZPid, syscall.SIGKILL); err != nil {
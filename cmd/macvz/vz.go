@@ -1,13 +1,20 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"github.com/mac-vz/macvz/pkg/hostagent"
+	"github.com/mac-vz/macvz/pkg/hostagent/api/server"
+	"github.com/mac-vz/macvz/pkg/store"
+	"github.com/mac-vz/macvz/pkg/store/filenames"
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
 	"io"
+	"net"
+	"net/http"
 	"os"
 	"os/signal"
+	"path/filepath"
 )
 
 func newVZCommand() *cobra.Command {
@@ -39,9 +46,34 @@ func vzAction(cmd *cobra.Command, args []string) error {
 		return err
 	}
 	ctx := cmd.Context()
+
+	instDir, err := store.InstanceDir(instName)
+	if err != nil {
+		return err
+	}
+	haSock := filepath.Join(instDir, filenames.HaSock)
+	// A stale socket may be left behind when the previous host agent was killed
+	if err := os.Remove(haSock); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	l, err := net.Listen("unix", haSock)
 	if err != nil {
 		return err
 	}
+	mux := http.NewServeMux()
+	server.AddRoutes(mux, &server.Backend{Agent: agent})
+	srv := &http.Server{Handler: mux}
+	go func() {
+		if err := srv.Serve(l); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logrus.WithError(err).Warn("host agent API server exited")
+		}
+	}()
+	defer func() {
+		_ = srv.Close()
+		_ = os.RemoveAll(haSock)
+	}()
+	logrus.Infof("Serving the host agent API on %q", haSock)
+
 	return agent.Run(ctx)
 }
 
@@ -40,7 +40,7 @@ if [ -d "${MACVZ_CIDATA_MNT}"/provision.system ]; then
 	done
 fi
 
-USER_SCRIPT="/home/${MACVZ_CIDATA_USER}.linux/.macvz-user-script"
+USER_SCRIPT="${MACVZ_CIDATA_HOME}/.macvz-user-script"
 if [ -d "${MACVZ_CIDATA_MNT}"/provision.user ]; then
 	if [ ! -f /sbin/openrc-init ]; then
 		until [ -e "/run/user/${MACVZ_CIDATA_UID}/systemd/private" ]; do sleep 3; done
@@ -0,0 +1,32 @@
+#!/bin/sh
+set -eux
+
+# sshd listens on the port of `ssh.port` in macvz.yaml.
+# It must be reconfigured before 07-etc-environment.sh opens the "macvz-ssh-ready" gate.
+
+conf=/etc/ssh/sshd_config.d/macvz-port.conf
+if [ "${MACVZ_CIDATA_SSH_PORT}" -eq 22 ]; then
+	if [ ! -e "${conf}" ]; then
+		exit 0
+	fi
+	rm -f "${conf}"
+else
+	if [ "$(cat "${conf}" 2>/dev/null)" = "Port ${MACVZ_CIDATA_SSH_PORT}" ]; then
+		exit 0
+	fi
+	mkdir -p /etc/ssh/sshd_config.d
+	if ! grep -q "^Include /etc/ssh/sshd_config.d/" /etc/ssh/sshd_config; then
+		sed -i '1i Include /etc/ssh/sshd_config.d/*.conf' /etc/ssh/sshd_config
+	fi
+	echo "Port ${MACVZ_CIDATA_SSH_PORT}" >"${conf}"
+fi
+
+if [ -f /sbin/openrc-init ]; then
+	rc-service sshd restart
+elif systemctl is-active --quiet ssh.socket; then
+	# the port of the socket is generated from sshd_config, see sshd-socket-generator(8)
+	systemctl daemon-reload
+	systemctl restart ssh.socket
+else
+	systemctl restart ssh || systemctl restart sshd
+fi
@@ -6,17 +6,17 @@ command -v systemctl >/dev/null 2>&1 || exit 0
 
 # Set up env
 for f in .profile .bashrc; do
-	if ! grep -q "# Macvz BEGIN" "/home/${MACVZ_CIDATA_USER}.linux/$f"; then
-		cat >>"/home/${MACVZ_CIDATA_USER}.linux/$f" <<EOF
+	if ! grep -q "# Macvz BEGIN" "${MACVZ_CIDATA_HOME}/$f"; then
+		cat >>"${MACVZ_CIDATA_HOME}/$f" <<EOF
 # Macvz BEGIN
 # Make sure iptables and mount.fuse3 are available
 PATH="\$PATH:/usr/sbin:/sbin"
 export PATH
 EOF
-		cat >>"/home/${MACVZ_CIDATA_USER}.linux/$f" <<EOF
+		cat >>"${MACVZ_CIDATA_HOME}/$f" <<EOF
 # Macvz END
 EOF
-		chown "${MACVZ_CIDATA_USER}" "/home/${MACVZ_CIDATA_USER}.linux/$f"
+		chown "${MACVZ_CIDATA_USER}" "${MACVZ_CIDATA_HOME}/$f"
 	fi
 done
 # Enable cgroup delegation (only meaningful on cgroup v2)
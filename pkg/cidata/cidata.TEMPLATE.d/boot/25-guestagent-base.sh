@@ -32,7 +32,7 @@ EOF
 	rc-service macvz-guestagent start
 else
 	# Remove legacy systemd service
-	rm -f "/home/${MACVZ_CIDATA_USER}.linux/.config/systemd/user/macvz-guestagent.service"
+	rm -f "${MACVZ_CIDATA_HOME}/.config/systemd/user/macvz-guestagent.service"
 
 	sudo /usr/local/bin/macvz-guestagent install-systemd
 fi
@@ -10,7 +10,6 @@ import (
 	"io/fs"
 	"os"
 	"path/filepath"
-	"strconv"
 	"strings"
 	"time"
 
@@ -23,18 +22,15 @@ func GenerateISO9660(instDir, name string, y *yaml.MacVZYaml) error {
 	if err := yaml.Validate(*y, false); err != nil {
 		return err
 	}
-	u, err := osutil.MacVZUser(true)
-	if err != nil {
-		return err
-	}
-	uid, err := strconv.Atoi(u.Uid)
-	if err != nil {
-		return err
-	}
+	// warn about an invalid host username, replaced by the default of user.name
+	_, _ = osutil.MacVZUser(true)
 	args := TemplateArgs{
-		Name: name,
-		User: u.Username,
-		UID:  uid,
+		Name:    name,
+		User:    *y.User.Name,
+		UID:     *y.User.UID,
+		Home:    *y.User.Home,
+		Shell:   *y.User.Shell,
+		SSHPort: *y.SSH.Port,
 	}
 
 	// change instance id on every boot so network config will be processed again
@@ -51,6 +47,12 @@ func GenerateISO9660(instDir, name string, y *yaml.MacVZYaml) error {
 		args.SSHPubKeys = append(args.SSHPubKeys, f.Content)
 	}
 
+	hostKey, err := sshutil.EnsureHostKey(instDir)
+	if err != nil {
+		return err
+	}
+	args.SSHHostKey = *hostKey
+
 	if *y.HostResolver.Enabled {
 		//TODO - Random post assignment in guest or replace port 53
 		args.UDPDNSLocalPort = 23
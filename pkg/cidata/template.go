@@ -6,6 +6,7 @@ import (
 	"errors"
 	"fmt"
 	"github.com/mac-vz/macvz/pkg/iso9660util"
+	"github.com/mac-vz/macvz/pkg/sshutil"
 	"io/fs"
 
 	"github.com/mac-vz/macvz/pkg/templateutil"
@@ -25,7 +26,11 @@ type TemplateArgs struct {
 	IID             string // instance id
 	User            string // user name
 	UID             int
+	Home            string // home directory of the user
+	Shell           string // login shell of the user
+	SSHPort         int    // port of sshd
 	SSHPubKeys      []string
+	SSHHostKey      sshutil.HostKey
 	UDPDNSLocalPort int
 	TCPDNSLocalPort int
 	Env             map[string]string
@@ -38,9 +43,21 @@ func ValidateTemplateArgs(args TemplateArgs) error {
 	if args.UID == 0 {
 		return errors.New("field UID must not be 0")
 	}
+	if args.Home == "" {
+		return errors.New("field Home must be set")
+	}
+	if args.Shell == "" {
+		return errors.New("field Shell must be set")
+	}
+	if args.SSHPort == 0 {
+		return errors.New("field SSHPort must be set")
+	}
 	if len(args.SSHPubKeys) == 0 {
 		return errors.New("field SSHPubKeys must be set")
 	}
+	if args.SSHHostKey.Private == "" || args.SSHHostKey.Public == "" {
+		return errors.New("field SSHHostKey must be set")
+	}
 	return nil
 }
 
@@ -0,0 +1,65 @@
+package guestagent
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/elastic/go-libaudit/v2"
+	"github.com/elastic/go-libaudit/v2/rule"
+	"github.com/elastic/go-libaudit/v2/rule/flags"
+	"github.com/sirupsen/logrus"
+)
+
+// bindAuditKey is the key of the audit rule that reports bind(2) and listen(2)
+const bindAuditKey = "macvz-bind"
+
+// addBindAuditRule adds an audit rule, so that the multicast audit client receives an AUDIT_SYSCALL message
+// whenever a process binds or listens on a socket.
+//
+// The agent itself and its children (iptables, nft) are excluded, as they bind netlink sockets
+// while collecting the ports.
+func addBindAuditRule() error {
+	client, err := libaudit.NewAuditClient(nil)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	// Delete the rules left by a previous instance of the agent, as they exclude another pid
+	existing, err := client.GetRules()
+	if err != nil {
+		return err
+	}
+	for _, wire := range existing {
+		cmdline, err := rule.ToCommandLine(wire, false)
+		if err != nil || !strings.Contains(cmdline, "key="+bindAuditKey) && !strings.Contains(cmdline, "-k "+bindAuditKey) {
+			continue
+		}
+		if err := client.DeleteRule(wire); err != nil {
+			logrus.WithError(err).Warnf("failed to delete the stale audit rule %q", cmdline)
+		}
+	}
+
+	pid := os.Getpid()
+	cmdline := fmt.Sprintf("-a always,exit -F arch=b64 -S bind -S listen -F success=1 -F pid!=%d -F ppid!=%d -k %s", pid, pid, bindAuditKey)
+	r, err := flags.Parse(cmdline)
+	if err != nil {
+		return err
+	}
+	wire, err := rule.Build(r)
+	if err != nil {
+		return err
+	}
+	if err := client.AddRule(wire); err != nil {
+		return fmt.Errorf("failed to add the audit rule %q: %w", cmdline, err)
+	}
+	logrus.Debugf("added the audit rule %q", cmdline)
+	return nil
+}
+
+// isBindAuditMessage returns true for the AUDIT_SYSCALL messages of the rule added by addBindAuditRule
+func isBindAuditMessage(data []byte) bool {
+	return bytes.Contains(data, []byte(`key="`+bindAuditKey+`"`))
+}
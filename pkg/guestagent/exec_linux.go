@@ -0,0 +1,308 @@
+package guestagent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/mac-vz/macvz/pkg/socket"
+	"github.com/mac-vz/macvz/pkg/types"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+// execPath is the PATH of the commands run for the host
+const execPath = "/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin"
+
+// handleExec starts a command for the host, and streams its stdin, stdout and stderr
+// in the frames of socket.ExecFrameWriter that follow the response
+func (a *agent) handleExec(ctx context.Context, req *socket.Request) (interface{}, error) {
+	var event types.ExecEvent
+	if err := req.Decode(&event); err != nil {
+		return nil, err
+	}
+	cmd, err := execCommand(event)
+	if err != nil {
+		return nil, err
+	}
+	var p *execProcess
+	if event.TTY {
+		p, err = startTTY(cmd, event.Rows, event.Cols)
+	} else {
+		p, err = startPipes(cmd)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to start %v: %w", event.Args, err)
+	}
+	logrus.Debugf("started %v (pid %d) for the host", event.Args, cmd.Process.Pid)
+	req.Hijack(p.relay)
+	res := types.ExecEventResponse{}
+	res.Kind = types.ExecResponseMessage
+	return &res, nil
+}
+
+// execCommand creates the command of event, running as event.User with its environment
+func execCommand(event types.ExecEvent) (*exec.Cmd, error) {
+	if len(event.Args) == 0 {
+		return nil, errors.New("no command")
+	}
+	username := event.User
+	if username == "" {
+		username = "root"
+	}
+	u, err := user.Lookup(username)
+	if err != nil {
+		return nil, err
+	}
+	uid, err := strconv.ParseUint(u.Uid, 10, 32)
+	if err != nil {
+		return nil, err
+	}
+	gid, err := strconv.ParseUint(u.Gid, 10, 32)
+	if err != nil {
+		return nil, err
+	}
+	groupIDs, err := u.GroupIds()
+	if err != nil {
+		return nil, err
+	}
+	var groups []uint32
+	for _, g := range groupIDs {
+		if id, err := strconv.ParseUint(g, 10, 32); err == nil {
+			groups = append(groups, uint32(id))
+		}
+	}
+
+	env := []string{
+		"HOME=" + u.HomeDir,
+		"USER=" + u.Username,
+		"LOGNAME=" + u.Username,
+		"PATH=" + execPath,
+	}
+	env = append(env, event.Env...)
+	path, err := lookPath(event.Args[0], env)
+	if err != nil {
+		return nil, err
+	}
+	cmd := &exec.Cmd{
+		Path: path,
+		Args: event.Args,
+		Env:  env,
+		Dir:  event.Dir,
+		SysProcAttr: &syscall.SysProcAttr{
+			Credential: &syscall.Credential{
+				Uid:    uint32(uid),
+				Gid:    uint32(gid),
+				Groups: groups,
+			},
+		},
+	}
+	if cmd.Dir == "" {
+		cmd.Dir = u.HomeDir
+	}
+	return cmd, nil
+}
+
+// lookPath is like exec.LookPath, but with the PATH of env instead of the one of the guest agent
+func lookPath(file string, env []string) (string, error) {
+	if strings.Contains(file, "/") {
+		return file, nil
+	}
+	var pathEnv string
+	for _, e := range env {
+		if strings.HasPrefix(e, "PATH=") {
+			pathEnv = strings.TrimPrefix(e, "PATH=")
+		}
+	}
+	for _, dir := range filepath.SplitList(pathEnv) {
+		if dir == "" {
+			dir = "."
+		}
+		path := filepath.Join(dir, file)
+		if st, err := os.Stat(path); err == nil && st.Mode().IsRegular() && st.Mode()&0111 != 0 {
+			return path, nil
+		}
+	}
+	return "", fmt.Errorf("%q: %w", file, exec.ErrNotFound)
+}
+
+// execProcess is a command started by handleExec
+type execProcess struct {
+	cmd *exec.Cmd
+	// stdin is the stdin pipe, or the PTY master
+	stdin io.WriteCloser
+	// outputs are read until EOF before waiting for the command, as stdout and stderr
+	outputs [2]io.Reader
+	// ptmx is the PTY master when a TTY is allocated
+	ptmx *os.File
+}
+
+func startPipes(cmd *exec.Cmd) (*execProcess, error) {
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	return &execProcess{
+		cmd:     cmd,
+		stdin:   stdin,
+		outputs: [2]io.Reader{stdout, stderr},
+	}, nil
+}
+
+func startTTY(cmd *exec.Cmd, rows, cols uint16) (*execProcess, error) {
+	ptmx, tty, err := openPTY()
+	if err != nil {
+		return nil, err
+	}
+	if rows > 0 && cols > 0 {
+		if err := unix.IoctlSetWinsize(int(ptmx.Fd()), unix.TIOCSWINSZ, &unix.Winsize{Row: rows, Col: cols}); err != nil {
+			logrus.WithError(err).Debug("failed to set the size of the TTY")
+		}
+	}
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = tty, tty, tty
+	cmd.SysProcAttr.Setsid = true
+	cmd.SysProcAttr.Setctty = true
+	if err := cmd.Start(); err != nil {
+		_ = ptmx.Close()
+		_ = tty.Close()
+		return nil, err
+	}
+	_ = tty.Close()
+	return &execProcess{
+		cmd:     cmd,
+		stdin:   ptmx,
+		outputs: [2]io.Reader{ptmx, nil},
+		ptmx:    ptmx,
+	}, nil
+}
+
+// openPTY opens a new PTY, see pty(7)
+func openPTY() (ptmx, tty *os.File, err error) {
+	ptmx, err = os.OpenFile("/dev/ptmx", os.O_RDWR|unix.O_NOCTTY, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+	fd := int(ptmx.Fd())
+	if err := unix.IoctlSetPointerInt(fd, unix.TIOCSPTLCK, 0); err != nil {
+		_ = ptmx.Close()
+		return nil, nil, fmt.Errorf("failed to unlock the PTY: %w", err)
+	}
+	n, err := unix.IoctlGetInt(fd, unix.TIOCGPTN)
+	if err != nil {
+		_ = ptmx.Close()
+		return nil, nil, fmt.Errorf("failed to get the number of the PTY: %w", err)
+	}
+	tty, err = os.OpenFile("/dev/pts/"+strconv.Itoa(n), os.O_RDWR|unix.O_NOCTTY, 0)
+	if err != nil {
+		_ = ptmx.Close()
+		return nil, nil, err
+	}
+	return ptmx, tty, nil
+}
+
+// relay streams the frames between stream and the command, until it exits.
+// The command is killed when the host closes the stream before.
+func (p *execProcess) relay(stream net.Conn) {
+	defer stream.Close()
+	w := socket.NewExecFrameWriter(stream)
+
+	exited := make(chan struct{})
+	go func() {
+		for {
+			kind, data, err := socket.ReadExecFrame(stream)
+			if err != nil {
+				select {
+				case <-exited:
+				default:
+					logrus.WithError(err).Debugf("the host closed the stream of pid %d, killing it", p.cmd.Process.Pid)
+					_ = p.cmd.Process.Kill()
+				}
+				return
+			}
+			switch kind {
+			case socket.ExecStdin:
+				if len(data) == 0 {
+					if p.ptmx == nil {
+						_ = p.stdin.Close()
+					} else {
+						// EOF, i.e. ^D
+						_, _ = p.stdin.Write([]byte{4})
+					}
+					continue
+				}
+				if _, err := p.stdin.Write(data); err != nil {
+					logrus.WithError(err).Debugf("failed to write to the stdin of pid %d", p.cmd.Process.Pid)
+				}
+			case socket.ExecResize:
+				rows, cols, err := socket.ParseResize(data)
+				if err != nil || p.ptmx == nil {
+					continue
+				}
+				if err := unix.IoctlSetWinsize(int(p.ptmx.Fd()), unix.TIOCSWINSZ, &unix.Winsize{Row: rows, Col: cols}); err != nil {
+					logrus.WithError(err).Debug("failed to set the size of the TTY")
+				}
+			}
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for i, streamKind := range []socket.ExecStream{socket.ExecStdout, socket.ExecStderr} {
+		r := p.outputs[i]
+		if r == nil {
+			continue
+		}
+		wg.Add(1)
+		go func(r io.Reader, streamKind socket.ExecStream) {
+			defer wg.Done()
+			// reading the PTY master fails with EIO once the command exited
+			_, _ = io.Copy(w.Writer(streamKind), r)
+		}(r, streamKind)
+	}
+	wg.Wait()
+	err := p.cmd.Wait()
+	close(exited)
+	if p.ptmx != nil {
+		_ = p.ptmx.Close()
+	}
+	code := exitCode(err)
+	logrus.Debugf("pid %d exited with %d", p.cmd.Process.Pid, code)
+	if err := w.WriteExit(code); err != nil {
+		logrus.WithError(err).Debugf("failed to send the exit code of pid %d", p.cmd.Process.Pid)
+	}
+}
+
+// exitCode returns the exit code of a command like a shell, i.e. 128+n when killed by the signal n
+func exitCode(err error) int {
+	if err == nil {
+		return 0
+	}
+	var exitErr *exec.ExitError
+	if !errors.As(err, &exitErr) {
+		return -1
+	}
+	if ws, ok := exitErr.Sys().(syscall.WaitStatus); ok && ws.Signaled() {
+		return 128 + int(ws.Signal())
+	}
+	return exitErr.ExitCode()
+}
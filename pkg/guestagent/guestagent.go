@@ -1,7 +1,16 @@
 package guestagent
 
+import (
+	"time"
+
+	"github.com/hashicorp/yamux"
+)
+
 type Agent interface {
-	PublishInfo()
+	// ServeSession serves a session with the host agent until it is closed
+	ServeSession(sess *yamux.Session)
 	StartDNS()
 	ListenAndSendEvents()
+	// ListenAndSendStats sends the resources of the guest every interval
+	ListenAndSendStats(interval time.Duration)
 }
@@ -1,14 +1,20 @@
 package guestagent
 
 import (
+	"context"
 	"encoding/binary"
 	"errors"
+	"fmt"
 	"github.com/hashicorp/yamux"
 	"github.com/joho/godotenv"
 	"github.com/mac-vz/macvz/pkg/guestagent/guestdns"
 	"github.com/mac-vz/macvz/pkg/socket"
 	"github.com/mac-vz/macvz/pkg/types"
+	"github.com/mac-vz/macvz/pkg/version"
+	"github.com/norouter/norouter/pkg/agent/bicopy"
+	"net"
 	"reflect"
+	"strings"
 	"sync"
 	"time"
 
@@ -16,17 +22,28 @@ import (
 	"github.com/elastic/go-libaudit/v2/auparse"
 	"github.com/mac-vz/macvz/pkg/guestagent/iptables"
 	"github.com/mac-vz/macvz/pkg/guestagent/procnettcp"
+	"github.com/mac-vz/macvz/pkg/guestagent/sockdiag"
+	"github.com/mac-vz/macvz/pkg/guestagent/sysinfo"
 	"github.com/mac-vz/macvz/pkg/guestagent/timesync"
 	"github.com/sirupsen/logrus"
 	"github.com/yalue/native_endian"
 )
 
-// New creates guest agent that takes care of guest to host communication
-func New(newTicker func() (<-chan time.Time, func()), sess *yamux.Session, iptablesIdle time.Duration) (Agent, error) {
+// New creates guest agent that takes care of guest to host communication.
+// The sessions with the host agent are served by ServeSession.
+//
+// When watchBind is true, the agent also collects the ports as soon as a process calls bind(2) or listen(2),
+// in addition to the ticks of newTicker.
+func New(newTicker func() (<-chan time.Time, func()), iptablesIdle time.Duration, watchBind bool) (Agent, error) {
 	a := &agent{
 		newTicker: newTicker,
-		sess:      sess,
+		mux:       socket.NewMux(),
+		bindCh:    make(chan struct{}, 1),
 	}
+	a.client = socket.NewClient(a.openStream)
+	a.mux.Handle(types.ConnectMessage, a.handleConnect)
+	a.mux.Handle(types.ExecMessage, a.handleExec)
+	a.mux.Handle(types.TimeMessage, a.handleTime)
 	go a.fixSystemTimeSkew()
 
 	auditClient, err := libaudit.NewMulticastAuditClient(nil)
@@ -43,6 +60,12 @@ func New(newTicker func() (<-chan time.Time, func()), sess *yamux.Session, iptab
 		}
 	}
 
+	if watchBind {
+		if err := addBindAuditRule(); err != nil {
+			logrus.WithError(err).Warn("failed to watch bind(2) and listen(2), falling back to polling")
+		}
+	}
+
 	go a.setWorthCheckingIPTablesRoutine(auditClient, iptablesIdle)
 	return a, nil
 }
@@ -52,12 +75,29 @@ type agent struct {
 	// We can't use inotify for /proc/net/tcp, so we need this ticker to
 	// reload /proc/net/tcp.
 	newTicker func() (<-chan time.Time, func())
-	sess      *yamux.Session
+	// sess is the current session with the host agent, nil while disconnected
+	sess *yamux.Session
+	// hostHello is the reply of the host agent to the handshake over sess, nil for older host agents
+	hostHello *types.HelloEvent
+	sessMu    sync.RWMutex
+	// client sends requests to the host agent, over the current session
+	client *socket.Client
+	// mux handles the requests of the host agent
+	mux *socket.Mux
+	// bindCh receives a value when a process called bind(2) or listen(2)
+	bindCh chan struct{}
+	// st is the state of the ports last sent to the host agent
+	st   eventState
+	stMu sync.Mutex
 
 	worthCheckingIPTables   bool
 	worthCheckingIPTablesMu sync.RWMutex
 	latestIPTables          []iptables.Entry
 	latestIPTablesMu        sync.RWMutex
+
+	// timeCorrection is the last correction of the system clock, reported in the stats
+	timeCorrection   *types.TimeCorrection
+	timeCorrectionMu sync.Mutex
 }
 
 // setWorthCheckingIPTablesRoutine sets worthCheckingIPTables to be true
@@ -93,6 +133,14 @@ func (a *agent) setWorthCheckingIPTablesRoutine(auditClient *libaudit.AuditClien
 			a.worthCheckingIPTables = true
 			latestTrue = time.Now()
 			a.worthCheckingIPTablesMu.Unlock()
+		case auparse.AUDIT_SYSCALL:
+			if isBindAuditMessage(msg.Data) {
+				select {
+				case a.bindCh <- struct{}{}:
+				default:
+					// a collection is already pending
+				}
+			}
 		}
 	}
 }
@@ -106,12 +154,12 @@ func comparePorts(old, neww []types.IPPort) (added, removed []types.IPPort) {
 	mStillExist := make(map[string]bool, len(old))
 
 	for _, f := range old {
-		k := f.String()
+		k := f.Proto() + ":" + f.String()
 		mRaw[k] = f
 		mStillExist[k] = false
 	}
 	for _, f := range neww {
-		k := f.String()
+		k := f.Proto() + ":" + f.String()
 		if _, ok := mRaw[k]; !ok {
 			added = append(added, f)
 		}
@@ -156,7 +204,7 @@ func isEventEmpty(ev types.PortEvent) bool {
 }
 
 func (a *agent) StartDNS() {
-	dnsServer, _ := guestdns.Start(23, 24, a.sess)
+	dnsServer, _ := guestdns.Start(23, 24, a.client)
 	defer dnsServer.Shutdown()
 }
 
@@ -164,48 +212,92 @@ func (a *agent) ListenAndSendEvents() {
 	tickerCh, tickerClose := a.newTicker()
 
 	defer tickerClose()
-	var st eventState
 	for {
-		var ev types.PortEvent
-		ev, st = a.collectEvent(st)
-		if !isEventEmpty(ev) {
-			encoder, _ := socket.GetIO(a.sess)
-			if encoder != nil {
-				socket.Write(encoder, ev)
-			}
-		}
+		a.sendEvent()
 		select {
 		case _, ok := <-tickerCh:
 			if !ok {
 				return
 			}
 			logrus.Debug("tick!")
+		case <-a.bindCh:
+			logrus.Debug("bind!")
 		}
 	}
 }
 
+// ListenAndSendStats sends the resources of the guest every interval, while connected to a host agent that receives them.
+// The first ones are sent along with the info.
+func (a *agent) ListenAndSendStats(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if !a.hostReceives(types.StatsMessage) {
+			continue
+		}
+		stats, err := sysinfo.Stats()
+		if err != nil {
+			logrus.WithError(err).Warn("failed to collect the stats")
+			continue
+		}
+		stats.TimeCorrection = a.lastTimeCorrection()
+		ev := types.StatsEvent{Stats: stats}
+		ev.Kind = types.StatsMessage
+		if err := a.client.Call(context.Background(), types.StatsMessage, &ev, nil); err != nil {
+			logrus.WithError(err).Debug("failed to send the stats")
+		}
+	}
+}
+
+// sendEvent sends the changes of the ports since the last event or snapshot, see publishInfo.
+// The changes are lost while disconnected, until the snapshot that follows the reconnection.
+func (a *agent) sendEvent() {
+	a.stMu.Lock()
+	defer a.stMu.Unlock()
+	var ev types.PortEvent
+	ev, a.st = a.collectEvent(a.st)
+	if isEventEmpty(ev) {
+		return
+	}
+	if err := a.client.Call(context.Background(), types.PortMessage, &ev, nil); err != nil {
+		logrus.WithError(err).Error("failed to send the port event")
+	}
+}
+
 func (a *agent) localPorts() ([]types.IPPort, error) {
 	if native_endian.NativeEndian() == binary.BigEndian {
 		return nil, errors.New("big endian architecture is unsupported, because I don't know how /proc/net/tcp looks like on big endian hosts")
 	}
 	var res []types.IPPort
-	tcpParsed, err := procnettcp.ParseFiles()
+	tcpParsed, err := sockdiag.List()
 	if err != nil {
-		return res, err
+		logrus.WithError(err).Debug("LocalPorts(): sock_diag failed, falling back to /proc/net")
+		tcpParsed, err = procnettcp.ParseFiles()
+		if err != nil {
+			return res, err
+		}
 	}
 
 	for _, f := range tcpParsed {
 		switch f.Kind {
 		case procnettcp.TCP, procnettcp.TCP6:
-		default:
-			continue
-		}
-		if f.State == procnettcp.TCPListen {
-			res = append(res,
-				types.IPPort{
-					IP:   f.IP,
-					Port: int(f.Port),
-				})
+			if f.State == procnettcp.TCPListen {
+				res = append(res,
+					types.IPPort{
+						IP:       f.IP,
+						Port:     int(f.Port),
+						Protocol: types.TCP,
+					})
+			}
+		case procnettcp.UDP, procnettcp.UDP6:
+			if f.State == procnettcp.UDPUnconnected {
+				res = append(res,
+					types.IPPort{
+						IP:       f.IP,
+						Port:     int(f.Port),
+						Protocol: types.UDP,
+					})
+			}
 		}
 	}
 
@@ -230,18 +322,23 @@ func (a *agent) localPorts() ([]types.IPPort, error) {
 	}
 
 	for _, ipt := range ipts {
+		proto := types.UDP
+		if ipt.TCP {
+			proto = types.TCP
+		}
 		// Make sure the port isn't already listed from procnettcp
 		found := false
 		for _, re := range res {
-			if re.Port == ipt.Port {
+			if re.Port == ipt.Port && re.Proto() == proto {
 				found = true
 			}
 		}
 		if !found {
 			res = append(res,
 				types.IPPort{
-					IP:   ipt.IP,
-					Port: ipt.Port,
+					IP:       ipt.IP,
+					Port:     ipt.Port,
+					Protocol: proto,
 				})
 		}
 	}
@@ -249,7 +346,79 @@ func (a *agent) localPorts() ([]types.IPPort, error) {
 	return res, nil
 }
 
-func (a *agent) PublishInfo() {
+// guestKinds are the message kinds the guest agent receives
+var guestKinds = []types.Kind{
+	types.HelloResponseMessage,
+	types.DNSResponseMessage,
+	types.ConnectMessage,
+	types.ExecMessage,
+	types.TimeMessage,
+}
+
+// guestCapabilities are the optional features of the guest agent
+var guestCapabilities = []types.Capability{
+	types.CapabilityConnect,
+	types.CapabilityConnectUDP,
+	types.CapabilityUDPPorts,
+	types.CapabilityExec,
+	types.CapabilityTimeSync,
+}
+
+// helloTimeout is the timeout for the host agent to reply to HelloEvent
+const helloTimeout = 10 * time.Second
+
+// hello performs the handshake with the host agent, and must precede publishInfo.
+// Host agents older than the handshake close the stream without replying, which is only logged.
+func (a *agent) hello() {
+	ctx, cancel := context.WithTimeout(context.Background(), helloTimeout)
+	defer cancel()
+	hello := types.HelloEvent{
+		Version:         version.Version,
+		ProtocolVersion: types.ProtocolVersion,
+		Kinds:           guestKinds,
+		Capabilities:    guestCapabilities,
+	}
+	hello.Kind = types.HelloMessage
+	var res types.HelloEvent
+	if err := a.client.Call(ctx, types.HelloMessage, &hello, &res); err != nil {
+		logrus.WithError(err).Warn("the host agent did not reply to the handshake, as it is probably older than the guest agent")
+		return
+	}
+	if res.Error != "" {
+		logrus.Errorf("the host agent %s refused the guest agent %s: %s", res.Version, version.Version, res.Error)
+		return
+	}
+	logrus.Infof("connected to the host agent %s (protocol %d, capabilities %v)", res.Version, res.ProtocolVersion, res.Capabilities)
+	a.sessMu.Lock()
+	a.hostHello = &res
+	a.sessMu.Unlock()
+}
+
+// hostReceives returns true if the connected host agent receives the message kind
+func (a *agent) hostReceives(kind types.Kind) bool {
+	a.sessMu.RLock()
+	defer a.sessMu.RUnlock()
+	if a.hostHello == nil {
+		return false
+	}
+	for _, k := range a.hostHello.Kinds {
+		if k == kind {
+			return true
+		}
+	}
+	return false
+}
+
+// hostSupports returns true if the connected host agent advertised c
+func (a *agent) hostSupports(c types.Capability) bool {
+	a.sessMu.RLock()
+	defer a.sessMu.RUnlock()
+	return a.hostHello != nil && a.hostHello.HasCapability(c)
+}
+
+// publishInfo sends the info along with the snapshot of the ports, which the host agent reconciles
+// its forwards against. The port events that follow are relative to the snapshot.
+func (a *agent) publishInfo() {
 	var (
 		info types.InfoEvent
 		err  error
@@ -258,25 +427,131 @@ func (a *agent) PublishInfo() {
 	if err != nil {
 		logrus.Error("Unable to fetch predefined hosts")
 	}
+	info.GuestInfo = sysinfo.GuestInfo()
+	if info.Stats != nil {
+		info.Stats.TimeCorrection = a.lastTimeCorrection()
+	}
 
+	a.stMu.Lock()
+	defer a.stMu.Unlock()
 	info.GatewayIP = ips["GATEWAY_IPADDR"]
+	info.GuestIP = ips["CURRENT_IPADDR"]
 	info.LocalPorts, err = a.localPorts()
 	if err != nil {
 		logrus.Error("Error getting local ports", err)
 	}
-	encoder, _ := socket.GetIO(a.sess)
-	if encoder != nil {
-		info.Kind = types.InfoMessage
-		socket.Write(encoder, info)
+	a.st = eventState{ports: info.LocalPorts}
+	info.Kind = types.InfoMessage
+	if err := a.client.Call(context.Background(), types.InfoMessage, &info, nil); err != nil {
+		logrus.WithError(err).Error("failed to publish the info")
+	}
+}
+
+// ServeSession performs the handshake, publishes the info and handles the streams opened by the host,
+// e.g. for forwarded connections, until the session is closed
+func (a *agent) ServeSession(sess *yamux.Session) {
+	a.sessMu.Lock()
+	a.sess = sess
+	a.sessMu.Unlock()
+	defer func() {
+		a.sessMu.Lock()
+		a.sess = nil
+		a.hostHello = nil
+		a.sessMu.Unlock()
+	}()
+
+	go func() {
+		a.hello()
+		a.publishInfo()
+	}()
+	if err := a.mux.Serve(context.Background(), sess); err != nil {
+		logrus.WithError(err).Warn("unable to accept new incoming yamux streams")
+	}
+}
+
+// openStream opens a new stream over the current session, see socket.Opener
+func (a *agent) openStream() (net.Conn, error) {
+	a.sessMu.RLock()
+	sess := a.sess
+	a.sessMu.RUnlock()
+	if sess == nil {
+		return nil, errors.New("the host agent is not connected")
+	}
+	return sess.Open()
+}
+
+const connectTimeout = 10 * time.Second
+
+// handleConnect connects to a guest-local address for the host, and relays the raw bytes that follow the response
+func (a *agent) handleConnect(ctx context.Context, req *socket.Request) (interface{}, error) {
+	var event types.ConnectEvent
+	if err := req.Decode(&event); err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(ctx, connectTimeout)
+	defer cancel()
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, event.Network, event.Address)
+	if err != nil {
+		logrus.WithError(err).Debugf("failed to connect to %s %q for the host", event.Network, event.Address)
+		return nil, err
+	}
+	req.Hijack(func(stream net.Conn) {
+		if strings.HasPrefix(event.Network, "udp") {
+			relayDatagrams(conn, stream)
+			return
+		}
+		bicopy.Bicopy(conn, socket.StreamConn{Conn: stream}, nil)
+	})
+	res := types.ConnectEventResponse{}
+	res.Kind = types.ConnectResponseMessage
+	return &res, nil
+}
+
+// relayDatagrams relays datagrams between a connected UDP socket and a stream framed by socket.WriteDatagram,
+// until the host closes the stream
+func relayDatagrams(conn net.Conn, stream net.Conn) {
+	defer stream.Close()
+	defer conn.Close()
+	go func() {
+		buf := make([]byte, socket.MaxDatagramSize)
+		for {
+			n, err := conn.Read(buf)
+			if err != nil {
+				if errors.Is(err, net.ErrClosed) {
+					return
+				}
+				// e.g. ECONNREFUSED, after an ICMP port unreachable for a previous datagram
+				logrus.WithError(err).Debugf("failed to read a datagram from %s", conn.RemoteAddr())
+				continue
+			}
+			if err := socket.WriteDatagram(stream, buf[:n]); err != nil {
+				return
+			}
+		}
+	}()
+	buf := make([]byte, socket.MaxDatagramSize)
+	for {
+		n, err := socket.ReadDatagram(stream, buf)
+		if err != nil {
+			return
+		}
+		if _, err := conn.Write(buf[:n]); err != nil {
+			logrus.WithError(err).Debugf("failed to write a datagram to %s", conn.RemoteAddr())
+		}
 	}
 }
 
 const deltaLimit = 2 * time.Second
 
+// fixSystemTimeSkew steps the system clock to the RTC, unless the host agent sends its clock, see handleTime
 func (a *agent) fixSystemTimeSkew() {
 	for {
 		ticker := time.NewTicker(10 * time.Second)
 		for now := range ticker.C {
+			if a.hostSupports(types.CapabilityTimeSync) {
+				continue
+			}
 			rtc, err := timesync.GetRTCTime()
 			if err != nil {
 				logrus.Warnf("fixSystemTimeSkew: lookup error: %s", err.Error())
@@ -292,9 +567,62 @@ func (a *agent) fixSystemTimeSkew() {
 					continue
 				}
 				logrus.Infof("fixSystemTimeSkew: system time synchronized with rtc")
+				a.setTimeCorrection(types.TimeCorrection{
+					Source: types.TimeSourceRTC,
+					Method: types.TimeMethodStep,
+					Skew:   d,
+				})
 				break
 			}
 		}
 		ticker.Stop()
 	}
 }
+
+// handleTime corrects the system clock to the clock of the host, and reports the correction
+func (a *agent) handleTime(ctx context.Context, req *socket.Request) (interface{}, error) {
+	var event types.TimeEvent
+	if err := req.Decode(&event); err != nil {
+		return nil, err
+	}
+	hostTime, err := time.Parse(time.RFC3339Nano, event.Time)
+	if err != nil {
+		return nil, err
+	}
+	res := types.TimeEventResponse{
+		TimeCorrection: types.TimeCorrection{
+			Source: types.TimeSourceHost,
+			Skew:   hostTime.Sub(time.Now()),
+		},
+	}
+	res.Kind = types.TimeResponseMessage
+	res.Method = timesync.Method(res.Skew, event.Threshold)
+	switch res.Method {
+	case types.TimeMethodSlew:
+		err = timesync.Slew(res.Skew)
+	case types.TimeMethodStep:
+		err = timesync.Step(res.Skew)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to %s the system clock by %v: %w", res.Method, res.Skew, err)
+	}
+	if res.Method != types.TimeMethodNone {
+		logrus.Infof("corrected the system clock by %v to the host clock (%s)", res.Skew, res.Method)
+		a.setTimeCorrection(res.TimeCorrection)
+	}
+	res.Time = time.Now().Format(time.RFC3339)
+	return &res, nil
+}
+
+func (a *agent) setTimeCorrection(c types.TimeCorrection) {
+	c.Time = time.Now().Format(time.RFC3339)
+	a.timeCorrectionMu.Lock()
+	a.timeCorrection = &c
+	a.timeCorrectionMu.Unlock()
+}
+
+func (a *agent) lastTimeCorrection() *types.TimeCorrection {
+	a.timeCorrectionMu.Lock()
+	defer a.timeCorrectionMu.Unlock()
+	return a.timeCorrection
+}
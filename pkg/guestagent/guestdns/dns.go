@@ -3,15 +3,18 @@
 package guestdns
 
 import (
+	"context"
 	"fmt"
-	"github.com/hashicorp/yamux"
+	"time"
+
 	"github.com/mac-vz/macvz/pkg/socket"
 	"github.com/mac-vz/macvz/pkg/types"
 	"github.com/miekg/dns"
+	"github.com/sirupsen/logrus"
 )
 
 type handler struct {
-	yamux *yamux.Session
+	client *socket.Client
 }
 
 //Server Custom DNSServer instance holds udp and tcp servers
@@ -30,38 +33,51 @@ func (s *Server) Shutdown() {
 	}
 }
 
-func newHandler(yamux *yamux.Session) (dns.Handler, error) {
+func newHandler(client *socket.Client) (dns.Handler, error) {
 	h := &handler{
-		yamux: yamux,
+		client: client,
 	}
 	return h, nil
 }
 
-//ServeDNS forwards the DNS request to host
-func (h *handler) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
-	encoder, decoder := socket.GetIO(h.yamux)
-	if encoder != nil && decoder != nil {
-		//Construct DNSEvent and send request to host
-		event := types.DNSEvent{}
-		event.Kind = types.DNSMessage
-		pack, _ := req.Pack()
-		event.Msg = pack
-		socket.Write(encoder, &event)
+// requestTimeout is the timeout for the host to resolve a request
+const requestTimeout = 5 * time.Second
 
-		//Read DNS response from host
-		var reply dns.Msg
-		dnsRes := types.DNSEventResponse{}
-		socket.Read(decoder, &dnsRes)
-		_ = reply.Unpack(dnsRes.Msg)
+//ServeDNS forwards the DNS request to host, and replies SERVFAIL when the host fails to resolve it
+func (h *handler) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
+	pack, err := req.Pack()
+	if err != nil {
+		logrus.WithError(err).Debug("failed to pack the DNS request")
+		dns.HandleFailed(w, req)
+		return
+	}
+	//Construct DNSEvent and send request to host
+	event := types.DNSEvent{}
+	event.Kind = types.DNSMessage
+	event.Msg = pack
 
-		//Write the response back to dns writer
-		_ = w.WriteMsg(&reply)
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+	dnsRes := types.DNSEventResponse{}
+	if err := h.client.Call(ctx, types.DNSMessage, &event, &dnsRes); err != nil {
+		logrus.WithError(err).Debug("failed to forward the DNS request to the host")
+		dns.HandleFailed(w, req)
+		return
+	}
+	var reply dns.Msg
+	if err := reply.Unpack(dnsRes.Msg); err != nil {
+		logrus.WithError(err).Debug("failed to unpack the DNS response of the host")
+		dns.HandleFailed(w, req)
+		return
 	}
+
+	//Write the response back to dns writer
+	_ = w.WriteMsg(&reply)
 }
 
 //Start initialise DNS server
-func Start(udpLocalPort, tcpLocalPort int, yamux *yamux.Session) (*Server, error) {
-	h, err := newHandler(yamux)
+func Start(udpLocalPort, tcpLocalPort int, client *socket.Client) (*Server, error) {
+	h, err := newHandler(client)
 	if err != nil {
 		return nil, err
 	}
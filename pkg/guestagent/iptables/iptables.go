@@ -3,12 +3,16 @@ package iptables
 import (
 	"bytes"
 	"errors"
+	"fmt"
 	"net"
 	"os/exec"
 	"regexp"
 	"strconv"
 	"strings"
 	"time"
+
+	"github.com/hashicorp/go-multierror"
+	"github.com/sirupsen/logrus"
 )
 
 type Entry struct {
@@ -18,49 +22,157 @@ type Entry struct {
 }
 
 // This regex can detect a line in the iptables added by portmap to do the
-// forwarding. The following two are examples of lines (notice that one has the
-// destination IP and the other does not):
-//    -A CNI-DN-2e2f8d5b91929ef9fc152 -d 127.0.0.1/32 -p tcp -m tcp --dport 8081 -j DNAT --to-destination 10.4.0.7:80
-//    -A CNI-DN-04579c7bb67f4c3f6cca0 -p tcp -m tcp --dport 8082 -j DNAT --to-destination 10.4.0.10:80
+// forwarding. The following three are examples of lines (notice that one has the
+// destination IP and the other does not, and that the last one is from ip6tables):
+//
+//	-A CNI-DN-2e2f8d5b91929ef9fc152 -d 127.0.0.1/32 -p tcp -m tcp --dport 8081 -j DNAT --to-destination 10.4.0.7:80
+//	-A CNI-DN-04579c7bb67f4c3f6cca0 -p tcp -m tcp --dport 8082 -j DNAT --to-destination 10.4.0.10:80
+//	-A CNI-DN-9a1c1e1b6b2f2a7e5b4c3 -d ::1/128 -p tcp -m tcp --dport 8083 -j DNAT --to-destination [fd00:4::7]:80
+//
 // The -A on the front is to amend the rule that was already created. portmap
 // ensures the rule is created before creating this line so it is always -A.
 // CNI-DN- is the prefix used for rule for an individual container.
-// -d is followed by the IP address. The regular expression looks for a valid
-// ipv4 IP address. We need to detect this IP.
+// -d is followed by the IP address. The regular expression looks for an ipv4
+// or ipv6 IP address, which is validated by net.ParseIP. We need to detect this IP.
 // --dport is the destination port. We need to detect this port
 // -j DNAT this tells us it's the line doing the port forwarding.
-var findPortRegex = regexp.MustCompile(`-A\s+CNI-DN-\w*\s+(?:-d ((?:\b25[0-5]|\b2[0-4][0-9]|\b[01]?[0-9][0-9]?)(?:\.(?:25[0-5]|2[0-4][0-9]|[01]?[0-9][0-9]?)){3}))?(?:/32\s+)?-p (tcp)?.*--dport (\d+) -j DNAT`)
-
+var findPortRegex = regexp.MustCompile(`-A\s+CNI-DN-\w*\s+(?:-d ([0-9a-fA-F.:]+))?(?:/(?:32|128)\s+)?-p (tcp)?.*--dport (\d+) -j DNAT`)
+
+// GetPorts returns the ports published with DNAT rules, e.g. by CNI portmap or by Docker.
+//
+// The rules are read from `nft -j list ruleset` when nft is installed, which also covers
+// the rules added by iptables-nft. Otherwise, or when iptables is the legacy one or nft fails,
+// they are read from `iptables -t nat -S` and `ip6tables -t nat -S`.
+// A failing backend is skipped, and an error is only returned when all of them failed.
 func GetPorts() ([]Entry, error) {
-	// TODO: add support for ipv6
+	pts, err := getPorts()
+	if err != nil {
+		return nil, err
+	}
+	return checkPortsOpen(pts)
+}
 
-	// Detect the location of iptables. If it is not installed skip the lookup
+// The backends of getPorts, replaced by the tests
+var (
+	lookPathFunc     = lookPath
+	listNFTFunc      = listNFTRuleset
+	listNATFunc      = listNATRules
+	isNFTBackendFunc = isNFTBackend
+)
+
+func getPorts() ([]Entry, error) {
+	// Detect the location of nft and iptables. If they are not installed skip the lookup
 	// and return no results. The lookup is performed on each run so that the
 	// agent does not need to be started to detect if iptables was installed
 	// after the agent is already running.
-	pth, err := exec.LookPath("iptables")
+	var (
+		pts           []Entry
+		mErr          error
+		tried, failed int
+		listedByNFT   bool
+	)
+	fail := func(backend string, err error) {
+		logrus.WithError(err).Debugf("failed to list the ports published by %s, skipping it", backend)
+		mErr = multierror.Append(mErr, fmt.Errorf("%s: %w", backend, err))
+		failed++
+	}
+
+	nftPath, err := lookPathFunc("nft")
 	if err != nil {
-		if errors.Is(err, exec.ErrNotFound) {
-			return nil, nil
+		tried++
+		fail("nft", err)
+	} else if nftPath != "" {
+		tried++
+		nftPts, err := listNFTPorts(nftPath)
+		if err != nil {
+			// e.g. nft built without JSON, the rules of iptables-nft are listed by iptables instead
+			fail("nft", err)
+		} else {
+			pts = append(pts, nftPts...)
+			listedByNFT = true
 		}
+	}
 
-		return nil, err
+	for _, bin := range []string{"iptables", "ip6tables"} {
+		pth, err := lookPathFunc(bin)
+		if err != nil {
+			tried++
+			fail(bin, err)
+			continue
+		}
+		if pth == "" {
+			continue
+		}
+		if listedByNFT && isNFTBackendFunc(pth) {
+			// Already listed by nft
+			continue
+		}
+		tried++
+		iptPts, err := listIPTablesPorts(pth, bin == "ip6tables")
+		if err != nil {
+			// e.g. the nat table of ip6tables is not available
+			fail(bin, err)
+			continue
+		}
+		pts = append(pts, iptPts...)
 	}
 
-	res, err := listNATRules(pth)
+	if tried > 0 && failed == tried {
+		return nil, mErr
+	}
+	return pts, nil
+}
+
+func listNFTPorts(pth string) ([]Entry, error) {
+	ruleset, err := listNFTFunc(pth)
 	if err != nil {
 		return nil, err
 	}
+	return parsePortsFromNFTRuleset(ruleset)
+}
 
-	pts, err := parsePortsFromRules(res)
+func listIPTablesPorts(pth string, ipv6 bool) ([]Entry, error) {
+	res, err := listNATFunc(pth)
 	if err != nil {
 		return nil, err
 	}
+	if ipv6 {
+		return parsePorts6FromRules(res)
+	}
+	return parsePortsFromRules(res)
+}
 
-	return checkPortsOpen(pts)
+// lookPath returns an empty string when file is not installed
+func lookPath(file string) (string, error) {
+	pth, err := exec.LookPath(file)
+	if err != nil {
+		if errors.Is(err, exec.ErrNotFound) {
+			return "", nil
+		}
+		return "", err
+	}
+	return pth, nil
+}
+
+// isNFTBackend returns true for iptables-nft, whose version is like "iptables v1.8.7 (nf_tables)"
+func isNFTBackend(pth string) bool {
+	out, err := exec.Command(pth, "--version").Output()
+	if err != nil {
+		return false
+	}
+	return strings.Contains(string(out), "nf_tables")
 }
 
 func parsePortsFromRules(rules []string) ([]Entry, error) {
+	return parseRules(rules, net.IPv4zero)
+}
+
+func parsePorts6FromRules(rules []string) ([]Entry, error) {
+	return parseRules(rules, net.IPv6unspecified)
+}
+
+// parseRules parses the rules of `iptables -S`, where unspecified is the IP of the rules without -d
+func parseRules(rules []string, unspecified net.IP) ([]Entry, error) {
 	var entries []Entry
 	for _, rule := range rules {
 		if found := findPortRegex.FindStringSubmatch(rule); found != nil {
@@ -76,12 +188,15 @@ func parsePortsFromRules(rules []string) ([]Entry, error) {
 				}
 
 				// When no IP is present the rule applies to all interfaces.
-				ip := found[1]
-				if ip == "" {
-					ip = "0.0.0.0"
+				ip := unspecified
+				if found[1] != "" {
+					ip = net.ParseIP(found[1])
+					if ip == nil {
+						continue
+					}
 				}
 				ent := Entry{
-					IP:   net.ParseIP(ip),
+					IP:   ip,
 					Port: port,
 					TCP:  istcp,
 				}
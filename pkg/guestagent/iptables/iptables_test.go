@@ -1,6 +1,8 @@
 package iptables
 
 import (
+	"errors"
+	"fmt"
 	"strings"
 	"testing"
 )
@@ -91,3 +93,109 @@ func TestParsePortsFromRules(t *testing.T) {
 		t.Errorf("expected port 8081 on IP 127.0.0.1 with TCP true but go port %d on IP %s with TCP %t", res[1].Port, res[1].IP.String(), res[1].TCP)
 	}
 }
+
+// data6 is from a run of `ip6tables -t nat -S` with a container started with an
+// IPv6-enabled CNI network and exposed ports 8083 (on ::1) and 8084.
+const data6 = `-P PREROUTING ACCEPT
+-P INPUT ACCEPT
+-P OUTPUT ACCEPT
+-P POSTROUTING ACCEPT
+-N CNI-DN-9a1c1e1b6b2f2a7e5b4c3
+-N CNI-HOSTPORT-DNAT
+-N CNI-HOSTPORT-SETMARK
+-A PREROUTING -m addrtype --dst-type LOCAL -j CNI-HOSTPORT-DNAT
+-A OUTPUT -m addrtype --dst-type LOCAL -j CNI-HOSTPORT-DNAT
+-A CNI-DN-9a1c1e1b6b2f2a7e5b4c3 -s fd00:4::/64 -d ::1/128 -p tcp -m tcp --dport 8083 -j CNI-HOSTPORT-SETMARK
+-A CNI-DN-9a1c1e1b6b2f2a7e5b4c3 -d ::1/128 -p tcp -m tcp --dport 8083 -j DNAT --to-destination [fd00:4::7]:80
+-A CNI-DN-9a1c1e1b6b2f2a7e5b4c3 -p tcp -m tcp --dport 8084 -j DNAT --to-destination [fd00:4::7]:81
+-A CNI-HOSTPORT-DNAT -p tcp -m comment --comment "dnat name: \"bridge\" id: \"default-8f1e0e2c\"" -m multiport --dports 8083,8084 -j CNI-DN-9a1c1e1b6b2f2a7e5b4c3
+-A CNI-HOSTPORT-SETMARK -m comment --comment "CNI portfwd masquerade mark" -j MARK --set-xmark 0x2000/0x2000
+`
+
+func TestParsePorts6FromRules(t *testing.T) {
+	rules := strings.Split(strings.TrimSuffix(data6, "\n"), "\n")
+
+	res, err := parsePorts6FromRules(rules)
+	if err != nil {
+		t.Errorf("parsing ip6tables ports failed with error: %s", err)
+	}
+
+	l := len(res)
+	if l != 2 {
+		t.Fatalf("expected 2 ports parsed from ip6tables but parsed %d", l)
+	}
+
+	if res[0].IP.String() != "::1" || res[0].Port != 8083 || res[0].TCP != true {
+		t.Errorf("expected port 8083 on IP ::1 with TCP true but got port %d on IP %s with TCP %t", res[0].Port, res[0].IP.String(), res[0].TCP)
+	}
+	if res[1].IP.String() != "::" || res[1].Port != 8084 || res[1].TCP != true {
+		t.Errorf("expected port 8084 on IP :: with TCP true but got port %d on IP %s with TCP %t", res[1].Port, res[1].IP.String(), res[1].TCP)
+	}
+}
+
+// fakeBackends replaces the backends of getPorts, with nft and iptables-nft when nft is true
+func fakeBackends(t *testing.T, nft bool, nftErr, ip6tablesErr error) {
+	lookPath, listNFT, listNAT, isNFT := lookPathFunc, listNFTFunc, listNATFunc, isNFTBackendFunc
+	t.Cleanup(func() {
+		lookPathFunc, listNFTFunc, listNATFunc, isNFTBackendFunc = lookPath, listNFT, listNAT, isNFT
+	})
+	lookPathFunc = func(file string) (string, error) {
+		if file == "nft" && !nft {
+			return "", nil
+		}
+		return "/usr/sbin/" + file, nil
+	}
+	listNFTFunc = func(string) ([]byte, error) {
+		if nftErr != nil {
+			return nil, nftErr
+		}
+		return []byte(nftData), nil
+	}
+	listNATFunc = func(pth string) ([]string, error) {
+		if pth == "/usr/sbin/ip6tables" {
+			if ip6tablesErr != nil {
+				return nil, ip6tablesErr
+			}
+			return strings.Split(strings.TrimSuffix(data6, "\n"), "\n"), nil
+		}
+		return strings.Split(strings.TrimSuffix(data, "\n"), "\n"), nil
+	}
+	isNFTBackendFunc = func(string) bool { return nft }
+}
+
+func TestGetPortsFailingBackends(t *testing.T) {
+	errFailed := errors.New("failed")
+	for _, tc := range []struct {
+		name         string
+		nft          bool
+		nftErr       error
+		ip6tablesErr error
+		ports        []int
+	}{
+		{"nft", true, nil, nil, []int{8081, 8082, 8080, 5353}},
+		{"nft without JSON falls back to iptables", true, errFailed, nil, []int{8082, 8081, 8083, 8084}},
+		{"ip6tables without nat", false, nil, errFailed, []int{8082, 8081}},
+		{"nft and ip6tables failing", true, errFailed, errFailed, []int{8082, 8081}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			fakeBackends(t, tc.nft, tc.nftErr, tc.ip6tablesErr)
+			pts, err := getPorts()
+			if err != nil {
+				t.Fatalf("expected the ports of the working backends, got error: %s", err)
+			}
+			var ports []int
+			for _, pt := range pts {
+				ports = append(ports, pt.Port)
+			}
+			if fmt.Sprint(ports) != fmt.Sprint(tc.ports) {
+				t.Errorf("expected ports %v, got %v", tc.ports, ports)
+			}
+		})
+	}
+
+	fakeBackends(t, false, nil, errFailed)
+	listNATFunc = func(string) ([]string, error) { return nil, errFailed }
+	if _, err := getPorts(); err == nil {
+		t.Error("expected an error when all the backends failed")
+	}
+}
@@ -0,0 +1,213 @@
+package iptables
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os/exec"
+)
+
+// nftRuleset is the output of `nft -j list ruleset`, see libnftables-json(5).
+// Only the rules are decoded, the other objects (tables, chains, sets, ...) are skipped.
+type nftRuleset struct {
+	Nftables []struct {
+		Rule *nftRule `json:"rule,omitempty"`
+	} `json:"nftables"`
+}
+
+type nftRule struct {
+	Family string                       `json:"family"`
+	Table  string                       `json:"table"`
+	Chain  string                       `json:"chain"`
+	Expr   []map[string]json.RawMessage `json:"expr"`
+}
+
+type nftMatch struct {
+	Op    string          `json:"op"`
+	Left  nftOperand      `json:"left"`
+	Right json.RawMessage `json:"right"`
+}
+
+type nftOperand struct {
+	Payload *struct {
+		Protocol string `json:"protocol"`
+		Field    string `json:"field"`
+	} `json:"payload,omitempty"`
+	Meta *struct {
+		Key string `json:"key"`
+	} `json:"meta,omitempty"`
+}
+
+// nftXT is the expression of a rule added by iptables-nft that has no native translation
+type nftXT struct {
+	Type string `json:"type"`
+	Name string `json:"name"`
+}
+
+// listNFTRuleset performs the lookup with nft and returns the ruleset as JSON
+func listNFTRuleset(pth string) ([]byte, error) {
+	var stdout bytes.Buffer
+	var stderr bytes.Buffer
+	cmd := exec.Cmd{
+		Path:   pth,
+		Args:   []string{pth, "-j", "list", "ruleset"},
+		Stdout: &stdout,
+		Stderr: &stderr,
+	}
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("failed to run %v: %q: %w", cmd.Args, stderr.String(), err)
+	}
+	return stdout.Bytes(), nil
+}
+
+// parsePortsFromNFTRuleset detects the rules doing the port forwarding, i.e. the ones
+// with a DNAT statement and a tcp or udp destination port, like the translation of
+//
+//	-A CNI-DN-2e2f8d5b91929ef9fc152 -d 127.0.0.1/32 -p tcp -m tcp --dport 8081 -j DNAT --to-destination 10.4.0.7:80
+//
+// which is:
+//
+//	{"rule": {"family": "ip", "table": "nat", "chain": "CNI-DN-2e2f8d5b91929ef9fc152", "expr": [
+//	  {"match": {"op": "==", "left": {"payload": {"protocol": "ip", "field": "daddr"}}, "right": "127.0.0.1"}},
+//	  {"match": {"op": "==", "left": {"payload": {"protocol": "tcp", "field": "dport"}}, "right": 8081}},
+//	  {"dnat": {"addr": "10.4.0.7", "port": 80}}]}}
+func parsePortsFromNFTRuleset(data []byte) ([]Entry, error) {
+	var ruleset nftRuleset
+	if err := json.Unmarshal(data, &ruleset); err != nil {
+		return nil, fmt.Errorf("failed to parse the nft ruleset: %w", err)
+	}
+	var entries []Entry
+	for _, obj := range ruleset.Nftables {
+		if obj.Rule == nil {
+			continue
+		}
+		ents, err := parseNFTRule(obj.Rule)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, ents...)
+	}
+	return entries, nil
+}
+
+func parseNFTRule(rule *nftRule) ([]Entry, error) {
+	var (
+		dnat  bool
+		daddr bool
+		ip    net.IP
+		proto string
+		ports []int
+	)
+	for _, expr := range rule.Expr {
+		if _, ok := expr["dnat"]; ok {
+			dnat = true
+			continue
+		}
+		if raw, ok := expr["xt"]; ok {
+			var xt nftXT
+			// "xt" is null when nft cannot describe the expression
+			if err := json.Unmarshal(raw, &xt); err == nil && xt.Type == "target" && xt.Name == "DNAT" {
+				dnat = true
+			}
+			continue
+		}
+		raw, ok := expr["match"]
+		if !ok {
+			continue
+		}
+		var m nftMatch
+		if err := json.Unmarshal(raw, &m); err != nil {
+			return nil, fmt.Errorf("failed to parse the match expression %s of chain %q: %w", raw, rule.Chain, err)
+		}
+		if m.Op != "==" {
+			// e.g. "!=" for `! -d 224.0.0.0/4`
+			continue
+		}
+		switch {
+		case m.Left.Payload != nil && m.Left.Payload.Field == "daddr":
+			daddr = true
+			ip = parseNFTAddr(m.Right)
+		case m.Left.Payload != nil && m.Left.Payload.Field == "dport":
+			proto = m.Left.Payload.Protocol
+			ports = parseNFTPorts(m.Right)
+		case m.Left.Meta != nil && m.Left.Meta.Key == "l4proto" && proto == "":
+			_ = json.Unmarshal(m.Right, &proto)
+		}
+	}
+	if !dnat || len(ports) == 0 {
+		return nil, nil
+	}
+	if daddr && ip == nil {
+		// The destination is a network, not a single address
+		return nil, nil
+	}
+	if ip == nil {
+		// When no IP is present the rule applies to all interfaces.
+		ip = net.IPv4zero
+		if rule.Family == "ip6" {
+			ip = net.IPv6unspecified
+		}
+	}
+	var entries []Entry
+	for _, port := range ports {
+		entries = append(entries, Entry{
+			IP:   ip,
+			Port: port,
+			TCP:  proto == "tcp",
+		})
+	}
+	return entries, nil
+}
+
+// parseNFTAddr parses "127.0.0.1" or {"prefix": {"addr": "127.0.0.1", "len": 32}}.
+// Prefixes of networks are not a single address, and result in nil.
+func parseNFTAddr(raw json.RawMessage) net.IP {
+	var s string
+	if err := json.Unmarshal(raw, &s); err == nil {
+		return net.ParseIP(s)
+	}
+	var prefix struct {
+		Prefix struct {
+			Addr string `json:"addr"`
+			Len  int    `json:"len"`
+		} `json:"prefix"`
+	}
+	if err := json.Unmarshal(raw, &prefix); err != nil {
+		return nil
+	}
+	ip := net.ParseIP(prefix.Prefix.Addr)
+	if ip == nil {
+		return nil
+	}
+	bits := 128
+	if ip.To4() != nil {
+		bits = 32
+	}
+	if prefix.Prefix.Len != bits {
+		return nil
+	}
+	return ip
+}
+
+// parseNFTPorts parses 8081 or {"set": [8081, 8082]}.
+// Ranges are not supported, as they usually map huge numbers of ports.
+func parseNFTPorts(raw json.RawMessage) []int {
+	var port int
+	if err := json.Unmarshal(raw, &port); err == nil {
+		return []int{port}
+	}
+	var set struct {
+		Set []json.RawMessage `json:"set"`
+	}
+	if err := json.Unmarshal(raw, &set); err != nil {
+		return nil
+	}
+	var ports []int
+	for _, elem := range set.Set {
+		if err := json.Unmarshal(elem, &port); err == nil {
+			ports = append(ports, port)
+		}
+	}
+	return ports
+}
@@ -0,0 +1,103 @@
+package iptables
+
+import (
+	"testing"
+)
+
+// nftData is from a run of `nft -j list ruleset` (trimmed to the nat table), with the rules of
+// the CNI portmap plugin for ports 8081 (on 127.0.0.1) and 8082, and of Docker for ports 8080 (tcp) and 5353 (udp).
+const nftData = `{"nftables": [
+{"metainfo": {"version": "1.0.2", "release_name": "Lester Gooch", "json_schema_version": 1}},
+{"table": {"family": "ip", "name": "nat", "handle": 1}},
+{"chain": {"family": "ip", "table": "nat", "name": "PREROUTING", "handle": 1, "type": "nat", "hook": "prerouting", "prio": -100, "policy": "accept"}},
+{"chain": {"family": "ip", "table": "nat", "name": "CNI-DN-2e2f8d5b91929ef9fc152", "handle": 12}},
+{"chain": {"family": "ip", "table": "nat", "name": "DOCKER", "handle": 13}},
+{"rule": {"family": "ip", "table": "nat", "chain": "PREROUTING", "handle": 20, "expr": [
+  {"xt": {"type": "match", "name": "addrtype"}},
+  {"counter": {"packets": 1, "bytes": 60}},
+  {"jump": {"target": "CNI-HOSTPORT-DNAT"}}]}},
+{"rule": {"family": "ip", "table": "nat", "chain": "CNI-DN-2e2f8d5b91929ef9fc152", "handle": 21, "expr": [
+  {"match": {"op": "==", "left": {"payload": {"protocol": "ip", "field": "saddr"}}, "right": {"prefix": {"addr": "10.4.0.0", "len": 24}}}},
+  {"match": {"op": "==", "left": {"payload": {"protocol": "ip", "field": "daddr"}}, "right": "127.0.0.1"}},
+  {"match": {"op": "==", "left": {"payload": {"protocol": "tcp", "field": "dport"}}, "right": 8081}},
+  {"counter": {"packets": 0, "bytes": 0}},
+  {"jump": {"target": "CNI-HOSTPORT-SETMARK"}}]}},
+{"rule": {"family": "ip", "table": "nat", "chain": "CNI-DN-2e2f8d5b91929ef9fc152", "handle": 22, "expr": [
+  {"match": {"op": "==", "left": {"payload": {"protocol": "ip", "field": "daddr"}}, "right": "127.0.0.1"}},
+  {"match": {"op": "==", "left": {"meta": {"key": "l4proto"}}, "right": "tcp"}},
+  {"match": {"op": "==", "left": {"payload": {"protocol": "tcp", "field": "dport"}}, "right": 8081}},
+  {"counter": {"packets": 0, "bytes": 0}},
+  {"xt": {"type": "target", "name": "DNAT"}}]}},
+{"rule": {"family": "ip", "table": "nat", "chain": "CNI-DN-04579c7bb67f4c3f6cca0", "handle": 23, "expr": [
+  {"match": {"op": "==", "left": {"payload": {"protocol": "tcp", "field": "dport"}}, "right": 8082}},
+  {"counter": {"packets": 0, "bytes": 0}},
+  {"dnat": {"addr": "10.4.0.10", "port": 80}}]}},
+{"rule": {"family": "ip", "table": "nat", "chain": "DOCKER", "handle": 24, "expr": [
+  {"match": {"op": "!=", "left": {"meta": {"key": "iifname"}}, "right": "docker0"}},
+  {"match": {"op": "==", "left": {"payload": {"protocol": "tcp", "field": "dport"}}, "right": 8080}},
+  {"counter": {"packets": 0, "bytes": 0}},
+  {"dnat": {"addr": "172.17.0.2", "port": 80}}]}},
+{"rule": {"family": "ip", "table": "nat", "chain": "DOCKER", "handle": 25, "expr": [
+  {"match": {"op": "!=", "left": {"meta": {"key": "iifname"}}, "right": "docker0"}},
+  {"match": {"op": "==", "left": {"payload": {"protocol": "udp", "field": "dport"}}, "right": 5353}},
+  {"counter": {"packets": 0, "bytes": 0}},
+  {"dnat": {"addr": "172.17.0.2", "port": 53}}]}},
+{"rule": {"family": "ip", "table": "nat", "chain": "POSTROUTING", "handle": 26, "expr": [
+  {"match": {"op": "==", "left": {"payload": {"protocol": "ip", "field": "saddr"}}, "right": {"prefix": {"addr": "172.17.0.0", "len": 16}}}},
+  {"counter": {"packets": 0, "bytes": 0}},
+  {"masquerade": null}]}}
+]}`
+
+func TestParsePortsFromNFTRuleset(t *testing.T) {
+	res, err := parsePortsFromNFTRuleset([]byte(nftData))
+	if err != nil {
+		t.Fatalf("parsing nft ports failed with error: %s", err)
+	}
+
+	expected := []Entry{
+		{IP: []byte{127, 0, 0, 1}, Port: 8081, TCP: true},
+		{IP: []byte{0, 0, 0, 0}, Port: 8082, TCP: true},
+		{IP: []byte{0, 0, 0, 0}, Port: 8080, TCP: true},
+		{IP: []byte{0, 0, 0, 0}, Port: 5353, TCP: false},
+	}
+	if len(res) != len(expected) {
+		t.Fatalf("expected %d ports parsed from nft but parsed %d: %+v", len(expected), len(res), res)
+	}
+	for i, e := range expected {
+		if !res[i].IP.Equal(e.IP) || res[i].Port != e.Port || res[i].TCP != e.TCP {
+			t.Errorf("expected port %d on IP %s with TCP %t but got port %d on IP %s with TCP %t",
+				e.Port, e.IP, e.TCP, res[i].Port, res[i].IP, res[i].TCP)
+		}
+	}
+}
+
+func TestParsePortsFromNFTRuleset6(t *testing.T) {
+	data := `{"nftables": [
+{"rule": {"family": "ip6", "table": "nat", "chain": "CNI-DN-9a1c1e1b6b2f2a7e5b4c3", "handle": 5, "expr": [
+  {"match": {"op": "==", "left": {"payload": {"protocol": "ip6", "field": "daddr"}}, "right": {"prefix": {"addr": "::1", "len": 128}}}},
+  {"match": {"op": "==", "left": {"payload": {"protocol": "tcp", "field": "dport"}}, "right": {"set": [8083, 8084]}}},
+  {"dnat": {"addr": "fd00:4::7", "port": 80}}]}},
+{"rule": {"family": "ip6", "table": "nat", "chain": "CNI-DN-9a1c1e1b6b2f2a7e5b4c3", "handle": 6, "expr": [
+  {"match": {"op": "==", "left": {"payload": {"protocol": "tcp", "field": "dport"}}, "right": 8085}},
+  {"dnat": {"addr": "fd00:4::7", "port": 81}}]}},
+{"rule": {"family": "ip6", "table": "nat", "chain": "CNI-DN-9a1c1e1b6b2f2a7e5b4c3", "handle": 7, "expr": [
+  {"match": {"op": "==", "left": {"payload": {"protocol": "ip6", "field": "daddr"}}, "right": {"prefix": {"addr": "fd00:4::", "len": 64}}}},
+  {"match": {"op": "==", "left": {"payload": {"protocol": "tcp", "field": "dport"}}, "right": 8086}},
+  {"dnat": {"addr": "fd00:4::7", "port": 82}}]}}
+]}`
+	res, err := parsePortsFromNFTRuleset([]byte(data))
+	if err != nil {
+		t.Fatalf("parsing nft ports failed with error: %s", err)
+	}
+	if len(res) != 3 {
+		t.Fatalf("expected 3 ports parsed from nft but parsed %d: %+v", len(res), res)
+	}
+	for i, port := range []int{8083, 8084} {
+		if res[i].IP.String() != "::1" || res[i].Port != port || !res[i].TCP {
+			t.Errorf("expected port %d on IP ::1 with TCP true but got port %d on IP %s with TCP %t", port, res[i].Port, res[i].IP, res[i].TCP)
+		}
+	}
+	if res[2].IP.String() != "::" || res[2].Port != 8085 {
+		t.Errorf("expected port 8085 on IP :: but got port %d on IP %s", res[2].Port, res[2].IP)
+	}
+}
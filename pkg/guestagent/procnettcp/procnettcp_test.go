@@ -56,3 +56,23 @@ func TestParseTCP6Zero(t *testing.T) {
 	assert.Equal(t, uint16(22), entries[0].Port)
 	assert.Equal(t, TCPListen, entries[0].State)
 }
+
+func TestParseUDP(t *testing.T) {
+	procNetUDP := `   sl  local_address rem_address   st tx_queue rx_queue tr tm->when retrnsmt   uid  timeout inode ref pointer drops             
+  361: 3500007F:0035 00000000:0000 07 00000000:00000000 00:00000000 00000000   102        0 30954 2 0000000000000000 0         
+  376: 0B3CA8C0:0044 00000000:0000 07 00000000:00000000 00:00000000 00000000   101        0 31471 2 0000000000000000 0         
+  927: 0B3CA8C0:E06B 08080808:0035 01 00000000:00000000 00:00000000 00000000     0        0 54233 2 0000000000000000 0         
+`
+	entries, err := Parse(strings.NewReader(procNetUDP), UDP)
+	assert.NilError(t, err)
+	t.Log(entries)
+
+	assert.Check(t, net.ParseIP("127.0.0.53").Equal(entries[0].IP))
+	assert.Equal(t, uint16(53), entries[0].Port)
+	assert.Equal(t, UDPUnconnected, entries[0].State)
+	assert.Equal(t, UDP, entries[0].Kind)
+
+	assert.Check(t, net.ParseIP("192.168.60.11").Equal(entries[2].IP))
+	assert.Equal(t, uint16(57451), entries[2].Port)
+	assert.Equal(t, TCPEstablished, entries[2].State)
+}
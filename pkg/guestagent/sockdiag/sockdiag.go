@@ -0,0 +1,84 @@
+// Package sockdiag enumerates the listening sockets with the netlink sock_diag interface,
+// which is faster than parsing /proc/net/{tcp,tcp6,udp,udp6} and does not depend on the
+// format of the proc files.
+//
+// See sock_diag(7).
+package sockdiag
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+
+	"github.com/mac-vz/macvz/pkg/guestagent/procnettcp"
+	"github.com/yalue/native_endian"
+)
+
+const (
+	// sockDiagByFamily is SOCK_DIAG_BY_FAMILY
+	sockDiagByFamily = 20
+
+	// sizeofInetDiagReqV2 is the size of struct inet_diag_req_v2
+	sizeofInetDiagReqV2 = 56
+	// sizeofInetDiagMsg is the size of struct inet_diag_msg
+	sizeofInetDiagMsg = 72
+
+	afInet  = 2
+	afInet6 = 10
+
+	ipprotoTCP = 6
+	ipprotoUDP = 17
+)
+
+// request is a dump request for the sockets of a family and a protocol
+type request struct {
+	family   uint8
+	protocol uint8
+	states   uint32
+	kind     procnettcp.Kind
+}
+
+// requests cover the same sockets as procnettcp.ParseFiles, but only in the states of the listeners
+var requests = []request{
+	{family: afInet, protocol: ipprotoTCP, states: 1 << procnettcp.TCPListen, kind: procnettcp.TCP},
+	{family: afInet6, protocol: ipprotoTCP, states: 1 << procnettcp.TCPListen, kind: procnettcp.TCP6},
+	{family: afInet, protocol: ipprotoUDP, states: 1 << procnettcp.UDPUnconnected, kind: procnettcp.UDP},
+	{family: afInet6, protocol: ipprotoUDP, states: 1 << procnettcp.UDPUnconnected, kind: procnettcp.UDP6},
+}
+
+// marshal encodes the request as struct inet_diag_req_v2, without the netlink header
+func (r request) marshal() []byte {
+	b := make([]byte, sizeofInetDiagReqV2)
+	b[0] = r.family   // sdiag_family
+	b[1] = r.protocol // sdiag_protocol
+	// b[2] is idiag_ext, b[3] is pad
+	native_endian.NativeEndian().PutUint32(b[4:8], r.states) // idiag_states
+	// b[8:56] is struct inet_diag_sockid, zero for matching any socket
+	return b
+}
+
+// parseInetDiagMsg decodes struct inet_diag_msg
+func parseInetDiagMsg(b []byte, kind procnettcp.Kind) (procnettcp.Entry, error) {
+	if len(b) < sizeofInetDiagMsg {
+		return procnettcp.Entry{}, fmt.Errorf("inet_diag_msg too short: %d bytes", len(b))
+	}
+	family := b[0]
+	state := b[1]
+	// struct inet_diag_sockid starts at 4, with the ports and the addresses in network byte order
+	sport := binary.BigEndian.Uint16(b[4:6])
+	var ip net.IP
+	switch family {
+	case afInet:
+		ip = net.IP(append([]byte{}, b[8:12]...))
+	case afInet6:
+		ip = net.IP(append([]byte{}, b[8:24]...))
+	default:
+		return procnettcp.Entry{}, fmt.Errorf("unexpected family %d", family)
+	}
+	return procnettcp.Entry{
+		Kind:  kind,
+		IP:    ip,
+		Port:  sport,
+		State: int(state),
+	}, nil
+}
@@ -0,0 +1,79 @@
+package sockdiag
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+
+	"github.com/mac-vz/macvz/pkg/guestagent/procnettcp"
+	"github.com/yalue/native_endian"
+	"golang.org/x/sys/unix"
+)
+
+// List returns the TCP listeners and the unconnected UDP sockets, like procnettcp.ParseFiles
+func List() ([]procnettcp.Entry, error) {
+	fd, err := unix.Socket(unix.AF_NETLINK, unix.SOCK_RAW|unix.SOCK_CLOEXEC, unix.NETLINK_SOCK_DIAG)
+	if err != nil {
+		return nil, os.NewSyscallError("socket", err)
+	}
+	defer unix.Close(fd)
+
+	var res []procnettcp.Entry
+	for i, req := range requests {
+		entries, err := dump(fd, uint32(i+1), req)
+		if err != nil {
+			return res, err
+		}
+		res = append(res, entries...)
+	}
+	return res, nil
+}
+
+func dump(fd int, seq uint32, req request) ([]procnettcp.Entry, error) {
+	body := req.marshal()
+	msg := make([]byte, unix.SizeofNlMsghdr+len(body))
+	ne := native_endian.NativeEndian()
+	ne.PutUint32(msg[0:4], uint32(len(msg)))                           // nlmsg_len
+	ne.PutUint16(msg[4:6], sockDiagByFamily)                           // nlmsg_type
+	ne.PutUint16(msg[6:8], uint16(unix.NLM_F_REQUEST|unix.NLM_F_DUMP)) // nlmsg_flags
+	ne.PutUint32(msg[8:12], seq)                                       // nlmsg_seq
+	copy(msg[unix.SizeofNlMsghdr:], body)
+	if err := unix.Sendto(fd, msg, 0, &unix.SockaddrNetlink{Family: unix.AF_NETLINK}); err != nil {
+		return nil, os.NewSyscallError("sendto", err)
+	}
+
+	var res []procnettcp.Entry
+	buf := make([]byte, os.Getpagesize()*8)
+	for {
+		n, _, err := unix.Recvfrom(fd, buf, 0)
+		if err != nil {
+			return res, os.NewSyscallError("recvfrom", err)
+		}
+		msgs, err := syscall.ParseNetlinkMessage(buf[:n])
+		if err != nil {
+			return res, err
+		}
+		for _, m := range msgs {
+			if m.Header.Seq != seq {
+				continue
+			}
+			switch m.Header.Type {
+			case unix.NLMSG_DONE:
+				return res, nil
+			case unix.NLMSG_ERROR:
+				if len(m.Data) >= 4 {
+					if errno := int32(ne.Uint32(m.Data[0:4])); errno != 0 {
+						return res, fmt.Errorf("sock_diag dump of %s failed: %w", req.kind, syscall.Errno(-errno))
+					}
+				}
+				return res, nil
+			case sockDiagByFamily:
+				ent, err := parseInetDiagMsg(m.Data, req.kind)
+				if err != nil {
+					return res, err
+				}
+				res = append(res, ent)
+			}
+		}
+	}
+}
@@ -0,0 +1,45 @@
+package sockdiag
+
+import (
+	"net"
+	"testing"
+
+	"github.com/mac-vz/macvz/pkg/guestagent/procnettcp"
+	"gotest.tools/v3/assert"
+)
+
+func TestParseInetDiagMsg(t *testing.T) {
+	// inet_diag_msg of a TCP listener on 127.0.0.1:35567 (0x8AEF)
+	msg := make([]byte, sizeofInetDiagMsg)
+	msg[0] = afInet
+	msg[1] = byte(procnettcp.TCPListen)
+	msg[4], msg[5] = 0x8A, 0xEF
+	copy(msg[8:12], []byte{127, 0, 0, 1})
+
+	ent, err := parseInetDiagMsg(msg, procnettcp.TCP)
+	assert.NilError(t, err)
+	assert.Check(t, net.ParseIP("127.0.0.1").Equal(ent.IP))
+	assert.Equal(t, uint16(35567), ent.Port)
+	assert.Equal(t, procnettcp.TCPListen, ent.State)
+	assert.Equal(t, procnettcp.TCP, ent.Kind)
+}
+
+func TestParseInetDiagMsg6(t *testing.T) {
+	// inet_diag_msg of an unconnected UDP socket on [fe80::70a6:57ff:fe71:c75d]:53
+	msg := make([]byte, sizeofInetDiagMsg)
+	msg[0] = afInet6
+	msg[1] = byte(procnettcp.UDPUnconnected)
+	msg[4], msg[5] = 0x00, 0x35
+	copy(msg[8:24], net.ParseIP("fe80::70a6:57ff:fe71:c75d"))
+
+	ent, err := parseInetDiagMsg(msg, procnettcp.UDP6)
+	assert.NilError(t, err)
+	assert.Check(t, net.ParseIP("fe80::70a6:57ff:fe71:c75d").Equal(ent.IP))
+	assert.Equal(t, uint16(53), ent.Port)
+	assert.Equal(t, procnettcp.UDPUnconnected, ent.State)
+}
+
+func TestParseInetDiagMsgShort(t *testing.T) {
+	_, err := parseInetDiagMsg(make([]byte, 16), procnettcp.TCP)
+	assert.ErrorContains(t, err, "too short")
+}
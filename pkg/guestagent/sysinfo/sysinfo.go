@@ -0,0 +1,69 @@
+// Package sysinfo collects the information of the guest reported in types.InfoEvent and types.StatsEvent
+package sysinfo
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/joho/godotenv"
+	"github.com/mac-vz/macvz/pkg/types"
+)
+
+// OSReleasePath is the path of os-release(5)
+const OSReleasePath = "/etc/os-release"
+
+// ReadOSRelease parses the os-release(5) file at path
+func ReadOSRelease(path string) (*types.OSRelease, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	env, err := godotenv.Parse(f)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse %q: %w", path, err)
+	}
+	return &types.OSRelease{
+		ID:         env["ID"],
+		VersionID:  env["VERSION_ID"],
+		PrettyName: env["PRETTY_NAME"],
+	}, nil
+}
+
+// parseMeminfo returns MemTotal and MemAvailable of /proc/meminfo, in bytes
+func parseMeminfo(r io.Reader) (total, available uint64, err error) {
+	var foundTotal, foundAvailable bool
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		// e.g. "MemTotal:        4025688 kB"
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 3 || fields[2] != "kB" {
+			continue
+		}
+		var dst *uint64
+		switch fields[0] {
+		case "MemTotal:":
+			dst, foundTotal = &total, true
+		case "MemAvailable:":
+			dst, foundAvailable = &available, true
+		default:
+			continue
+		}
+		kb, err := strconv.ParseUint(fields[1], 10, 64)
+		if err != nil {
+			return 0, 0, fmt.Errorf("failed to parse %q: %w", scanner.Text(), err)
+		}
+		*dst = kb * 1024
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, 0, err
+	}
+	if !foundTotal || !foundAvailable {
+		return 0, 0, fmt.Errorf("MemTotal or MemAvailable is missing")
+	}
+	return total, available, nil
+}
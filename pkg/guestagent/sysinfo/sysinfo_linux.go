@@ -0,0 +1,89 @@
+package sysinfo
+
+import (
+	"net"
+	"os"
+	"runtime"
+	"time"
+
+	"github.com/mac-vz/macvz/pkg/types"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+// GuestInfo collects the information of the guest, which is complete even if some of it is missing
+func GuestInfo() types.GuestInfo {
+	info := types.GuestInfo{
+		CPUs: runtime.NumCPU(),
+	}
+	var err error
+	if info.OSRelease, err = ReadOSRelease(OSReleasePath); err != nil {
+		logrus.WithError(err).Warn("failed to read the OS release")
+	}
+	var uts unix.Utsname
+	if err := unix.Uname(&uts); err != nil {
+		logrus.WithError(err).Warn("failed to get the kernel release")
+	} else {
+		info.Kernel = unix.ByteSliceToString(uts.Release[:])
+	}
+	if info.Addresses, err = Addresses(); err != nil {
+		logrus.WithError(err).Warn("failed to list the addresses")
+	}
+	stats, err := Stats()
+	if err != nil {
+		logrus.WithError(err).Warn("failed to collect the stats")
+	} else {
+		info.Stats = &stats
+	}
+	return info
+}
+
+// Addresses returns the addresses of the network interfaces that are up, except the loopback
+func Addresses() ([]types.InterfaceAddrs, error) {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil, err
+	}
+	var res []types.InterfaceAddrs
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagUp == 0 || iface.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+		addrs, err := iface.Addrs()
+		if err != nil {
+			return res, err
+		}
+		entry := types.InterfaceAddrs{Name: iface.Name}
+		for _, addr := range addrs {
+			entry.Addrs = append(entry.Addrs, addr.String())
+		}
+		if len(entry.Addrs) > 0 {
+			res = append(res, entry)
+		}
+	}
+	return res, nil
+}
+
+// Stats returns the memory and the usage of the root filesystem
+func Stats() (types.Stats, error) {
+	stats := types.Stats{
+		Time: time.Now().Format(time.RFC3339),
+	}
+	f, err := os.Open("/proc/meminfo")
+	if err != nil {
+		return stats, err
+	}
+	defer f.Close()
+	stats.MemoryTotal, stats.MemoryAvailable, err = parseMeminfo(f)
+	if err != nil {
+		return stats, err
+	}
+	var st unix.Statfs_t
+	if err := unix.Statfs("/", &st); err != nil {
+		return stats, os.NewSyscallError("statfs", err)
+	}
+	// Bavail excludes the blocks reserved for root, like df(1)
+	stats.DiskTotal = st.Blocks * uint64(st.Bsize)
+	stats.DiskAvailable = st.Bavail * uint64(st.Bsize)
+	return stats, nil
+}
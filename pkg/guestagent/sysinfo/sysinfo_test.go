@@ -0,0 +1,46 @@
+package sysinfo
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/mac-vz/macvz/pkg/types"
+	"gotest.tools/v3/assert"
+)
+
+func TestReadOSRelease(t *testing.T) {
+	const content = `PRETTY_NAME="Ubuntu 22.04 LTS"
+NAME="Ubuntu"
+VERSION_ID="22.04"
+VERSION="22.04 LTS (Jammy Jellyfish)"
+ID=ubuntu
+ID_LIKE=debian
+`
+	path := filepath.Join(t.TempDir(), "os-release")
+	assert.NilError(t, os.WriteFile(path, []byte(content), 0o644))
+	osRelease, err := ReadOSRelease(path)
+	assert.NilError(t, err)
+	assert.DeepEqual(t, osRelease, &types.OSRelease{
+		ID:         "ubuntu",
+		VersionID:  "22.04",
+		PrettyName: "Ubuntu 22.04 LTS",
+	})
+}
+
+func TestParseMeminfo(t *testing.T) {
+	const content = `MemTotal:        4025688 kB
+MemFree:          261520 kB
+MemAvailable:    3214712 kB
+Buffers:          131460 kB
+HugePages_Total:       0
+`
+	total, available, err := parseMeminfo(strings.NewReader(content))
+	assert.NilError(t, err)
+	assert.Equal(t, total, uint64(4025688*1024))
+	assert.Equal(t, available, uint64(3214712*1024))
+
+	_, _, err = parseMeminfo(strings.NewReader("MemTotal:        4025688 kB\n"))
+	assert.ErrorContains(t, err, "missing")
+}
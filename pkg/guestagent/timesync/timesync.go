@@ -0,0 +1,26 @@
+package timesync
+
+import (
+	"time"
+
+	"github.com/mac-vz/macvz/pkg/types"
+)
+
+// SlewLimit is the largest skew corrected by slewing, which takes about 1000 seconds at the rate of 500ppm of the kernel.
+// A larger skew is corrected by stepping.
+const SlewLimit = 500 * time.Millisecond
+
+// Method returns how to correct skew, which is left as is below threshold
+func Method(skew, threshold time.Duration) types.TimeMethod {
+	if skew < 0 {
+		skew = -skew
+	}
+	switch {
+	case skew < threshold:
+		return types.TimeMethodNone
+	case skew < SlewLimit:
+		return types.TimeMethodSlew
+	default:
+		return types.TimeMethodStep
+	}
+}
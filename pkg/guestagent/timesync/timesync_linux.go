@@ -27,3 +27,23 @@ func SetSystemTime(t time.Time) error {
 	v := unix.NsecToTimeval(t.UnixNano())
 	return unix.Settimeofday(&v)
 }
+
+// Step sets the system clock forward by skew at once
+func Step(skew time.Duration) error {
+	return SetSystemTime(time.Now().Add(skew))
+}
+
+// adjOffsetSingleshot is ADJ_OFFSET_SINGLESHOT of <linux/timex.h>, the mode of adjtime(3)
+const adjOffsetSingleshot = 0x8001
+
+// Slew gradually sets the system clock forward by skew, like adjtime(3)
+func Slew(skew time.Duration) error {
+	tx := unix.Timex{
+		Modes:  adjOffsetSingleshot,
+		Offset: skew.Microseconds(),
+	}
+	if _, err := unix.Adjtimex(&tx); err != nil {
+		return os.NewSyscallError("adjtimex", err)
+	}
+	return nil
+}
@@ -0,0 +1,129 @@
+// Package guestip resolves the IP address of the guest of an instance.
+//
+// The address reported by the guest agent is preferred over the DHCP leases of macOS,
+// which may still hold the stale leases of the MAC address of the guest.
+// The host agent caches the address under the instance directory, for the other macvz processes.
+package guestip
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mac-vz/macvz/pkg/osutil"
+	"github.com/mac-vz/macvz/pkg/store/filenames"
+	"github.com/sirupsen/logrus"
+)
+
+// pollInterval is the interval between the resolutions of Wait
+const pollInterval = time.Second
+
+// Resolver resolves the IP address of the guest for the host agent, and caches it under the instance directory
+type Resolver struct {
+	instDir    string
+	macAddress string
+	leasesPath string
+
+	mu sync.Mutex
+	// reported is the address reported by the guest agent
+	reported string
+	// leased is the address of the newest lease when last read
+	leased string
+}
+
+// NewResolver creates a Resolver for the guest with macAddress of the instance in instDir
+func NewResolver(instDir, macAddress string) *Resolver {
+	return &Resolver{
+		instDir:    instDir,
+		macAddress: macAddress,
+		leasesPath: osutil.LeasesPath,
+	}
+}
+
+// Reset forgets the address, and removes the one cached by a previous boot of the guest
+func (r *Resolver) Reset() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.reported, r.leased = "", ""
+	if err := os.Remove(filepath.Join(r.instDir, filenames.GuestIP)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// SetReported records ip as reported by the guest agent, which takes precedence over the DHCP leases
+func (r *Resolver) SetReported(ip string) error {
+	if net.ParseIP(ip) == nil {
+		return fmt.Errorf("invalid IP address %q", ip)
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.leased != "" && r.leased != ip {
+		logrus.Debugf("the guest agent reported %s, while the newest DHCP lease is for %s", ip, r.leased)
+	}
+	r.reported = ip
+	return r.writeCache(ip)
+}
+
+// Resolve returns the address reported by the guest agent, or else the one of the newest DHCP lease of the guest.
+// The leases are read again on each call until the guest agent reports the address, as the newest lease may
+// still be the one of a previous boot until the guest renews it.
+func (r *Resolver) Resolve() (string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.reported != "" {
+		return r.reported, nil
+	}
+	ip, err := osutil.GetIPFromLeasesFile(r.macAddress, r.leasesPath)
+	if err != nil {
+		return "", err
+	}
+	if ip != r.leased {
+		r.leased = ip
+		if err := r.writeCache(ip); err != nil {
+			logrus.WithError(err).Warn("failed to cache the IP address of the guest")
+		}
+	}
+	return ip, nil
+}
+
+// Wait resolves the address, retrying until ctx is done or timeout elapsed, e.g. while the guest is booting
+func (r *Resolver) Wait(ctx context.Context, timeout time.Duration) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+	for {
+		ip, err := r.Resolve()
+		if err == nil {
+			return ip, nil
+		}
+		select {
+		case <-ctx.Done():
+			return "", fmt.Errorf("failed to resolve the IP address of the guest within %v: %w", timeout, err)
+		case <-ticker.C:
+		}
+	}
+}
+
+// writeCache must be called with r.mu held
+func (r *Resolver) writeCache(ip string) error {
+	return os.WriteFile(filepath.Join(r.instDir, filenames.GuestIP), []byte(ip+"\n"), 0o644)
+}
+
+// Lookup returns the address cached by the host agent of the instance in instDir,
+// or else the one of the newest DHCP lease of macAddress
+func Lookup(instDir, macAddress string) (string, error) {
+	if b, err := os.ReadFile(filepath.Join(instDir, filenames.GuestIP)); err == nil {
+		if ip := strings.TrimSpace(string(b)); net.ParseIP(ip) != nil {
+			return ip, nil
+		}
+	}
+	return osutil.GetIPFromMac(macAddress)
+}
@@ -0,0 +1,96 @@
+package guestip
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"gotest.tools/v3/assert"
+)
+
+const leases = `{
+	name=macvz-default
+	ip_address=192.168.64.5
+	hw_address=1,a2:b3:4:d5:e6:f7
+	identifier=1,a2:b3:4:d5:e6:f7
+	lease=0x62a1b2c3
+}
+{
+	name=macvz-default
+	ip_address=192.168.64.9
+	hw_address=1,a2:b3:4:d5:e6:f7
+	identifier=1,a2:b3:4:d5:e6:f7
+	lease=0x62b1b2c3
+}
+{
+	name=other
+	ip_address=192.168.64.2
+	hw_address=1,a2:b3:4:d5:e6:f8
+	identifier=1,a2:b3:4:d5:e6:f8
+	lease=0x62c1b2c3
+}
+`
+
+func newTestResolver(t *testing.T) *Resolver {
+	dir := t.TempDir()
+	leasesPath := filepath.Join(dir, "dhcpd_leases")
+	assert.NilError(t, os.WriteFile(leasesPath, []byte(leases), 0o644))
+	r := NewResolver(dir, "a2:b3:04:d5:e6:f7")
+	r.leasesPath = leasesPath
+	return r
+}
+
+func TestResolve(t *testing.T) {
+	r := newTestResolver(t)
+	ip, err := r.Resolve()
+	assert.NilError(t, err)
+	assert.Equal(t, ip, "192.168.64.9", "the newest lease must be preferred")
+	ip, err = Lookup(r.instDir, r.macAddress)
+	assert.NilError(t, err)
+	assert.Equal(t, ip, "192.168.64.9")
+
+	// the guest renews its lease after a stale one of a previous boot was resolved
+	renewed := strings.Replace(leases, "ip_address=192.168.64.5\n\thw_address=1,a2:b3:4:d5:e6:f7\n\tidentifier=1,a2:b3:4:d5:e6:f7\n\tlease=0x62a1b2c3",
+		"ip_address=192.168.64.5\n\thw_address=1,a2:b3:4:d5:e6:f7\n\tidentifier=1,a2:b3:4:d5:e6:f7\n\tlease=0x62d1b2c3", 1)
+	assert.NilError(t, os.WriteFile(r.leasesPath, []byte(renewed), 0o644))
+	ip, err = r.Resolve()
+	assert.NilError(t, err)
+	assert.Equal(t, ip, "192.168.64.5", "the leases must be read again until the guest agent reports the address")
+	ip, err = Lookup(r.instDir, r.macAddress)
+	assert.NilError(t, err)
+	assert.Equal(t, ip, "192.168.64.5")
+
+	assert.ErrorContains(t, r.SetReported("192.168.64"), "invalid")
+	assert.NilError(t, r.SetReported("192.168.64.10"))
+	ip, err = r.Resolve()
+	assert.NilError(t, err)
+	assert.Equal(t, ip, "192.168.64.10", "the address reported by the guest agent must be preferred")
+	ip, err = Lookup(r.instDir, r.macAddress)
+	assert.NilError(t, err)
+	assert.Equal(t, ip, "192.168.64.10")
+
+	assert.NilError(t, r.Reset())
+	_, err = os.Stat(filepath.Join(r.instDir, "guest_ip"))
+	assert.Assert(t, os.IsNotExist(err))
+	ip, err = r.Resolve()
+	assert.NilError(t, err)
+	assert.Equal(t, ip, "192.168.64.5")
+}
+
+func TestWait(t *testing.T) {
+	r := newTestResolver(t)
+	r.macAddress = "a2:b3:04:d5:e6:f9"
+	_, err := r.Wait(context.Background(), 100*time.Millisecond)
+	assert.ErrorContains(t, err, "could not find an IP address")
+
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		_ = r.SetReported("192.168.64.11")
+	}()
+	ip, err := r.Wait(context.Background(), 10*time.Second)
+	assert.NilError(t, err)
+	assert.Equal(t, ip, "192.168.64.11")
+}
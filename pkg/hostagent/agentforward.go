@@ -0,0 +1,261 @@
+package hostagent
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/mac-vz/macvz/pkg/socket"
+	"github.com/mac-vz/macvz/pkg/yaml"
+	"github.com/norouter/norouter/pkg/agent/bicopy"
+	"github.com/sirupsen/logrus"
+)
+
+// guestDialer connects to a guest-local address through the guest agent
+type guestDialer func(network, address string) (net.Conn, error)
+
+// agentListener is implemented by agentForwarder (TCP and unix sockets) and udpAgentForwarder
+type agentListener interface {
+	Serve() error
+	Close() error
+}
+
+// agentForwarder accepts connections on a host address, and forwards each of them to a guest address
+// over a new stream of the session with the guest agent.
+type agentForwarder struct {
+	ln        net.Listener
+	network   string
+	remote    string
+	dialGuest guestDialer
+}
+
+func newAgentForwarder(local, remote string, dialGuest guestDialer) (*agentForwarder, error) {
+	var (
+		ln  net.Listener
+		err error
+	)
+	if strings.HasPrefix(local, "/") {
+		if err := os.RemoveAll(local); err != nil {
+			logrus.WithError(err).Warnf("Failed to clean up %q (host) before setting up forwarding", local)
+		}
+		if err := os.MkdirAll(filepath.Dir(local), 0750); err != nil {
+			return nil, fmt.Errorf("can't create directory for local socket %q: %w", local, err)
+		}
+		ln, err = net.Listen("unix", local)
+	} else {
+		ln, err = listenTCP(local)
+	}
+	if err != nil {
+		return nil, err
+	}
+	network := "tcp"
+	if strings.HasPrefix(remote, "/") {
+		network = "unix"
+	}
+	return &agentForwarder{
+		ln:        ln,
+		network:   network,
+		remote:    remote,
+		dialGuest: dialGuest,
+	}, nil
+}
+
+func (f *agentForwarder) Serve() error {
+	for {
+		c, err := f.ln.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+		go f.forward(c)
+	}
+}
+
+func (f *agentForwarder) forward(c net.Conn) {
+	defer c.Close()
+	guestConn, err := f.dialGuest(f.network, f.remote)
+	if err != nil {
+		logrus.WithError(err).Warnf("failed to forward the connection from %s to %q (guest)", c.RemoteAddr(), f.remote)
+		return
+	}
+	defer guestConn.Close()
+	bicopy.Bicopy(c, guestConn, nil)
+}
+
+// Close stops accepting connections; the connections already forwarded are left open
+func (f *agentForwarder) Close() error {
+	err := f.ln.Close()
+	if unixAddr, ok := f.ln.Addr().(*net.UnixAddr); ok {
+		if rmErr := os.RemoveAll(unixAddr.Name); rmErr != nil {
+			logrus.WithError(rmErr).Warnf("Failed to clean up %q (host) after stopping forwarding", unixAddr.Name)
+		}
+	}
+	return err
+}
+
+// udpIdleTimeout is the duration after which the stream of an inactive UDP client is closed
+const udpIdleTimeout = 60 * time.Second
+
+// udpAgentForwarder receives datagrams on a host address, and forwards them to a guest address.
+// Each client address gets its own stream to the guest agent, carrying datagrams framed by socket.WriteDatagram,
+// so that the replies can be sent back to the client.
+type udpAgentForwarder struct {
+	pc        net.PacketConn
+	remote    string
+	dialGuest guestDialer
+
+	sessions   map[string]*udpSession
+	sessionsMu sync.Mutex
+}
+
+type udpSession struct {
+	conn net.Conn
+	// lastActive is the UnixNano time of the latest datagram, in either direction
+	lastActive int64
+}
+
+func newUDPAgentForwarder(local, remote string, dialGuest guestDialer) (*udpAgentForwarder, error) {
+	pc, err := listenUDP(local)
+	if err != nil {
+		return nil, err
+	}
+	return &udpAgentForwarder{
+		pc:        pc,
+		remote:    remote,
+		dialGuest: dialGuest,
+		sessions:  make(map[string]*udpSession),
+	}, nil
+}
+
+func (f *udpAgentForwarder) Serve() error {
+	buf := make([]byte, socket.MaxDatagramSize)
+	for {
+		n, addr, err := f.pc.ReadFrom(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+		sess, err := f.session(addr)
+		if err != nil {
+			logrus.WithError(err).Warnf("failed to forward the datagram from %s to %q (guest)", addr, f.remote)
+			continue
+		}
+		atomic.StoreInt64(&sess.lastActive, time.Now().UnixNano())
+		if err := socket.WriteDatagram(sess.conn, buf[:n]); err != nil {
+			logrus.WithError(err).Debugf("failed to forward the datagram from %s to %q (guest)", addr, f.remote)
+			f.closeSession(addr, sess)
+		}
+	}
+}
+
+// session returns the session of the client addr, connecting to the guest for a new client
+func (f *udpAgentForwarder) session(addr net.Addr) (*udpSession, error) {
+	f.sessionsMu.Lock()
+	defer f.sessionsMu.Unlock()
+	if sess, ok := f.sessions[addr.String()]; ok {
+		return sess, nil
+	}
+	conn, err := f.dialGuest("udp", f.remote)
+	if err != nil {
+		return nil, err
+	}
+	sess := &udpSession{conn: conn, lastActive: time.Now().UnixNano()}
+	f.sessions[addr.String()] = sess
+	go f.reply(addr, sess)
+	return sess, nil
+}
+
+// reply sends the datagrams from the guest back to the client addr, until the session is idle for udpIdleTimeout
+func (f *udpAgentForwarder) reply(addr net.Addr, sess *udpSession) {
+	defer f.closeSession(addr, sess)
+	buf := make([]byte, socket.MaxDatagramSize)
+	for {
+		lastActive := time.Unix(0, atomic.LoadInt64(&sess.lastActive))
+		_ = sess.conn.SetReadDeadline(lastActive.Add(udpIdleTimeout))
+		n, err := socket.ReadDatagram(sess.conn, buf)
+		if err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() && time.Since(time.Unix(0, atomic.LoadInt64(&sess.lastActive))) < udpIdleTimeout {
+				// the client sent a datagram meanwhile
+				continue
+			}
+			return
+		}
+		atomic.StoreInt64(&sess.lastActive, time.Now().UnixNano())
+		if _, err := f.pc.WriteTo(buf[:n], addr); err != nil {
+			logrus.WithError(err).Debugf("failed to send the datagram from %q (guest) to %s", f.remote, addr)
+		}
+	}
+}
+
+func (f *udpAgentForwarder) closeSession(addr net.Addr, sess *udpSession) {
+	f.sessionsMu.Lock()
+	defer f.sessionsMu.Unlock()
+	if f.sessions[addr.String()] == sess {
+		delete(f.sessions, addr.String())
+	}
+	_ = sess.conn.Close()
+}
+
+func (f *udpAgentForwarder) Close() error {
+	err := f.pc.Close()
+	f.sessionsMu.Lock()
+	defer f.sessionsMu.Unlock()
+	for k, sess := range f.sessions {
+		_ = sess.conn.Close()
+		delete(f.sessions, k)
+	}
+	return err
+}
+
+// forwardAgent is the counterpart of forwardTCP for the forwarding over the guest agent
+func (pf *portForwarder) forwardAgent(proto yaml.Proto, local, remote, verb string) error {
+	pf.agentForwardersMu.Lock()
+	defer pf.agentForwardersMu.Unlock()
+	key := forwardKey(proto, local)
+	switch verb {
+	case verbForward:
+		if _, ok := pf.agentForwarders[key]; ok {
+			return fmt.Errorf("%s %q is already forwarded", proto, local)
+		}
+		var (
+			f   agentListener
+			err error
+		)
+		if proto == yaml.UDP {
+			f, err = newUDPAgentForwarder(local, remote, pf.dialGuest)
+		} else {
+			f, err = newAgentForwarder(local, remote, pf.dialGuest)
+		}
+		if err != nil {
+			return err
+		}
+		pf.agentForwarders[key] = f
+		go func() {
+			if err := f.Serve(); err != nil {
+				logrus.WithError(err).Warnf("forwarder for %q crashed", local)
+			}
+		}()
+		return nil
+	case verbCancel:
+		f, ok := pf.agentForwarders[key]
+		if !ok {
+			logrus.Warnf("forwarding for %s %q seems already cancelled?", proto, local)
+			return nil
+		}
+		delete(pf.agentForwarders, key)
+		return f.Close()
+	default:
+		panic(fmt.Errorf("invalid verb %q", verb))
+	}
+}
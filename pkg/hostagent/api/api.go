@@ -0,0 +1,148 @@
+// Package api defines the types of the host agent API, which is served over HTTP
+// on the unix socket filenames.HaSock under the instance directory.
+package api
+
+import (
+	"time"
+
+	"github.com/mac-vz/macvz/pkg/hostagent/events"
+	"github.com/mac-vz/macvz/pkg/types"
+)
+
+// Info is the response of GET /v1/info
+type Info struct {
+	Name      string `json:"name"`
+	Dir       string `json:"dir"`
+	Version   string `json:"version"`
+	VZPid     int    `json:"VZPid"`
+	GuestIP   string `json:"guestIP,omitempty"`
+	GatewayIP string `json:"gatewayIP,omitempty"`
+	// Guest is the latest information reported by the guest agent
+	Guest *types.GuestInfo `json:"guest,omitempty"`
+	// GuestAgentVersion is the version reported by the guest agent in the handshake,
+	// or "<legacy>" for a guest agent older than the handshake
+	GuestAgentVersion string        `json:"guestAgentVersion,omitempty"`
+	Status            events.Status `json:"status"`
+}
+
+// PortForward is an element of the response of GET /v1/port-forwards
+type PortForward struct {
+	// Protocol is "tcp" or "udp"
+	Protocol string `json:"protocol"`
+	// Guest is the guest address ("IP:PORT") or socket path
+	Guest string `json:"guest"`
+	// Host is the host address ("IP:PORT") or socket path
+	Host string `json:"host"`
+	// Forwarder is "agent" or "ssh"
+	Forwarder string `json:"forwarder"`
+}
+
+type RequirementStatus = string
+
+const (
+	RequirementPending   RequirementStatus = "pending"
+	RequirementSatisfied RequirementStatus = "satisfied"
+	RequirementFailed    RequirementStatus = "failed"
+)
+
+// Requirement is an element of the response of GET /v1/requirements
+type Requirement struct {
+	// Label is the group of the requirement, e.g. "essential" or "optional"
+	Label       string            `json:"label"`
+	Description string            `json:"description"`
+	Status      RequirementStatus `json:"status"`
+	Error       string            `json:"error,omitempty"`
+}
+
+// DNSCacheStats is the response of GET /v1/dns/cache
+type DNSCacheStats struct {
+	Enabled bool `json:"enabled"`
+	// Entries is the number of cached answers, up to Size
+	Entries int    `json:"entries"`
+	Size    int    `json:"size"`
+	Hits    uint64 `json:"hits"`
+	// NegativeHits are the hits of the answers without records, included in Hits
+	NegativeHits uint64 `json:"negativeHits"`
+	Misses       uint64 `json:"misses"`
+	// Evictions are the answers removed before their TTL expired, as the cache was full
+	Evictions uint64 `json:"evictions"`
+	// Deduplicated are the queries answered along with an identical one in flight, without a lookup of their own
+	Deduplicated uint64 `json:"deduplicated"`
+}
+
+// DNSHost is the body of PUT /v1/dns/hosts/NAME, which adds the static host NAME
+type DNSHost struct {
+	// Address is an IP or a CNAME
+	Address string `json:"address"`
+}
+
+type DNSSource = string
+
+const (
+	// DNSSourceStatic is hostResolver.hosts, srv, txt, the hosts file and the hosts added through the API
+	DNSSourceStatic DNSSource = "static"
+	DNSSourceCache  DNSSource = "cache"
+	// DNSSourceSystem is the system resolver of the host
+	DNSSourceSystem DNSSource = "system"
+	// DNSSourceUpstream is the upstream servers, i.e. hostResolver.upstreams, domains or the ones of /etc/resolv.conf
+	DNSSourceUpstream DNSSource = "upstream"
+)
+
+// DNSQuery is an element of the query log of GET /v1/dns/log
+type DNSQuery struct {
+	Time time.Time `json:"time"`
+	Name string    `json:"name"`
+	// Type is the type of the question, e.g. "AAAA"
+	Type   string    `json:"type"`
+	Source DNSSource `json:"source"`
+	// Rcode is the rcode of the answer, e.g. "NXDOMAIN"
+	Rcode   string        `json:"rcode"`
+	Answers int           `json:"answers"`
+	Latency time.Duration `json:"latency"`
+}
+
+// DNSQueryLog is the response of GET /v1/dns/log
+type DNSQueryLog struct {
+	// Enabled is hostResolver.queryLog.enabled
+	Enabled bool `json:"enabled"`
+	// Queries are the latest ones, from the oldest
+	Queries []DNSQuery `json:"queries"`
+}
+
+// DNSQueryRequest is the body of POST /v1/dns/query, which resolves a name with the DNS server of the host agent
+type DNSQueryRequest struct {
+	Name string `json:"name"`
+	// Type is the type of the question, e.g. "AAAA"
+	Type string `json:"type,omitempty"` // default: "A"
+}
+
+// DNSQueryResponse is the response of POST /v1/dns/query
+type DNSQueryResponse struct {
+	DNSQuery
+	// Records are the records of the answer, in the format of the zone files
+	Records []string `json:"records"`
+}
+
+// ExecUpgrade is the protocol of the "Upgrade" header of POST /v1/exec
+const ExecUpgrade = "macvz-exec"
+
+// ExecRequest is the body of POST /v1/exec, which starts a command in the guest through the guest agent.
+// Once the command is started, the connection is upgraded to ExecUpgrade, and carries the frames of socket.ExecFrameWriter.
+type ExecRequest struct {
+	Args []string `json:"args"`
+	// Env is a list of "KEY=VALUE"
+	Env []string `json:"env,omitempty"`
+	// Dir defaults to the home of User
+	Dir string `json:"dir,omitempty"`
+	// User defaults to the user of the instance
+	User string `json:"user,omitempty"`
+	// TTY allocates a TTY of Rows and Cols, which merges stderr into stdout
+	TTY  bool   `json:"tty,omitempty"`
+	Rows uint16 `json:"rows,omitempty"`
+	Cols uint16 `json:"cols,omitempty"`
+}
+
+// ErrorJSON is the body of the non-2xx responses
+type ErrorJSON struct {
+	Message string `json:"message"`
+}
@@ -0,0 +1,254 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+
+	"github.com/mac-vz/macvz/pkg/hostagent/api"
+)
+
+// HostAgentClient talks to the API of a running host agent
+type HostAgentClient interface {
+	HTTPClient() *http.Client
+	Info(context.Context) (*api.Info, error)
+	PortForwards(context.Context) ([]api.PortForward, error)
+	DNSHosts(context.Context) (map[string]string, error)
+	// AddDNSHost adds the static host name, which maps to an IP or a CNAME, until the host agent exits
+	AddDNSHost(ctx context.Context, name, address string) error
+	// RemoveDNSHost removes the static host name added by AddDNSHost
+	RemoveDNSHost(ctx context.Context, name string) error
+	DNSCacheStats(context.Context) (*api.DNSCacheStats, error)
+	DNSQueryLog(context.Context) (*api.DNSQueryLog, error)
+	// DNSQuery resolves a name with the DNS server of the host agent, the same way as the queries of the guest
+	DNSQuery(context.Context, api.DNSQueryRequest) (*api.DNSQueryResponse, error)
+	Requirements(context.Context) ([]api.Requirement, error)
+	// Exec starts a command in the guest, and returns the stream of the frames of socket.ExecFrameWriter
+	Exec(context.Context, api.ExecRequest) (io.ReadWriteCloser, error)
+	Stop(context.Context) error
+}
+
+// NewHostAgentClient creates a client for the API served on socketPath (filenames.HaSock)
+func NewHostAgentClient(socketPath string) (HostAgentClient, error) {
+	if _, err := os.Stat(socketPath); err != nil {
+		return nil, err
+	}
+	hc := &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", socketPath)
+			},
+		},
+	}
+	return NewHostAgentClientWithHTTPClient(hc), nil
+}
+
+func NewHostAgentClientWithHTTPClient(hc *http.Client) HostAgentClient {
+	return &client{
+		Client:    hc,
+		version:   "v1",
+		dummyHost: "macvz-hostagent",
+	}
+}
+
+type client struct {
+	*http.Client
+	// version is always "v1"
+	version   string
+	dummyHost string
+}
+
+func (c *client) HTTPClient() *http.Client {
+	return c.Client
+}
+
+func (c *client) url(path string) string {
+	return fmt.Sprintf("http://%s/%s/%s", c.dummyHost, c.version, path)
+}
+
+func (c *client) Info(ctx context.Context) (*api.Info, error) {
+	var info api.Info
+	if err := c.get(ctx, "info", &info); err != nil {
+		return nil, err
+	}
+	return &info, nil
+}
+
+func (c *client) PortForwards(ctx context.Context) ([]api.PortForward, error) {
+	var forwards []api.PortForward
+	if err := c.get(ctx, "port-forwards", &forwards); err != nil {
+		return nil, err
+	}
+	return forwards, nil
+}
+
+func (c *client) DNSHosts(ctx context.Context) (map[string]string, error) {
+	var hosts map[string]string
+	if err := c.get(ctx, "dns/hosts", &hosts); err != nil {
+		return nil, err
+	}
+	return hosts, nil
+}
+
+func (c *client) AddDNSHost(ctx context.Context, name, address string) error {
+	b, err := json.Marshal(api.DNSHost{Address: address})
+	if err != nil {
+		return err
+	}
+	return c.send(ctx, http.MethodPut, "dns/hosts/"+url.PathEscape(name), bytes.NewReader(b))
+}
+
+func (c *client) RemoveDNSHost(ctx context.Context, name string) error {
+	return c.send(ctx, http.MethodDelete, "dns/hosts/"+url.PathEscape(name), nil)
+}
+
+func (c *client) DNSCacheStats(ctx context.Context) (*api.DNSCacheStats, error) {
+	var stats api.DNSCacheStats
+	if err := c.get(ctx, "dns/cache", &stats); err != nil {
+		return nil, err
+	}
+	return &stats, nil
+}
+
+func (c *client) DNSQueryLog(ctx context.Context) (*api.DNSQueryLog, error) {
+	var log api.DNSQueryLog
+	if err := c.get(ctx, "dns/log", &log); err != nil {
+		return nil, err
+	}
+	return &log, nil
+}
+
+func (c *client) DNSQuery(ctx context.Context, queryReq api.DNSQueryRequest) (*api.DNSQueryResponse, error) {
+	b, err := json.Marshal(queryReq)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.url("dns/query"), bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := c.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if err := successful(resp); err != nil {
+		return nil, err
+	}
+	var queryResp api.DNSQueryResponse
+	if err := json.NewDecoder(resp.Body).Decode(&queryResp); err != nil {
+		return nil, err
+	}
+	return &queryResp, nil
+}
+
+func (c *client) Requirements(ctx context.Context) ([]api.Requirement, error) {
+	var reqs []api.Requirement
+	if err := c.get(ctx, "requirements", &reqs); err != nil {
+		return nil, err
+	}
+	return reqs, nil
+}
+
+func (c *client) Exec(ctx context.Context, execReq api.ExecRequest) (io.ReadWriteCloser, error) {
+	b, err := json.Marshal(execReq)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.url("exec"), bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", api.ExecUpgrade)
+	resp, err := c.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		defer resp.Body.Close()
+		if err := successful(resp); err != nil {
+			return nil, err
+		}
+		return nil, fmt.Errorf("unexpected HTTP status %s, expected the connection to be upgraded", resp.Status)
+	}
+	// since Go 1.12, the body of a 101 response is the upgraded connection
+	rwc, ok := resp.Body.(io.ReadWriteCloser)
+	if !ok {
+		resp.Body.Close()
+		return nil, errors.New("the upgraded connection is not writable")
+	}
+	return rwc, nil
+}
+
+func (c *client) Stop(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.url("stop"), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := c.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return successful(resp)
+}
+
+// send sends a request of method without a response body, along with the JSON body, if any
+func (c *client) send(ctx context.Context, method, path string, body io.Reader) error {
+	req, err := http.NewRequestWithContext(ctx, method, c.url(path), body)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := c.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return successful(resp)
+}
+
+func (c *client) get(ctx context.Context, path string, v interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.url(path), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := c.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if err := successful(resp); err != nil {
+		return err
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// successful returns an error when resp is not 2xx, using the message of api.ErrorJSON when available
+func successful(resp *http.Response) error {
+	if resp.StatusCode/100 == 2 {
+		return nil
+	}
+	b, err := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	if err != nil {
+		return fmt.Errorf("unexpected HTTP status %s, failed to read the body: %w", resp.Status, err)
+	}
+	var e api.ErrorJSON
+	if err := json.Unmarshal(b, &e); err != nil || e.Message == "" {
+		return fmt.Errorf("unexpected HTTP status %s, body=%q", resp.Status, string(b))
+	}
+	return errors.New(e.Message)
+}
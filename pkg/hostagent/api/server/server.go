@@ -0,0 +1,212 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/mac-vz/macvz/pkg/hostagent"
+	"github.com/mac-vz/macvz/pkg/hostagent/api"
+	"github.com/mac-vz/macvz/pkg/types"
+	"github.com/sirupsen/logrus"
+)
+
+// Backend serves the host agent API for Agent
+type Backend struct {
+	Agent *hostagent.HostAgent
+}
+
+func (b *Backend) onError(w http.ResponseWriter, r *http.Request, err error, ec int) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(ec)
+	// err may potentially contain credential info (in a future version),
+	// but it is safe to return the err to the client, because we do not expose the socket to the internet
+	e := api.ErrorJSON{
+		Message: err.Error(),
+	}
+	_ = json.NewEncoder(w).Encode(e)
+}
+
+func (b *Backend) onJSON(w http.ResponseWriter, r *http.Request, v interface{}) {
+	m, err := json.Marshal(v)
+	if err != nil {
+		b.onError(w, r, err, http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(m)
+}
+
+// methods wraps h so that other methods than the allowed ones are rejected
+func (b *Backend) methods(h http.HandlerFunc, allowed ...string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		for _, m := range allowed {
+			if r.Method == m {
+				h(w, r)
+				return
+			}
+		}
+		b.onError(w, r, errMethodNotAllowed(r.Method), http.StatusMethodNotAllowed)
+	}
+}
+
+// GetInfo is the handler for GET /v1/info
+func (b *Backend) GetInfo(w http.ResponseWriter, r *http.Request) {
+	b.onJSON(w, r, b.Agent.Info())
+}
+
+// GetPortForwards is the handler for GET /v1/port-forwards
+func (b *Backend) GetPortForwards(w http.ResponseWriter, r *http.Request) {
+	b.onJSON(w, r, b.Agent.PortForwards())
+}
+
+// GetDNSHosts is the handler for GET /v1/dns/hosts
+func (b *Backend) GetDNSHosts(w http.ResponseWriter, r *http.Request) {
+	b.onJSON(w, r, b.Agent.DNSHosts())
+}
+
+// DNSHost is the handler for PUT and DELETE /v1/dns/hosts/NAME
+func (b *Backend) DNSHost(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(r.URL.Path, "/v1/dns/hosts/")
+	if name == "" || strings.Contains(name, "/") {
+		b.onError(w, r, fmt.Errorf("invalid host name %q", name), http.StatusBadRequest)
+		return
+	}
+	switch r.Method {
+	case http.MethodPut:
+		var req api.DNSHost
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			b.onError(w, r, err, http.StatusBadRequest)
+			return
+		}
+		if err := b.Agent.AddDNSHost(name, req.Address); err != nil {
+			b.onError(w, r, err, http.StatusBadRequest)
+			return
+		}
+	case http.MethodDelete:
+		if err := b.Agent.RemoveDNSHost(name); err != nil {
+			ec := http.StatusInternalServerError
+			if errors.Is(err, hostagent.ErrDNSHostNotFound) {
+				ec = http.StatusNotFound
+			}
+			b.onError(w, r, err, ec)
+			return
+		}
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// GetDNSCache is the handler for GET /v1/dns/cache
+func (b *Backend) GetDNSCache(w http.ResponseWriter, r *http.Request) {
+	b.onJSON(w, r, b.Agent.DNSCacheStats())
+}
+
+// GetDNSLog is the handler for GET /v1/dns/log
+func (b *Backend) GetDNSLog(w http.ResponseWriter, r *http.Request) {
+	b.onJSON(w, r, b.Agent.DNSQueryLog())
+}
+
+// PostDNSQuery is the handler for POST /v1/dns/query
+func (b *Backend) PostDNSQuery(w http.ResponseWriter, r *http.Request) {
+	var req api.DNSQueryRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		b.onError(w, r, err, http.StatusBadRequest)
+		return
+	}
+	resp, err := b.Agent.DNSQuery(req)
+	if err != nil {
+		b.onError(w, r, err, http.StatusBadRequest)
+		return
+	}
+	b.onJSON(w, r, resp)
+}
+
+// GetRequirements is the handler for GET /v1/requirements
+func (b *Backend) GetRequirements(w http.ResponseWriter, r *http.Request) {
+	b.onJSON(w, r, b.Agent.Requirements())
+}
+
+// PostStop is the handler for POST /v1/stop
+func (b *Backend) PostStop(w http.ResponseWriter, r *http.Request) {
+	logrus.Info("Received a stop request through the API")
+	b.Agent.Stop()
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// PostExec is the handler for POST /v1/exec, which upgrades the connection to the stream of the command
+func (b *Backend) PostExec(w http.ResponseWriter, r *http.Request) {
+	if !strings.EqualFold(r.Header.Get("Upgrade"), api.ExecUpgrade) {
+		b.onError(w, r, fmt.Errorf("expected the header \"Upgrade: %s\"", api.ExecUpgrade), http.StatusUpgradeRequired)
+		return
+	}
+	var req api.ExecRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		b.onError(w, r, err, http.StatusBadRequest)
+		return
+	}
+	if len(req.Args) == 0 {
+		b.onError(w, r, errors.New("no command"), http.StatusBadRequest)
+		return
+	}
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		b.onError(w, r, errors.New("the connection cannot be upgraded"), http.StatusInternalServerError)
+		return
+	}
+	stream, err := b.Agent.Exec(r.Context(), types.ExecEvent{
+		Args: req.Args,
+		Env:  req.Env,
+		Dir:  req.Dir,
+		User: req.User,
+		TTY:  req.TTY,
+		Rows: req.Rows,
+		Cols: req.Cols,
+	})
+	if err != nil {
+		b.onError(w, r, err, http.StatusInternalServerError)
+		return
+	}
+	defer stream.Close()
+	conn, bufrw, err := hj.Hijack()
+	if err != nil {
+		logrus.WithError(err).Warn("failed to hijack the connection of the exec request")
+		return
+	}
+	defer conn.Close()
+	if _, err := fmt.Fprintf(bufrw, "HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: %s\r\n\r\n", api.ExecUpgrade); err != nil {
+		return
+	}
+	if err := bufrw.Flush(); err != nil {
+		return
+	}
+	// The command is killed when the client goes away, and the client is disconnected once the command exits
+	go func() {
+		_, _ = io.Copy(stream, bufrw.Reader)
+		_ = stream.Close()
+	}()
+	_, _ = io.Copy(conn, stream)
+}
+
+// AddRoutes registers the routes of the API (version 1) to r
+func AddRoutes(r *http.ServeMux, b *Backend) {
+	r.HandleFunc("/v1/info", b.methods(b.GetInfo, http.MethodGet))
+	r.HandleFunc("/v1/port-forwards", b.methods(b.GetPortForwards, http.MethodGet))
+	r.HandleFunc("/v1/dns/hosts", b.methods(b.GetDNSHosts, http.MethodGet))
+	r.HandleFunc("/v1/dns/hosts/", b.methods(b.DNSHost, http.MethodPut, http.MethodDelete))
+	r.HandleFunc("/v1/dns/cache", b.methods(b.GetDNSCache, http.MethodGet))
+	r.HandleFunc("/v1/dns/log", b.methods(b.GetDNSLog, http.MethodGet))
+	r.HandleFunc("/v1/dns/query", b.methods(b.PostDNSQuery, http.MethodPost))
+	r.HandleFunc("/v1/requirements", b.methods(b.GetRequirements, http.MethodGet))
+	r.HandleFunc("/v1/exec", b.methods(b.PostExec, http.MethodPost))
+	r.HandleFunc("/v1/stop", b.methods(b.PostStop, http.MethodPost))
+}
+
+type errMethodNotAllowed string
+
+func (e errMethodNotAllowed) Error() string {
+	return "method " + string(e) + " is not allowed"
+}
@@ -0,0 +1,187 @@
+package dns
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mac-vz/macvz/pkg/hostagent/api"
+	"github.com/miekg/dns"
+)
+
+// maxTTL caps the TTL of the cached answers, so that the records changed upstream are eventually refreshed
+const maxTTL = time.Hour
+
+type cacheKey struct {
+	name   string
+	qtype  uint16
+	qclass uint16
+}
+
+type cacheEntry struct {
+	reply   *dns.Msg
+	stored  time.Time
+	expires time.Time
+}
+
+// cache holds the replies to the queries of a single question, for the TTL of their records.
+// The replies without records (NXDOMAIN and NODATA) are cached for the TTL of the SOA record of
+// the authority section, or negativeTTL.
+type cache struct {
+	size        int
+	negativeTTL time.Duration
+
+	mu      sync.Mutex
+	entries map[cacheKey]*cacheEntry
+	stats   api.DNSCacheStats
+}
+
+func newCache(size int, negativeTTL time.Duration) *cache {
+	return &cache{
+		size:        size,
+		negativeTTL: negativeTTL,
+		entries:     make(map[cacheKey]*cacheEntry),
+	}
+}
+
+// keyOf returns the key of req, or false if req cannot be cached
+func keyOf(req *dns.Msg) (cacheKey, bool) {
+	if req.Opcode != dns.OpcodeQuery || len(req.Question) != 1 {
+		return cacheKey{}, false
+	}
+	q := req.Question[0]
+	return cacheKey{
+		name:   strings.ToLower(dns.Fqdn(q.Name)),
+		qtype:  q.Qtype,
+		qclass: q.Qclass,
+	}, true
+}
+
+// get returns a copy of the cached reply to req, with the TTLs decremented by the time elapsed since it was cached
+func (c *cache) get(req *dns.Msg) *dns.Msg {
+	key, ok := keyOf(req)
+	if !ok {
+		return nil
+	}
+	now := time.Now()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, ok := c.entries[key]
+	if ok && !now.Before(entry.expires) {
+		delete(c.entries, key)
+		ok = false
+	}
+	if !ok {
+		c.stats.Misses++
+		return nil
+	}
+	c.stats.Hits++
+	if len(entry.reply.Answer) == 0 {
+		c.stats.NegativeHits++
+	}
+	reply := entry.reply.Copy()
+	reply.Id = req.Id
+	// the case of the name may differ, e.g. with the 0x20 randomization of the resolver
+	reply.Question = append([]dns.Question(nil), req.Question...)
+	elapsed := uint32(now.Sub(entry.stored) / time.Second)
+	for _, section := range [][]dns.RR{reply.Answer, reply.Ns, reply.Extra} {
+		for _, rr := range section {
+			hdr := rr.Header()
+			if hdr.Rrtype == dns.TypeOPT {
+				continue
+			}
+			if hdr.Ttl > elapsed {
+				hdr.Ttl -= elapsed
+			} else {
+				hdr.Ttl = 0
+			}
+		}
+	}
+	return reply
+}
+
+// put caches reply to req, unless it is an error other than NXDOMAIN, truncated, or has a zero TTL
+func (c *cache) put(req, reply *dns.Msg) {
+	key, ok := keyOf(req)
+	if !ok || reply.Truncated {
+		return
+	}
+	ttl := c.ttlOf(reply)
+	if ttl <= 0 {
+		return
+	}
+	now := time.Now()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.entries[key]; !ok && len(c.entries) >= c.size {
+		c.evict(now)
+	}
+	c.entries[key] = &cacheEntry{
+		reply:   reply.Copy(),
+		stored:  now,
+		expires: now.Add(ttl),
+	}
+}
+
+// ttlOf returns the duration reply can be cached for
+func (c *cache) ttlOf(reply *dns.Msg) time.Duration {
+	switch reply.Rcode {
+	case dns.RcodeSuccess, dns.RcodeNameError:
+	default:
+		return 0
+	}
+	ttl := maxTTL
+	if len(reply.Answer) == 0 {
+		ttl = c.negativeTTL
+		// RFC 2308, Section 5
+		for _, rr := range reply.Ns {
+			if soa, ok := rr.(*dns.SOA); ok {
+				ttl = time.Duration(soa.Hdr.Ttl) * time.Second
+				if minTTL := time.Duration(soa.Minttl) * time.Second; minTTL < ttl {
+					ttl = minTTL
+				}
+			}
+		}
+		return ttl
+	}
+	for _, rr := range reply.Answer {
+		if d := time.Duration(rr.Header().Ttl) * time.Second; d < ttl {
+			ttl = d
+		}
+	}
+	return ttl
+}
+
+// evict removes the expired entries, or else an arbitrary one, and must be called with c.mu held
+func (c *cache) evict(now time.Time) {
+	for key, entry := range c.entries {
+		if !now.Before(entry.expires) {
+			delete(c.entries, key)
+		}
+	}
+	if len(c.entries) < c.size {
+		return
+	}
+	for key := range c.entries {
+		delete(c.entries, key)
+		c.stats.Evictions++
+		break
+	}
+}
+
+// flush removes all the entries, e.g. as the static hosts changed
+func (c *cache) flush() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries = make(map[cacheKey]*cacheEntry)
+}
+
+func (c *cache) Stats() api.DNSCacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	stats := c.stats
+	stats.Enabled = true
+	stats.Entries = len(c.entries)
+	stats.Size = c.size
+	return stats
+}
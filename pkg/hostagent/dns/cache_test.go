@@ -0,0 +1,89 @@
+package dns
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"gotest.tools/v3/assert"
+)
+
+func newReply(req *dns.Msg, rcode int, rrs ...dns.RR) *dns.Msg {
+	reply := new(dns.Msg)
+	reply.SetRcode(req, rcode)
+	reply.Answer = rrs
+	return reply
+}
+
+func TestCache(t *testing.T) {
+	c := newCache(2, 5*time.Second)
+	req := new(dns.Msg).SetQuestion("example.com.", dns.TypeA)
+	assert.Assert(t, c.get(req) == nil)
+
+	a := &dns.A{
+		Hdr: dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300},
+		A:   net.IPv4(192, 0, 2, 1),
+	}
+	c.put(req, newReply(req, dns.RcodeSuccess, a))
+	// the names are case-insensitive
+	other := new(dns.Msg).SetQuestion("EXAMPLE.com.", dns.TypeA)
+	reply := c.get(other)
+	assert.Assert(t, reply != nil)
+	assert.Equal(t, reply.Id, other.Id)
+	assert.Equal(t, reply.Question[0].Name, "EXAMPLE.com.")
+	assert.Equal(t, len(reply.Answer), 1)
+	assert.Assert(t, reply.Answer[0].Header().Ttl <= 300)
+	// the cached reply is not modified by the callers
+	reply.Answer[0].Header().Ttl = 1
+	assert.Equal(t, c.get(req).Answer[0].Header().Ttl, uint32(300))
+
+	// the errors other than NXDOMAIN are not cached
+	failed := new(dns.Msg).SetQuestion("failed.example.com.", dns.TypeA)
+	c.put(failed, newReply(failed, dns.RcodeServerFailure))
+	assert.Assert(t, c.get(failed) == nil)
+
+	// the negative replies are cached for the TTL of the SOA record
+	nx := new(dns.Msg).SetQuestion("nx.example.com.", dns.TypeA)
+	nxReply := newReply(nx, dns.RcodeNameError)
+	nxReply.Ns = []dns.RR{&dns.SOA{
+		Hdr:    dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: 60},
+		Minttl: 30,
+	}}
+	assert.Equal(t, c.ttlOf(nxReply), 30*time.Second)
+	c.put(nx, nxReply)
+	assert.Equal(t, c.get(nx).Rcode, dns.RcodeNameError)
+
+	// the cache is full
+	aaaa := new(dns.Msg).SetQuestion("example.com.", dns.TypeAAAA)
+	c.put(aaaa, newReply(aaaa, dns.RcodeSuccess))
+	stats := c.Stats()
+	assert.Equal(t, stats.Entries, 2)
+	assert.Equal(t, stats.Evictions, uint64(1))
+	assert.Equal(t, stats.Hits, uint64(3))
+	assert.Equal(t, stats.NegativeHits, uint64(1))
+	assert.Equal(t, stats.Misses, uint64(2))
+
+	c.flush()
+	assert.Assert(t, c.get(req) == nil)
+}
+
+func TestCacheExpiry(t *testing.T) {
+	c := newCache(10, 5*time.Second)
+	req := new(dns.Msg).SetQuestion("example.com.", dns.TypeA)
+	a := &dns.A{
+		Hdr: dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 0},
+		A:   net.IPv4(192, 0, 2, 1),
+	}
+	// a zero TTL must not be cached
+	c.put(req, newReply(req, dns.RcodeSuccess, a))
+	assert.Assert(t, c.get(req) == nil)
+
+	a.Hdr.Ttl = 10
+	c.put(req, newReply(req, dns.RcodeSuccess, a))
+	key, _ := keyOf(req)
+	c.entries[key].stored = time.Now().Add(-4 * time.Second)
+	assert.Equal(t, c.get(req).Answer[0].Header().Ttl, uint32(6))
+	c.entries[key].expires = time.Now()
+	assert.Assert(t, c.get(req) == nil)
+}
@@ -3,12 +3,21 @@
 package dns
 
 import (
+	"context"
 	"fmt"
+	"github.com/hashicorp/go-multierror"
+	"github.com/mac-vz/macvz/pkg/hostagent/api"
 	"github.com/mac-vz/macvz/pkg/yaml"
 	"github.com/miekg/dns"
 	"github.com/sirupsen/logrus"
+	"golang.org/x/sync/singleflight"
 	"net"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 // Truncate for avoiding "Parse error" from `busybox nslookup`
@@ -16,11 +25,37 @@ import (
 const truncateSize = 512
 
 type Handler struct {
-	clientConfig *dns.ClientConfig
-	clients      []*dns.Client
-	IPv6         bool
-	cname        map[string]string
-	ip           map[string]net.IP
+	// systemServers are the servers of /etc/resolv.conf, as "IP:PORT"
+	systemServers []string
+	// upstreams replace the system resolver, when configured
+	upstreams []string
+	// domains are the servers of the names under the domains, keyed by the canonical name of the domain
+	domains   map[string][]string
+	udpClient *dns.Client
+	tcpClient *dns.Client
+	// timeout is the timeout of a query to an upstream server
+	timeout time.Duration
+	// ttl is the TTL of the answers of the static hosts and the system resolver
+	ttl  uint32
+	IPv6 bool
+
+	// cache is nil when disabled
+	cache *cache
+	// queryLog is nil when disabled
+	queryLog *queryLog
+	// inflight deduplicates the identical queries, e.g. of the A records of the same name by concurrent processes
+	inflight     singleflight.Group
+	deduplicated uint64
+
+	// mu protects the static records, which are replaced by SetStatic.
+	// The names are canonical, and may be wildcards, e.g. "*.dev.test.".
+	mu    sync.RWMutex
+	cname map[string]string
+	ip    map[string]net.IP
+	// ptr maps the reverse names of the static IPs to their names, which are not wildcards
+	ptr map[string][]string
+	srv map[string][]yaml.SRVRecord
+	txt map[string][]string
 }
 
 func newStaticClientConfig(ips []net.IP) (*dns.ClientConfig, error) {
@@ -32,8 +67,22 @@ func newStaticClientConfig(ips []net.IP) (*dns.ClientConfig, error) {
 	return dns.ClientConfigFromReader(r)
 }
 
-//CreateHandler Starts DNS handler to receive request from guest
-func CreateHandler(IPv6 bool) (*Handler, error) {
+//CreateHandler Starts DNS handler to receive request from guest, configured by hostResolver of macvz.yaml
+func CreateHandler(config yaml.HostResolver) (*Handler, error) {
+	// validated by yaml.Validate
+	timeout, err := time.ParseDuration(*config.Timeout)
+	if err != nil {
+		return nil, err
+	}
+	systemTTL, err := time.ParseDuration(*config.Cache.SystemTTL)
+	if err != nil {
+		return nil, err
+	}
+	negativeTTL, err := time.ParseDuration(*config.Cache.NegativeTTL)
+	if err != nil {
+		return nil, err
+	}
+
 	cc, err := dns.ClientConfigFromFile("/etc/resolv.conf")
 	if err != nil {
 		fallbackIPs := []net.IP{net.ParseIP("8.8.8.8"), net.ParseIP("1.1.1.1")}
@@ -43,24 +92,177 @@ func CreateHandler(IPv6 bool) (*Handler, error) {
 			return nil, err
 		}
 	}
-	clients := []*dns.Client{
-		{}, // UDP
-		{Net: "tcp"},
-	}
 	h := &Handler{
-		clientConfig: cc,
-		clients:      clients,
-		IPv6:         IPv6,
-		cname:        make(map[string]string),
-		ip:           make(map[string]net.IP),
+		upstreams: serverAddrs(config.Upstreams),
+		domains:   make(map[string][]string, len(config.Domains)),
+		udpClient: &dns.Client{Timeout: timeout},
+		tcpClient: &dns.Client{Net: "tcp", Timeout: timeout},
+		timeout:   timeout,
+		ttl:       uint32(systemTTL / time.Second),
+		IPv6:      *config.IPv6,
+		cname:     make(map[string]string),
+		ip:        make(map[string]net.IP),
+		ptr:       make(map[string][]string),
+	}
+	for _, srv := range cc.Servers {
+		h.systemServers = append(h.systemServers, net.JoinHostPort(srv, cc.Port))
+	}
+	for domain, servers := range config.Domains {
+		h.domains[yaml.Cname(domain)] = serverAddrs(servers)
+	}
+	if *config.Cache.Enabled {
+		h.cache = newCache(*config.Cache.Size, negativeTTL)
+	}
+	if *config.QueryLog.Enabled {
+		h.queryLog = newQueryLog(*config.QueryLog.Size)
 	}
 	return h, nil
 }
 
-func (h *Handler) handleQuery(req *dns.Msg) *dns.Msg {
+// serverAddrs returns the "IP:PORT" of servers, which are "IP" or "IP:PORT"
+func serverAddrs(servers []string) []string {
+	addrs := make([]string, 0, len(servers))
+	for _, server := range servers {
+		if net.ParseIP(server) != nil {
+			server = net.JoinHostPort(server, "53")
+		}
+		addrs = append(addrs, server)
+	}
+	return addrs
+}
+
+// serversFor returns the servers of name, i.e. the ones of the longest domain of name, or else the upstreams,
+// or else the system servers. configured is false for the system servers.
+func (h *Handler) serversFor(name string) (servers []string, configured bool) {
+	name = yaml.Cname(name)
+	var longest string
+	for domain := range h.domains {
+		if (name == domain || strings.HasSuffix(name, "."+domain)) && len(domain) > len(longest) {
+			longest = domain
+		}
+	}
+	if longest != "" {
+		return h.domains[longest], true
+	}
+	if len(h.upstreams) > 0 {
+		return h.upstreams, true
+	}
+	return h.systemServers, false
+}
+
+// candidates returns the canonical name of name followed by the wildcards matching it, from the most specific,
+// e.g. "a.dev.test.", "*.dev.test.", "*.test."
+func candidates(name string) []string {
+	name = yaml.Cname(name)
+	keys := []string{name}
+	for i := strings.Index(name, "."); i >= 0 && i < len(name)-1; i = strings.Index(name, ".") {
+		name = name[i+1:]
+		keys = append(keys, "*."+name)
+	}
+	return keys
+}
+
+// hostKey returns the key of the static host entry of name, and must be called with h.mu held
+func (h *Handler) hostKey(name string) (string, bool) {
+	for _, key := range candidates(name) {
+		_, isCNAME := h.cname[key]
+		_, isIP := h.ip[key]
+		if isCNAME || isIP {
+			return key, true
+		}
+	}
+	return "", false
+}
+
+// recordKey returns the first candidate of name for which has returns true, e.g. the key of the static SRV records
+func recordKey(name string, has func(key string) bool) (string, bool) {
+	for _, key := range candidates(name) {
+		if has(key) {
+			return key, true
+		}
+	}
+	return "", false
+}
+
+// isStatic returns true if name has a static entry
+func (h *Handler) isStatic(name string) bool {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	if _, ok := h.hostKey(name); ok {
+		return true
+	}
+	if _, ok := h.ptr[yaml.Cname(name)]; ok {
+		return true
+	}
+	_, isSRV := recordKey(name, func(key string) bool { _, ok := h.srv[key]; return ok })
+	_, isTXT := recordKey(name, func(key string) bool { _, ok := h.txt[key]; return ok })
+	return isSRV || isTXT
+}
+
+// lookupStatic follows the static CNAMEs of name, and returns the last name along with its static IP, if any
+func (h *Handler) lookupStatic(name string) (string, net.IP) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	cname := name
+	seen := make(map[string]bool)
+	for {
+		key, ok := h.hostKey(cname)
+		// break cyclic definition
+		if !ok || seen[key] {
+			return cname, nil
+		}
+		if ip, ok := h.ip[key]; ok {
+			return cname, ip
+		}
+		seen[key] = true
+		cname = h.cname[key]
+	}
+}
+
+// lookupStaticRecords returns the static PTR, SRV or TXT records of q, if any
+func (h *Handler) lookupStaticRecords(q dns.Question, hdr dns.RR_Header) []dns.RR {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	var rrs []dns.RR
+	switch q.Qtype {
+	case dns.TypePTR:
+		for _, name := range h.ptr[yaml.Cname(q.Name)] {
+			rrs = append(rrs, &dns.PTR{Hdr: hdr, Ptr: name})
+		}
+	case dns.TypeSRV:
+		key, _ := recordKey(q.Name, func(key string) bool { _, ok := h.srv[key]; return ok })
+		for _, r := range h.srv[key] {
+			rrs = append(rrs, &dns.SRV{
+				Hdr:      hdr,
+				Target:   yaml.Cname(r.Target),
+				Port:     r.Port,
+				Priority: r.Priority,
+				Weight:   r.Weight,
+			})
+		}
+	case dns.TypeTXT:
+		key, _ := recordKey(q.Name, func(key string) bool { _, ok := h.txt[key]; return ok })
+		if txt := h.txt[key]; len(txt) > 0 {
+			rrs = append(rrs, &dns.TXT{Hdr: hdr, Txt: txt})
+		}
+	}
+	return rrs
+}
+
+// handleQuery answers req, and returns the source of the answer
+func (h *Handler) handleQuery(req *dns.Msg) (*dns.Msg, api.DNSSource) {
+	// The names without static entries under the configured domains or upstreams are forwarded as is,
+	// as the system resolver may not know them, e.g. the internal zones of a VPN
+	if len(req.Question) == 1 && !h.isStatic(req.Question[0].Name) {
+		if _, configured := h.serversFor(req.Question[0].Name); configured {
+			return h.handleDefault(req), api.DNSSourceUpstream
+		}
+	}
 	var (
 		reply   dns.Msg
 		handled bool
+		// system is true once the system resolver is used, even along with the static hosts
+		system bool
 	)
 	reply.SetReply(req)
 	for _, q := range req.Question {
@@ -68,7 +270,12 @@ func (h *Handler) handleQuery(req *dns.Msg) *dns.Msg {
 			Name:   q.Name,
 			Rrtype: q.Qtype,
 			Class:  q.Qclass,
-			Ttl:    5,
+			Ttl:    h.ttl,
+		}
+		if rrs := h.lookupStaticRecords(q, hdr); len(rrs) > 0 {
+			reply.Answer = append(reply.Answer, rrs...)
+			handled = true
+			continue
 		}
 		qtype := q.Qtype
 		switch qtype {
@@ -86,22 +293,11 @@ func (h *Handler) handleQuery(req *dns.Msg) *dns.Msg {
 			}
 			fallthrough
 		case dns.TypeCNAME, dns.TypeA:
-			cname := q.Name
-			seen := make(map[string]bool)
-			for {
-				// break cyclic definition
-				if seen[cname] {
-					break
-				}
-				if _, ok := h.cname[cname]; ok {
-					seen[cname] = true
-					cname = h.cname[cname]
-					continue
-				}
-				break
-			}
+			// The system lookups are done without the lock, which is only held for the static hosts
+			cname, staticIP := h.lookupStatic(q.Name)
 			var err error
-			if _, ok := h.ip[cname]; !ok {
+			if staticIP == nil {
+				system = true
 				cname, err = net.LookupCNAME(cname)
 				if err != nil {
 					break
@@ -121,10 +317,11 @@ func (h *Handler) handleQuery(req *dns.Msg) *dns.Msg {
 			}
 			hdr.Name = cname
 			var addrs []net.IP
-			if _, ok := h.ip[cname]; ok {
-				addrs = []net.IP{h.ip[cname]}
+			if staticIP != nil {
+				addrs = []net.IP{staticIP}
 				err = nil
 			} else {
+				system = true
 				addrs, err = net.LookupIP(cname)
 			}
 			if err == nil && len(addrs) > 0 {
@@ -151,6 +348,7 @@ func (h *Handler) handleQuery(req *dns.Msg) *dns.Msg {
 				}
 			}
 		case dns.TypeTXT:
+			system = true
 			txt, err := net.LookupTXT(q.Name)
 			if err == nil && len(txt) > 0 {
 				a := &dns.TXT{
@@ -161,6 +359,7 @@ func (h *Handler) handleQuery(req *dns.Msg) *dns.Msg {
 				handled = true
 			}
 		case dns.TypeNS:
+			system = true
 			ns, err := net.LookupNS(q.Name)
 			if err == nil && len(ns) > 0 {
 				for _, s := range ns {
@@ -175,6 +374,7 @@ func (h *Handler) handleQuery(req *dns.Msg) *dns.Msg {
 				}
 			}
 		case dns.TypeMX:
+			system = true
 			mx, err := net.LookupMX(q.Name)
 			if err == nil && len(mx) > 0 {
 				for _, s := range mx {
@@ -190,6 +390,7 @@ func (h *Handler) handleQuery(req *dns.Msg) *dns.Msg {
 				}
 			}
 		case dns.TypeSRV:
+			system = true
 			_, addrs, err := net.LookupSRV("", "", q.Name)
 			if err == nil {
 				hdr.Rrtype = dns.TypeSRV
@@ -209,26 +410,76 @@ func (h *Handler) handleQuery(req *dns.Msg) *dns.Msg {
 	}
 	if handled {
 		reply.Truncate(truncateSize)
-		return &reply
+		if system {
+			return &reply, api.DNSSourceSystem
+		}
+		return &reply, api.DNSSourceStatic
 	}
-	return h.handleDefault(req)
+	return h.handleDefault(req), api.DNSSourceUpstream
 }
 
 func (h *Handler) handleDefault(req *dns.Msg) *dns.Msg {
-	for _, client := range h.clients {
-		for _, srv := range h.clientConfig.Servers {
-			addr := fmt.Sprintf("%s:%s", srv, h.clientConfig.Port)
-			reply, _, err := client.Exchange(req, addr)
-			if err == nil {
-				reply.Truncate(truncateSize)
-				return reply
-			}
-		}
+	var name string
+	if len(req.Question) > 0 {
+		name = req.Question[0].Name
+	}
+	servers, _ := h.serversFor(name)
+	reply, err := h.exchange(req, servers)
+	if err != nil {
+		logrus.WithError(err).Debugf("failed to forward the query %v", req.Question)
+		var failure dns.Msg
+		failure.SetRcode(req, dns.RcodeServerFailure)
+		return &failure
 	}
-	var reply dns.Msg
-	reply.SetReply(req)
 	reply.Truncate(truncateSize)
-	return &reply
+	return reply
+}
+
+// exchange sends req to servers in parallel over UDP, and returns the first reply that is not an error of the server.
+// A truncated reply is retried over TCP with the same server.
+func (h *Handler) exchange(req *dns.Msg, servers []string) (*dns.Msg, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), h.timeout)
+	defer cancel()
+	type result struct {
+		server string
+		reply  *dns.Msg
+		err    error
+	}
+	results := make(chan result, len(servers))
+	for _, server := range servers {
+		go func(server string) {
+			reply, _, err := h.udpClient.ExchangeContext(ctx, req, server)
+			results <- result{server: server, reply: reply, err: err}
+		}(server)
+	}
+	var (
+		mErr     error
+		fallback *dns.Msg
+	)
+	for range servers {
+		res := <-results
+		if res.err == nil && res.reply.Truncated {
+			res.reply, _, res.err = h.tcpClient.ExchangeContext(ctx, req, res.server)
+		}
+		if res.err != nil {
+			mErr = multierror.Append(mErr, fmt.Errorf("%s: %w", res.server, res.err))
+			continue
+		}
+		switch res.reply.Rcode {
+		case dns.RcodeServerFailure, dns.RcodeRefused:
+			// another server may know better
+			fallback = res.reply
+			continue
+		}
+		return res.reply, nil
+	}
+	if fallback != nil {
+		return fallback, nil
+	}
+	if mErr == nil {
+		return nil, fmt.Errorf("no upstream server")
+	}
+	return nil, mErr
 }
 
 //HandleDNSRequest Handles the DNS request from guest and returns response
@@ -237,21 +488,166 @@ func (h *Handler) HandleDNSRequest(req []byte) *dns.Msg {
 		original dns.Msg
 	)
 	_ = original.Unpack(req)
-	switch original.Opcode {
+	reply, _ := h.handle(&original)
+	return reply
+}
+
+// handle answers req, and records it in the query log
+func (h *Handler) handle(req *dns.Msg) (*dns.Msg, api.DNSQuery) {
+	start := time.Now()
+	var (
+		reply  *dns.Msg
+		source api.DNSSource
+	)
+	switch req.Opcode {
 	case dns.OpcodeQuery:
-		return h.handleQuery(&original)
+		reply, source = h.resolve(req)
 	default:
-		return h.handleDefault(&original)
+		reply, source = h.handleDefault(req), api.DNSSourceUpstream
+	}
+	q := api.DNSQuery{
+		Time:    start,
+		Source:  source,
+		Rcode:   dns.RcodeToString[reply.Rcode],
+		Answers: len(reply.Answer),
+		Latency: time.Since(start),
+	}
+	if len(req.Question) > 0 {
+		q.Name = req.Question[0].Name
+		q.Type = dns.TypeToString[req.Question[0].Qtype]
 	}
+	if h.queryLog != nil {
+		h.queryLog.add(q)
+	}
+	return reply, q
 }
 
-//UpdateDefaults Updates the predefined list of cname and ip
-func (h *Handler) UpdateDefaults(hosts map[string]string) {
-	for host, address := range hosts {
-		if ip := net.ParseIP(address); ip != nil {
-			h.ip[host] = ip
+// resolve answers req from the cache, or else with handleQuery along with the identical queries in flight
+func (h *Handler) resolve(req *dns.Msg) (*dns.Msg, api.DNSSource) {
+	key, ok := keyOf(req)
+	if !ok {
+		return h.handleQuery(req)
+	}
+	if h.cache != nil {
+		if reply := h.cache.get(req); reply != nil {
+			return reply, api.DNSSourceCache
+		}
+	}
+	type result struct {
+		reply  *dns.Msg
+		source api.DNSSource
+	}
+	var leader bool
+	v, _, shared := h.inflight.Do(key.name+"/"+strconv.Itoa(int(key.qtype))+"/"+strconv.Itoa(int(key.qclass)), func() (interface{}, error) {
+		leader = true
+		reply, source := h.handleQuery(req)
+		if h.cache != nil {
+			h.cache.put(req, reply)
+		}
+		return result{reply: reply, source: source}, nil
+	})
+	res := v.(result)
+	reply := res.reply
+	if shared {
+		if !leader {
+			atomic.AddUint64(&h.deduplicated, 1)
+		}
+		// the reply is shared with the other callers
+		reply = reply.Copy()
+	}
+	reply.Id = req.Id
+	reply.Question = append([]dns.Question(nil), req.Question...)
+	return reply, res.source
+}
+
+//Query Resolves name of qtype (e.g. "AAAA") the same way as the queries of the guest, for `macvz dns query`
+func (h *Handler) Query(name, qtype string) (*api.DNSQueryResponse, error) {
+	if qtype == "" {
+		qtype = "A"
+	}
+	t, ok := dns.StringToType[strings.ToUpper(qtype)]
+	if !ok {
+		return nil, fmt.Errorf("unknown type %q", qtype)
+	}
+	if _, ok := dns.IsDomainName(name); !ok {
+		return nil, fmt.Errorf("invalid name %q", name)
+	}
+	req := new(dns.Msg).SetQuestion(dns.Fqdn(name), t)
+	reply, q := h.handle(req)
+	resp := &api.DNSQueryResponse{DNSQuery: q, Records: []string{}}
+	for _, rr := range reply.Answer {
+		resp.Records = append(resp.Records, rr.String())
+	}
+	return resp, nil
+}
+
+//QueryLog Returns the latest queries from the oldest, or nil if the query log is disabled
+func (h *Handler) QueryLog() []api.DNSQuery {
+	if h.queryLog == nil {
+		return nil
+	}
+	return h.queryLog.list()
+}
+
+//CacheStats Returns the statistics of the cache
+func (h *Handler) CacheStats() api.DNSCacheStats {
+	var stats api.DNSCacheStats
+	if h.cache != nil {
+		stats = h.cache.Stats()
+	}
+	stats.Deduplicated = atomic.LoadUint64(&h.deduplicated)
+	return stats
+}
+
+// Static is the static records answered by Handler, keyed by the canonical names
+type Static struct {
+	// Hosts maps the names to an IP or a CNAME
+	Hosts map[string]string
+	SRV   map[string][]yaml.SRVRecord
+	TXT   map[string][]string
+}
+
+//SetStatic Replaces the static records, so that the names removed from s are not answered anymore
+func (h *Handler) SetStatic(s Static) {
+	cname := make(map[string]string)
+	ip := make(map[string]net.IP)
+	ptr := make(map[string][]string)
+	for host, address := range s.Hosts {
+		if addr := net.ParseIP(address); addr != nil {
+			ip[host] = addr
+			if strings.HasPrefix(host, "*.") {
+				continue
+			}
+			// validated by net.ParseIP
+			reverse, _ := dns.ReverseAddr(addr.String())
+			ptr[reverse] = append(ptr[reverse], host)
 		} else {
-			h.cname[host] = yaml.Cname(address)
+			cname[host] = yaml.Cname(address)
 		}
 	}
+	for _, names := range ptr {
+		// the map order is random
+		sort.Strings(names)
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.cname, h.ip, h.ptr, h.srv, h.txt = cname, ip, ptr, s.SRV, s.TXT
+	if h.cache != nil {
+		// the cached answers may have been derived from the previous records
+		h.cache.flush()
+	}
+}
+
+//Hosts Returns the predefined list of cname and ip, keyed by host name
+func (h *Handler) Hosts() map[string]string {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	hosts := make(map[string]string, len(h.cname)+len(h.ip))
+	for host, cname := range h.cname {
+		hosts[host] = cname
+	}
+	for host, ip := range h.ip {
+		hosts[host] = ip.String()
+	}
+	return hosts
 }
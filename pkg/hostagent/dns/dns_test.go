@@ -0,0 +1,249 @@
+package dns
+
+import (
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/mac-vz/macvz/pkg/hostagent/api"
+	"github.com/mac-vz/macvz/pkg/yaml"
+	"github.com/miekg/dns"
+	"gotest.tools/v3/assert"
+)
+
+// startServer starts a DNS server on UDP, which replies with rcode after delay, and counts the queries
+func startServer(t *testing.T, rcode int, delay time.Duration, queries *uint64) string {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.NilError(t, err)
+	handler := dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		if queries != nil {
+			atomic.AddUint64(queries, 1)
+		}
+		time.Sleep(delay)
+		reply := new(dns.Msg)
+		reply.SetRcode(req, rcode)
+		if rcode == dns.RcodeSuccess {
+			reply.Answer = append(reply.Answer, &dns.CAA{
+				Hdr:   dns.RR_Header{Name: req.Question[0].Name, Rrtype: dns.TypeCAA, Class: dns.ClassINET, Ttl: 60},
+				Tag:   "issue",
+				Value: pc.LocalAddr().String(),
+			})
+		}
+		_ = w.WriteMsg(reply)
+	})
+	srv := &dns.Server{PacketConn: pc, Handler: handler}
+	go func() { _ = srv.ActivateAndServe() }()
+	t.Cleanup(func() { _ = srv.Shutdown() })
+	return pc.LocalAddr().String()
+}
+
+func newTestHandler(t *testing.T, servers ...string) *Handler {
+	timeout := time.Second
+	return &Handler{
+		systemServers: servers,
+		domains:       make(map[string][]string),
+		udpClient:     &dns.Client{Timeout: timeout},
+		tcpClient:     &dns.Client{Net: "tcp", Timeout: timeout},
+		timeout:       timeout,
+		ttl:           5,
+		cache:         newCache(100, 5*time.Second),
+		cname:         make(map[string]string),
+		ip:            make(map[string]net.IP),
+	}
+}
+
+func TestExchange(t *testing.T) {
+	h := newTestHandler(t)
+	failing := startServer(t, dns.RcodeServerFailure, 0, nil)
+	slow := startServer(t, dns.RcodeSuccess, 500*time.Millisecond, nil)
+	fast := startServer(t, dns.RcodeSuccess, 0, nil)
+	req := new(dns.Msg).SetQuestion("example.com.", dns.TypeCAA)
+
+	reply, err := h.exchange(req, []string{failing, slow, fast})
+	assert.NilError(t, err)
+	assert.Equal(t, reply.Answer[0].(*dns.CAA).Value, fast, "the fastest server must win")
+
+	reply, err = h.exchange(req, []string{failing, slow})
+	assert.NilError(t, err)
+	assert.Equal(t, reply.Answer[0].(*dns.CAA).Value, slow, "a server failure must not win")
+
+	reply, err = h.exchange(req, []string{failing})
+	assert.NilError(t, err)
+	assert.Equal(t, reply.Rcode, dns.RcodeServerFailure)
+
+	h.timeout = 100 * time.Millisecond
+	_, err = h.exchange(req, []string{slow})
+	assert.ErrorContains(t, err, slow)
+}
+
+func TestResolveCache(t *testing.T) {
+	var queries uint64
+	h := newTestHandler(t, startServer(t, dns.RcodeSuccess, 100*time.Millisecond, &queries))
+	req := new(dns.Msg).SetQuestion("example.com.", dns.TypeCAA)
+	packed, err := req.Pack()
+	assert.NilError(t, err)
+
+	done := make(chan *dns.Msg)
+	for i := 0; i < 3; i++ {
+		go func() { done <- h.HandleDNSRequest(packed) }()
+	}
+	for i := 0; i < 3; i++ {
+		reply := <-done
+		assert.Equal(t, reply.Id, req.Id)
+		assert.Equal(t, len(reply.Answer), 1)
+	}
+	reply := h.HandleDNSRequest(packed)
+	assert.Equal(t, len(reply.Answer), 1)
+	assert.Equal(t, atomic.LoadUint64(&queries), uint64(1), "the identical queries must be answered by a single lookup")
+	stats := h.CacheStats()
+	assert.Equal(t, stats.Hits, uint64(1))
+	assert.Equal(t, stats.Deduplicated, uint64(2))
+
+	h.SetStatic(Static{Hosts: map[string]string{"host.macvz.internal.": "192.168.5.2"}})
+	_ = h.HandleDNSRequest(packed)
+	assert.Equal(t, atomic.LoadUint64(&queries), uint64(2), "the cache must be flushed as the hosts change")
+}
+
+func TestServersFor(t *testing.T) {
+	h := newTestHandler(t, "192.168.1.1:53")
+	h.domains = map[string][]string{
+		"corp.example.":     {"10.0.0.53:53"},
+		"dev.corp.example.": {"10.0.1.53:53"},
+	}
+	for _, tc := range []struct {
+		name       string
+		servers    []string
+		configured bool
+	}{
+		{"corp.example.", []string{"10.0.0.53:53"}, true},
+		{"git.CORP.example", []string{"10.0.0.53:53"}, true},
+		{"api.dev.corp.example.", []string{"10.0.1.53:53"}, true},
+		{"notcorp.example.", []string{"192.168.1.1:53"}, false},
+		{"example.com.", []string{"192.168.1.1:53"}, false},
+	} {
+		servers, configured := h.serversFor(tc.name)
+		assert.DeepEqual(t, servers, tc.servers)
+		assert.Equal(t, configured, tc.configured, tc.name)
+	}
+
+	h.upstreams = []string{"9.9.9.9:53"}
+	servers, configured := h.serversFor("example.com.")
+	assert.DeepEqual(t, servers, []string{"9.9.9.9:53"})
+	assert.Assert(t, configured)
+}
+
+func TestSplitHorizon(t *testing.T) {
+	corp := startServer(t, dns.RcodeSuccess, 0, nil)
+	h := newTestHandler(t)
+	h.domains = map[string][]string{"corp.example.": {corp}}
+	// the A queries are forwarded too, instead of being answered by the system resolver
+	req := new(dns.Msg).SetQuestion("git.corp.example.", dns.TypeA)
+	packed, err := req.Pack()
+	assert.NilError(t, err)
+	reply := h.HandleDNSRequest(packed)
+	assert.Equal(t, reply.Rcode, dns.RcodeSuccess)
+	assert.Equal(t, reply.Answer[0].(*dns.CAA).Value, corp)
+
+	h.SetStatic(Static{Hosts: map[string]string{"git.corp.example.": "192.168.5.2"}})
+	reply = h.HandleDNSRequest(packed)
+	assert.Equal(t, reply.Answer[0].(*dns.A).A.String(), "192.168.5.2", "the static hosts must win")
+}
+
+func TestStaticRecords(t *testing.T) {
+	h := newTestHandler(t)
+	h.SetStatic(Static{
+		Hosts: map[string]string{
+			"*.dev.test.":   "192.168.5.2",
+			"api.dev.test.": "192.168.5.3",
+			"app.test.":     "192.168.5.3",
+			"*.alias.test.": "api.dev.test",
+		},
+		SRV: map[string][]yaml.SRVRecord{
+			"_http._tcp.app.test.": {{Target: "app.test", Port: 8080, Priority: 10}},
+		},
+		TXT: map[string][]string{"*.dev.test.": {"v=dev"}},
+	})
+	query := func(name string, qtype uint16) *dns.Msg {
+		req := new(dns.Msg).SetQuestion(name, qtype)
+		packed, err := req.Pack()
+		assert.NilError(t, err)
+		return h.HandleDNSRequest(packed)
+	}
+
+	reply := query("web.a.DEV.test.", dns.TypeA)
+	assert.Equal(t, reply.Answer[0].(*dns.A).A.String(), "192.168.5.2")
+	reply = query("api.dev.test.", dns.TypeA)
+	assert.Equal(t, reply.Answer[0].(*dns.A).A.String(), "192.168.5.3", "an exact name must win over a wildcard")
+	reply = query("x.alias.test.", dns.TypeA)
+	assert.Equal(t, reply.Answer[0].(*dns.CNAME).Target, "api.dev.test.")
+	assert.Equal(t, reply.Answer[1].(*dns.A).A.String(), "192.168.5.3")
+
+	reply = query("3.5.168.192.in-addr.arpa.", dns.TypePTR)
+	assert.Equal(t, len(reply.Answer), 2)
+	assert.Equal(t, reply.Answer[0].(*dns.PTR).Ptr, "api.dev.test.")
+	assert.Equal(t, reply.Answer[1].(*dns.PTR).Ptr, "app.test.")
+
+	reply = query("_http._tcp.app.test.", dns.TypeSRV)
+	srv := reply.Answer[0].(*dns.SRV)
+	assert.Equal(t, srv.Target, "app.test.")
+	assert.Equal(t, srv.Port, uint16(8080))
+	assert.Equal(t, srv.Priority, uint16(10))
+
+	reply = query("web.dev.test.", dns.TypeTXT)
+	assert.DeepEqual(t, reply.Answer[0].(*dns.TXT).Txt, []string{"v=dev"})
+}
+
+func TestCandidates(t *testing.T) {
+	assert.DeepEqual(t, candidates("A.dev.test"), []string{"a.dev.test.", "*.dev.test.", "*.test."})
+	assert.DeepEqual(t, candidates("."), []string{"."})
+}
+
+func TestSetStatic(t *testing.T) {
+	h := newTestHandler(t)
+	h.SetStatic(Static{Hosts: map[string]string{
+		"old.test.":  "192.168.5.2",
+		"kept.test.": "192.168.5.3",
+	}})
+	h.SetStatic(Static{Hosts: map[string]string{
+		"kept.test.": "192.168.5.4",
+	}})
+	assert.DeepEqual(t, h.Hosts(), map[string]string{"kept.test.": "192.168.5.4"})
+	assert.Assert(t, !h.isStatic("old.test."), "the removed names must not be answered")
+	_, ok := h.ptr["2.5.168.192.in-addr.arpa."]
+	assert.Assert(t, !ok)
+}
+
+func TestQuerySources(t *testing.T) {
+	corp := startServer(t, dns.RcodeSuccess, 0, nil)
+	h := newTestHandler(t)
+	h.queryLog = newQueryLog(10)
+	h.domains = map[string][]string{"corp.example.": {corp}}
+	h.SetStatic(Static{Hosts: map[string]string{"app.test.": "192.168.5.15"}})
+
+	resp, err := h.Query("app.test", "")
+	assert.NilError(t, err)
+	assert.Equal(t, resp.Type, "A")
+	assert.Equal(t, resp.Source, api.DNSSourceStatic)
+	assert.Equal(t, resp.Rcode, "NOERROR")
+	assert.Equal(t, len(resp.Records), 1)
+	assert.Assert(t, strings.HasSuffix(resp.Records[0], "192.168.5.15"), resp.Records[0])
+
+	resp, err = h.Query("app.test.", "a")
+	assert.NilError(t, err)
+	assert.Equal(t, resp.Source, api.DNSSourceCache)
+
+	resp, err = h.Query("git.corp.example", "CAA")
+	assert.NilError(t, err)
+	assert.Equal(t, resp.Source, api.DNSSourceUpstream)
+
+	_, err = h.Query("app.test", "BOGUS")
+	assert.ErrorContains(t, err, "unknown type")
+
+	var sources []string
+	for _, q := range h.QueryLog() {
+		sources = append(sources, q.Name+" "+q.Source)
+	}
+	assert.DeepEqual(t, sources, []string{"app.test. static", "app.test. cache", "git.corp.example. upstream"})
+}
@@ -0,0 +1,45 @@
+package dns
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+
+	"github.com/mac-vz/macvz/pkg/yaml"
+)
+
+// ParseHostsFile parses the entries of r in the format of /etc/hosts, i.e. "IP NAME [ALIAS...]",
+// into the IPs keyed by the canonical names. The first entry of a name wins, as with /etc/hosts.
+func ParseHostsFile(r io.Reader) (map[string]string, error) {
+	hosts := make(map[string]string)
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text := scanner.Text()
+		if i := strings.IndexByte(text, '#'); i >= 0 {
+			text = text[:i]
+		}
+		fields := strings.Fields(text)
+		if len(fields) == 0 {
+			continue
+		}
+		ip := net.ParseIP(fields[0])
+		if ip == nil {
+			return nil, fmt.Errorf("line %d: invalid IP address %q", line, fields[0])
+		}
+		if len(fields) == 1 {
+			return nil, fmt.Errorf("line %d: no name for %s", line, ip)
+		}
+		for _, name := range fields[1:] {
+			name = yaml.Cname(name)
+			if _, ok := hosts[name]; !ok {
+				hosts[name] = ip.String()
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return hosts, nil
+}
@@ -0,0 +1,28 @@
+package dns
+
+import (
+	"strings"
+	"testing"
+
+	"gotest.tools/v3/assert"
+)
+
+func TestParseHostsFile(t *testing.T) {
+	hosts, err := ParseHostsFile(strings.NewReader(`# comment
+192.168.5.15	app.test   API.test # the API
+::1 v6.test
+
+192.168.5.16 app.test
+`))
+	assert.NilError(t, err)
+	assert.DeepEqual(t, hosts, map[string]string{
+		"app.test.": "192.168.5.15",
+		"api.test.": "192.168.5.15",
+		"v6.test.":  "::1",
+	})
+
+	_, err = ParseHostsFile(strings.NewReader("app.test 192.168.5.15\n"))
+	assert.ErrorContains(t, err, "line 1: invalid IP address")
+	_, err = ParseHostsFile(strings.NewReader("\n192.168.5.15\n"))
+	assert.ErrorContains(t, err, "line 2: no name")
+}
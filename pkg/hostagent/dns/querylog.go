@@ -0,0 +1,40 @@
+package dns
+
+import (
+	"sync"
+
+	"github.com/mac-vz/macvz/pkg/hostagent/api"
+)
+
+// queryLog is a ring buffer of the latest queries
+type queryLog struct {
+	mu      sync.Mutex
+	entries []api.DNSQuery
+	// next is the index of the next entry, which is the oldest one once entries is full
+	next int
+	full bool
+}
+
+func newQueryLog(size int) *queryLog {
+	return &queryLog{entries: make([]api.DNSQuery, size)}
+}
+
+func (l *queryLog) add(q api.DNSQuery) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.entries[l.next] = q
+	l.next = (l.next + 1) % len(l.entries)
+	if l.next == 0 {
+		l.full = true
+	}
+}
+
+// list returns the entries from the oldest
+func (l *queryLog) list() []api.DNSQuery {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if !l.full {
+		return append([]api.DNSQuery{}, l.entries[:l.next]...)
+	}
+	return append(append([]api.DNSQuery{}, l.entries[l.next:]...), l.entries[:l.next]...)
+}
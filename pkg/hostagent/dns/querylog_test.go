@@ -0,0 +1,28 @@
+package dns
+
+import (
+	"testing"
+
+	"github.com/mac-vz/macvz/pkg/hostagent/api"
+	"gotest.tools/v3/assert"
+)
+
+func TestQueryLog(t *testing.T) {
+	l := newQueryLog(3)
+	names := func() []string {
+		var names []string
+		for _, q := range l.list() {
+			names = append(names, q.Name)
+		}
+		return names
+	}
+	assert.Equal(t, len(l.list()), 0)
+	for _, name := range []string{"a.", "b."} {
+		l.add(api.DNSQuery{Name: name})
+	}
+	assert.DeepEqual(t, names(), []string{"a.", "b."})
+	for _, name := range []string{"c.", "d.", "e."} {
+		l.add(api.DNSQuery{Name: name})
+	}
+	assert.DeepEqual(t, names(), []string{"c.", "d.", "e."})
+}
@@ -0,0 +1,80 @@
+package hostagent
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/mac-vz/macvz/pkg/socket"
+	"github.com/mac-vz/macvz/pkg/types"
+)
+
+// errExecUnavailable is returned by execScript when the guest agent could not start the script,
+// in which case it may still be run over SSH
+var errExecUnavailable = errors.New("guest agent cannot execute the script")
+
+// Exec starts a command in the guest through the guest agent, as the user of the instance (`user.name`) unless ev.User is set.
+// The returned stream carries the frames of socket.ExecFrameWriter, see socket.StreamExec.
+// Closing it before the exit code is received kills the command.
+func (a *HostAgent) Exec(ctx context.Context, ev types.ExecEvent) (net.Conn, error) {
+	if !a.guestSupports(types.CapabilityExec) {
+		return nil, errors.New("guest agent does not support exec, as it was probably installed by an older version of macvz")
+	}
+	if ev.User == "" {
+		ev.User = *a.y.User.Name
+	}
+	ev.Kind = types.ExecMessage
+	var res types.ExecEventResponse
+	conn, err := a.guestClient.Open(ctx, types.ExecMessage, &ev, &res)
+	if err != nil {
+		return nil, fmt.Errorf("guest agent failed to execute %v: %w", ev.Args, err)
+	}
+	return conn, nil
+}
+
+// execScript runs script with the interpreter of its shebang through the guest agent, like sshclient.Client.ExecuteScript
+func (a *HostAgent) execScript(ctx context.Context, script string) (stdout, stderr string, err error) {
+	interpreter, err := scriptInterpreter(script)
+	if err != nil {
+		return "", "", err
+	}
+	conn, err := a.Exec(ctx, types.ExecEvent{Args: interpreter})
+	if err != nil {
+		return "", "", fmt.Errorf("%w: %v", errExecUnavailable, err)
+	}
+	defer conn.Close()
+
+	// Interrupt the script when ctx is cancelled
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			_ = conn.Close()
+		case <-done:
+		}
+	}()
+
+	var stdoutBuf, stderrBuf bytes.Buffer
+	code, err := socket.StreamExec(conn, strings.NewReader(script), &stdoutBuf, &stderrBuf, nil)
+	if err == nil && code != 0 {
+		err = fmt.Errorf("exit status %d", code)
+	}
+	return stdoutBuf.String(), stderrBuf.String(), err
+}
+
+// scriptInterpreter returns the interpreter in the shebang of script, e.g. ["/bin/bash"]
+func scriptInterpreter(script string) ([]string, error) {
+	firstLine := strings.SplitN(script, "\n", 2)[0]
+	if !strings.HasPrefix(firstLine, "#!") {
+		return nil, fmt.Errorf("no shebang in script %q", firstLine)
+	}
+	interpreter := strings.Fields(strings.TrimPrefix(firstLine, "#!"))
+	if len(interpreter) == 0 {
+		return nil, fmt.Errorf("no interpreter in shebang %q", firstLine)
+	}
+	return interpreter, nil
+}
@@ -0,0 +1,73 @@
+package hostagent
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+
+	"github.com/mac-vz/macvz/pkg/socket"
+	"github.com/mac-vz/macvz/pkg/store/filenames"
+	"github.com/mac-vz/macvz/pkg/types"
+	"github.com/sirupsen/logrus"
+)
+
+// setGuestInfo records the information sent by the guest agent along with InfoEvent
+func (a *HostAgent) setGuestInfo(info types.GuestInfo) {
+	if info.OSRelease == nil && info.Kernel == "" {
+		// sent by a guest agent older than GuestInfo
+		return
+	}
+	a.stateMu.Lock()
+	a.guestInfo = &info
+	a.stateMu.Unlock()
+	a.saveGuestInfo()
+}
+
+func (a *HostAgent) statsEventHandler(ctx context.Context, req *socket.Request) (interface{}, error) {
+	var statsEvent types.StatsEvent
+	if err := req.Decode(&statsEvent); err != nil {
+		return nil, err
+	}
+	a.stateMu.Lock()
+	if a.guestInfo == nil {
+		a.guestInfo = &types.GuestInfo{}
+	}
+	// guestInfo is shared by Info and store.Inspect, so it is replaced rather than modified
+	info := *a.guestInfo
+	info.Stats = &statsEvent.Stats
+	a.guestInfo = &info
+	a.stateMu.Unlock()
+	a.saveGuestInfo()
+	return nil, nil
+}
+
+// saveGuestInfo writes the guest info to filenames.GuestInfo, for store.Inspect
+func (a *HostAgent) saveGuestInfo() {
+	a.stateMu.RLock()
+	b, err := json.Marshal(a.guestInfo)
+	a.stateMu.RUnlock()
+	if err != nil {
+		logrus.WithError(err).Warn("failed to marshal the guest info")
+		return
+	}
+	// the file is replaced atomically, as `macvz list` may read it at any time
+	path := filepath.Join(a.instDir, filenames.GuestInfo)
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, b, 0o644); err != nil {
+		logrus.WithError(err).Warn("failed to save the guest info")
+		return
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		logrus.WithError(err).Warn("failed to save the guest info")
+	}
+}
+
+// removeGuestInfo removes the guest info saved by a previous boot of the guest
+func removeGuestInfo(instDir string) error {
+	if err := os.Remove(filepath.Join(instDir, filenames.GuestInfo)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,111 @@
+package hostagent
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/mac-vz/macvz/pkg/hostagent/events"
+	"github.com/mac-vz/macvz/pkg/socket"
+	"github.com/mac-vz/macvz/pkg/types"
+	"github.com/mac-vz/macvz/pkg/version"
+	"github.com/sirupsen/logrus"
+)
+
+// legacyGuestAgentVersion is reported for the guest agents older than the handshake
+const legacyGuestAgentVersion = "<legacy>"
+
+// hostKinds are the message kinds the host agent receives
+var hostKinds = []types.Kind{
+	types.HelloMessage,
+	types.InfoMessage,
+	types.PortMessage,
+	types.DNSMessage,
+	types.ConnectResponseMessage,
+	types.StatsMessage,
+}
+
+// helloEventHandler replies to the handshake of the guest agent.
+// The guest agent is refused when its protocol version differs, in which case the ports are forwarded over SSH.
+func (a *HostAgent) helloEventHandler(ctx context.Context, req *socket.Request) (interface{}, error) {
+	var hello types.HelloEvent
+	if err := req.Decode(&hello); err != nil {
+		return nil, err
+	}
+	logrus.Infof("guest agent %s connected (protocol %d, kinds %v, capabilities %v)",
+		hello.Version, hello.ProtocolVersion, hello.Kinds, hello.Capabilities)
+
+	res := types.HelloEvent{
+		Version:         version.Version,
+		ProtocolVersion: types.ProtocolVersion,
+		Kinds:           hostKinds,
+		Capabilities:    []types.Capability{types.CapabilityTimeSync},
+	}
+	res.Kind = types.HelloResponseMessage
+	if hello.ProtocolVersion != types.ProtocolVersion {
+		err := fmt.Errorf("guest agent %s speaks protocol version %d, while host agent %s speaks %d; forwarding ports over SSH",
+			hello.Version, hello.ProtocolVersion, version.Version, types.ProtocolVersion)
+		res.Error = err.Error()
+		hello.Capabilities = nil
+		a.reportGuestAgentError(ctx, err)
+	}
+
+	// The handshake completes with the InfoEvent that follows, see guestAgentConnected
+	a.stateMu.Lock()
+	a.pendingHello = &hello
+	a.stateMu.Unlock()
+	return &res, nil
+}
+
+// guestAgentConnected is called on the InfoEvent sent by every guest agent once connected.
+// A guest agent that did not send HelloEvent before is older than the handshake, and gets no capabilities.
+func (a *HostAgent) guestAgentConnected(ctx context.Context) {
+	a.stateMu.Lock()
+	hello := a.pendingHello
+	a.pendingHello = nil
+	if hello == nil {
+		hello = &types.HelloEvent{Version: legacyGuestAgentVersion}
+	}
+	a.guestAgent = hello
+	a.stateMu.Unlock()
+	// The guest clock may have drifted while the guest agent was disconnected
+	a.requestTimeSync()
+
+	if hello.Version == legacyGuestAgentVersion {
+		a.reportGuestAgentError(ctx, fmt.Errorf("guest agent does not support the handshake of host agent %s, "+
+			"as it was probably installed by an older version of macvz; forwarding ports over SSH", version.Version))
+	}
+}
+
+// guestSupports returns true if the guest agent advertised c.
+// Until the guest agent connects, it is assumed to be as recent as the host agent.
+func (a *HostAgent) guestSupports(c types.Capability) bool {
+	a.stateMu.RLock()
+	defer a.stateMu.RUnlock()
+	if a.guestAgent == nil {
+		return true
+	}
+	return a.guestAgent.HasCapability(c)
+}
+
+// reportGuestAgentError surfaces err in the status of the instance, which becomes degraded once running
+func (a *HostAgent) reportGuestAgentError(ctx context.Context, err error) {
+	logrus.Warn(err)
+	a.stateMu.Lock()
+	a.guestAgentErr = err
+	st := a.status
+	a.stateMu.Unlock()
+	if !st.Running {
+		// Run reports the error along with the running status
+		return
+	}
+	st.Degraded = true
+	st.Errors = append(append([]string{}, st.Errors...), err.Error())
+	a.emitEvent(ctx, events.Event{Status: st})
+}
+
+// guestAgentError returns the error reported by reportGuestAgentError
+func (a *HostAgent) guestAgentError() error {
+	a.stateMu.RLock()
+	defer a.stateMu.RUnlock()
+	return a.guestAgentErr
+}
@@ -3,21 +3,22 @@ package hostagent
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"github.com/hashicorp/yamux"
-	"github.com/lima-vm/sshocker/pkg/ssh"
 	"github.com/mac-vz/macvz/pkg/cidata"
+	"github.com/mac-vz/macvz/pkg/guestip"
+	"github.com/mac-vz/macvz/pkg/hostagent/api"
 	"github.com/mac-vz/macvz/pkg/hostagent/dns"
 	"github.com/mac-vz/macvz/pkg/hostagent/events"
 	"github.com/mac-vz/macvz/pkg/socket"
+	"github.com/mac-vz/macvz/pkg/sshclient"
 	"github.com/mac-vz/macvz/pkg/types"
+	"github.com/mac-vz/macvz/pkg/version"
 	"github.com/mac-vz/macvz/pkg/vzrun"
 	"github.com/mac-vz/macvz/pkg/yaml"
 	"net"
 	"os"
-	"os/exec"
-	"path/filepath"
-	"strings"
+	"strconv"
 	"sync"
 	"time"
 
@@ -32,20 +33,47 @@ type HostAgent struct {
 	y             *yaml.MacVZYaml
 	instDir       string
 	instName      string
-	sshConfig     *ssh.SSHConfig
+	guestIP       *guestip.Resolver
+	sshClient     sshclient.Client
 	portForwarder *portForwarder
+	vm            *vzrun.VM
+	// guestClient sends requests to the guest agent
+	guestClient *socket.Client
 
 	udpDNSLocalPort int
 	tcpDNSLocalPort int
 	dnsHandler      *dns.Handler
 
-	onClose []func() error // LIFO
+	// hostsMu protects the sources of the static records of dnsHandler, see updateDNSHosts
+	hostsMu      sync.Mutex
+	hostResolver yaml.HostResolver
+	fileHosts    map[string]string
+	addedHosts   map[string]string
+
+	// onCloseMu protects onClose and closed
+	onCloseMu sync.Mutex
+	onClose   []func() error // LIFO
+	// closed is set once onClose has run, as the VM stopped
+	closed bool
 
 	sigintCh chan os.Signal
+	// timeSyncCh requests syncGuestTime to send the host clock
+	timeSyncCh chan struct{}
 
-	sshRemote  string
 	eventEnc   *json.Encoder
 	eventEncMu sync.Mutex
+
+	// stateMu protects the fields below, which are served by the host agent API
+	stateMu      sync.RWMutex
+	status       events.Status
+	gatewayIP    string
+	guestInfo    *types.GuestInfo
+	requirements []api.Requirement
+	// pendingHello is the handshake of the guest agent, until its InfoEvent
+	pendingHello *types.HelloEvent
+	// guestAgent is the handshake of the connected guest agent
+	guestAgent    *types.HelloEvent
+	guestAgentErr error
 }
 
 // New creates the HostAgent.
@@ -63,147 +91,273 @@ func New(instName string, sigintCh chan os.Signal) (*HostAgent, error) {
 	}
 	// y is loaded with FillDefault() already, so no need to care about nil pointers.
 
-	sshOpts, err := sshutil.SSHOpts(inst.Dir, *y.SSH.LoadDotSSHPubKeys, *y.SSH.ForwardAgent)
-	if err != nil {
+	// The host key of the guest is generated along with cidata, and pinned by the SSH client
+	if err := cidata.GenerateISO9660(inst.Dir, instName, y); err != nil {
 		return nil, err
 	}
-	sshConfig := &ssh.SSHConfig{
-		AdditionalArgs: sshutil.SSHArgsFromOpts(sshOpts),
+
+	// The address cached by the previous boot of the guest may have been leased to another one since
+	guestIP := guestip.NewResolver(inst.Dir, *y.MACAddress)
+	if err := guestIP.Reset(); err != nil {
+		return nil, err
+	}
+	if err := removeGuestInfo(inst.Dir); err != nil {
+		return nil, err
 	}
 
-	if err := cidata.GenerateISO9660(inst.Dir, instName, y); err != nil {
+	sshClient, err := newSSHClient(inst.Dir, y, *y.SSH.Client, guestIP.Resolve)
+	if err != nil {
 		return nil, err
 	}
 
 	rules := make([]yaml.PortForward, 0, 2+len(y.PortForwards))
-	// Block ports 22 and sshLocalPort on all IPs
-	for _, port := range []int{22} {
+	// Block the port of sshd on all IPs
+	for _, port := range []int{*y.SSH.Port} {
 		rule := yaml.PortForward{GuestIP: net.IPv4zero, GuestPort: port, Ignore: true}
-		yaml.FillPortForwardDefaults(&rule, inst.Dir)
+		yaml.FillPortForwardDefaults(&rule, inst.Dir, y.User)
 		rules = append(rules, rule)
 	}
 	rules = append(rules, y.PortForwards...)
 	// Default forwards for all non-privileged ports from "127.0.0.1" and "::1"
 	rule := yaml.PortForward{GuestIP: guestagentapi.IPv4loopback1}
-	yaml.FillPortForwardDefaults(&rule, inst.Dir)
+	yaml.FillPortForwardDefaults(&rule, inst.Dir, y.User)
 	rules = append(rules, rule)
 
 	var dnsHandler *dns.Handler
 	if *y.HostResolver.Enabled {
-		dnsHandler, err = dns.CreateHandler(*y.HostResolver.IPv6)
+		dnsHandler, err = dns.CreateHandler(y.HostResolver)
 		if err != nil {
 			logrus.Error("cannot start DNS server: %w", err)
 		}
 	}
 
 	a := &HostAgent{
-		y:             y,
-		instDir:       inst.Dir,
-		instName:      instName,
-		sshConfig:     sshConfig,
-		sigintCh:      sigintCh,
-		eventEnc:      json.NewEncoder(os.Stdout),
-		portForwarder: newPortForwarder(sshConfig, rules),
-		dnsHandler:    dnsHandler,
+		y:          y,
+		instDir:    inst.Dir,
+		instName:   instName,
+		guestIP:    guestIP,
+		sshClient:  sshClient,
+		sigintCh:   sigintCh,
+		timeSyncCh: make(chan struct{}, 1),
+		eventEnc:   json.NewEncoder(os.Stdout),
+		dnsHandler: dnsHandler,
+	}
+	a.portForwarder = newPortForwarder(sshClient, rules, a.dialGuest, a.guestSupports)
+	if dnsHandler != nil {
+		if err := a.loadDNSHosts(); err != nil {
+			logrus.WithError(err).Warn("failed to load the DNS hosts")
+		}
 	}
 
+	mux := socket.NewMux()
+	mux.Handle(types.HelloMessage, a.helloEventHandler)
+	mux.Handle(types.InfoMessage, a.infoEventHandler)
+	mux.Handle(types.PortMessage, a.portEventHandler)
+	mux.Handle(types.DNSMessage, a.dnsEventHandler)
+	mux.Handle(types.StatsMessage, a.statsEventHandler)
+
+	//Init vm
+	a.vm, err = vzrun.InitializeVM(instName, mux, sigintCh)
+	if err != nil {
+		return nil, err
+	}
+	a.guestClient = socket.NewClient(a.vm.OpenStream)
+
 	return a, nil
 }
 
-func (a *HostAgent) Run(ctx context.Context) error {
+func (a *HostAgent) Run(ctx context.Context) (err error) {
 	defer func() {
 		exitingEv := events.Event{
 			Status: events.Status{
 				Exiting: true,
 			},
 		}
+		// `macvz stop` reports these errors, as the guest did not reach the stopped state cleanly
+		if err != nil {
+			exitingEv.Status.Errors = append(exitingEv.Status.Errors, err.Error())
+		}
 		a.emitEvent(ctx, exitingEv)
 	}()
 
 	stBooting := events.Status{}
 	a.emitEvent(ctx, events.Event{Status: stBooting})
 
+	// Registered first to run last, after the forwards are cancelled over the SSH connection
+	a.addOnClose(func() error {
+		logrus.Debugf("closing the SSH connection")
+		if closeErr := a.sshClient.Close(); closeErr != nil {
+			logrus.WithError(closeErr).Warn("failed to close the SSH connection")
+		}
+		// The address and the info must not outlive the guest
+		if err := removeGuestInfo(a.instDir); err != nil {
+			logrus.WithError(err).Warn("failed to remove the guest info")
+		}
+		return a.guestIP.Reset()
+	})
+
 	ctxHA, cancelHA := context.WithCancel(ctx)
+	go a.syncGuestTime(ctxHA)
+	if a.dnsHandler != nil {
+		go a.watchDNSHosts(ctxHA)
+	}
 	go func() {
 		stRunning := events.Status{}
 		if haErr := a.startHostAgentRoutines(ctxHA); haErr != nil {
 			stRunning.Degraded = true
 			stRunning.Errors = append(stRunning.Errors, haErr.Error())
 		}
+		if gaErr := a.guestAgentError(); gaErr != nil {
+			stRunning.Degraded = true
+			stRunning.Errors = append(stRunning.Errors, gaErr.Error())
+		}
 		stRunning.Running = true
 		a.emitEvent(ctx, events.Event{Status: stRunning})
 	}()
 
-	handlers := make(map[types.Kind]func(ctx2 context.Context, stream *yamux.Stream, event interface{}))
-	handlers[types.InfoMessage] = a.infoEventHandler
-	handlers[types.PortMessage] = a.portEventHandler
-	handlers[types.DNSMessage] = a.dnsEventHandler
+	err = a.vm.Run()
+	cancelHA()
+	if closeErr := a.close(); closeErr != nil {
+		logrus.WithError(closeErr).Warn("failed to clean up after the VM stopped")
+	}
+	return err
+}
 
-	//Init vm
-	vm, err := vzrun.InitializeVM(a.instName, handlers, a.sigintCh)
-	if err != nil {
-		logrus.Fatal("INIT", err)
+// addOnClose registers f to be run by close, or runs it if close has already run
+func (a *HostAgent) addOnClose(f func() error) {
+	a.onCloseMu.Lock()
+	if !a.closed {
+		a.onClose = append(a.onClose, f)
+		a.onCloseMu.Unlock()
+		return
 	}
-	err = vm.Run()
-	if err != nil {
-		logrus.Fatal("RUN", err)
+	a.onCloseMu.Unlock()
+	if err := f(); err != nil {
+		logrus.WithError(err).Warn("failed to clean up after the VM stopped")
 	}
-	cancelHA()
-	return nil
 }
 
-func (a *HostAgent) infoEventHandler(ctx context.Context, stream *yamux.Stream, event interface{}) {
-	infoEvent := event.(types.InfoEvent)
-	hosts := a.y.HostResolver.Hosts
-	hosts["host.macvz.internal."] = infoEvent.GatewayIP
-	hosts[fmt.Sprintf("macvz-%s.", a.instName)] = infoEvent.GatewayIP
-	a.dnsHandler.UpdateDefaults(hosts)
+// close runs the functions registered by addOnClose, from the last one
+func (a *HostAgent) close() error {
+	a.onCloseMu.Lock()
+	a.closed = true
+	onClose := a.onClose
+	a.onClose = nil
+	a.onCloseMu.Unlock()
+	var mErr error
+	for i := len(onClose) - 1; i >= 0; i-- {
+		if err := onClose[i](); err != nil {
+			mErr = multierror.Append(mErr, err)
+		}
+	}
+	return mErr
 }
 
-func (a *HostAgent) portEventHandler(ctx context.Context, stream *yamux.Stream, event interface{}) {
-	portEvent := event.(types.PortEvent)
+func (a *HostAgent) infoEventHandler(ctx context.Context, req *socket.Request) (interface{}, error) {
+	var infoEvent types.InfoEvent
+	if err := req.Decode(&infoEvent); err != nil {
+		return nil, err
+	}
+	a.guestAgentConnected(ctx)
+	// An older guest agent does not report the address
+	if infoEvent.GuestIP != "" {
+		if err := a.guestIP.SetReported(infoEvent.GuestIP); err != nil {
+			logrus.WithError(err).Warn("failed to record the IP address reported by the guest agent")
+		}
+	}
+	a.stateMu.Lock()
+	a.gatewayIP = infoEvent.GatewayIP
+	a.stateMu.Unlock()
+	a.setGuestInfo(infoEvent.GuestInfo)
+	a.updateDNSHosts()
+
+	// The guest agent sends the info once connected, possibly after a reconnection
+	a.portForwarder.Reconcile(ctx, infoEvent.LocalPorts)
+	return nil, nil
+}
+
+func (a *HostAgent) portEventHandler(ctx context.Context, req *socket.Request) (interface{}, error) {
+	var portEvent types.PortEvent
+	if err := req.Decode(&portEvent); err != nil {
+		return nil, err
+	}
 	logrus.Debugf("guest agent event: %+v", portEvent)
 	for _, f := range portEvent.Errors {
 		logrus.Warnf("received error from the guest: %q", f)
 	}
-	sshRemoteUser := sshutil.SSHRemoteUser(*a.y.MACAddress)
-	a.portForwarder.OnEvent(ctx, sshRemoteUser, portEvent)
+	a.portForwarder.OnEvent(ctx, portEvent)
+	return nil, nil
 }
 
-func (a *HostAgent) dnsEventHandler(ctx context.Context, stream *yamux.Stream, event interface{}) {
-	dnsEvent := event.(types.DNSEvent)
-	if a.dnsHandler != nil {
-		res := a.dnsHandler.HandleDNSRequest(dnsEvent.Msg)
-		pack, _ := res.Pack()
-		encoder, _ := socket.GetStreamIO(stream)
-		resEvent := types.DNSEventResponse{
-			Msg: pack,
-		}
-		resEvent.Kind = types.DNSResponseMessage
-		_ = encoder.Encode(&resEvent)
+func (a *HostAgent) dnsEventHandler(ctx context.Context, req *socket.Request) (interface{}, error) {
+	if a.dnsHandler == nil {
+		return nil, errors.New("the host resolver is disabled")
+	}
+	var dnsEvent types.DNSEvent
+	if err := req.Decode(&dnsEvent); err != nil {
+		return nil, err
+	}
+	res := a.dnsHandler.HandleDNSRequest(dnsEvent.Msg)
+	pack, err := res.Pack()
+	if err != nil {
+		return nil, fmt.Errorf("failed to pack the DNS response: %w", err)
+	}
+	resEvent := types.DNSEventResponse{
+		Msg: pack,
 	}
+	resEvent.Kind = types.DNSResponseMessage
+	return &resEvent, nil
 }
 
-func (a *HostAgent) setSSHRemote(remote string) {
-	a.sshRemote = remote
+// connectTimeout is the timeout for the guest agent to acknowledge a ConnectEvent
+const connectTimeout = 15 * time.Second
+
+// dialGuest connects to a guest-local address, through a new stream to the guest agent
+func (a *HostAgent) dialGuest(network, address string) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), connectTimeout)
+	defer cancel()
+	req := types.ConnectEvent{
+		Network: network,
+		Address: address,
+	}
+	req.Kind = types.ConnectMessage
+	var res types.ConnectEventResponse
+	conn, err := a.guestClient.Open(ctx, types.ConnectMessage, &req, &res)
+	if err != nil {
+		return nil, fmt.Errorf("guest agent failed to connect to %s %q: %w", network, address, err)
+	}
+	return socket.StreamConn{Conn: conn}, nil
 }
 
-func (a *HostAgent) startHostAgentRoutines(ctx context.Context) error {
-	a.onClose = append(a.onClose, func() error {
-		logrus.Debugf("shutting down the SSH master")
-		if exitMasterErr := ssh.ExitMaster(a.sshRemote, 22, a.sshConfig); exitMasterErr != nil {
-			logrus.WithError(exitMasterErr).Warn("failed to exit SSH master")
+// newSSHClient creates the SSH client of the instance in instDir, see yaml.SSH.Client.
+// resolve returns the IP address of the guest, which is assigned by DHCP once it has booted.
+func newSSHClient(instDir string, y *yaml.MacVZYaml, client yaml.SSHClient, resolve func() (string, error)) (sshclient.Client, error) {
+	addr := func() (string, error) {
+		ip, err := resolve()
+		if err != nil {
+			return "", err
 		}
-		return nil
-	})
+		return net.JoinHostPort(ip, strconv.Itoa(*y.SSH.Port)), nil
+	}
+	if client == yaml.SSHClientNative {
+		config, err := sshclient.NativeConfig(instDir, *y.User.Name, *y.SSH.LoadDotSSHPubKeys)
+		if err != nil {
+			return nil, err
+		}
+		return sshclient.NewNativeClient(config, addr), nil
+	}
+	sshOpts, err := sshutil.SSHOpts(instDir, *y.User.Name, *y.SSH.Port, *y.SSH.LoadDotSSHPubKeys, *y.SSH.ForwardAgent)
+	if err != nil {
+		return nil, err
+	}
+	return sshclient.NewExecClient(sshutil.SSHArgsFromOpts(sshOpts), addr), nil
+}
 
+func (a *HostAgent) startHostAgentRoutines(ctx context.Context) error {
 	var mErr error
 	if err := a.waitForRequirements(ctx, "host", a.hostRequirements()); err != nil {
 		mErr = multierror.Append(mErr, err)
 	}
-	sshRemoteUser := sshutil.SSHRemoteUser(*a.y.MACAddress)
-	a.setSSHRemote(sshRemoteUser)
-
 	if err := a.waitForRequirements(ctx, "essential", a.essentialRequirements()); err != nil {
 		mErr = multierror.Append(mErr, err)
 	}
@@ -223,18 +377,20 @@ func (a *HostAgent) ForwardDefinedSockets(ctx context.Context) {
 	for _, rule := range a.y.PortForwards {
 		if rule.GuestSocket != "" {
 			local := hostAddress(rule, types.IPPort{})
-			_ = forwardSSH(ctx, a.sshConfig, a.sshRemote, local, rule.GuestSocket, verbForward)
+			if err := a.portForwarder.forward(ctx, rule.Forwarder, rule.Proto, local, rule.GuestSocket, verbForward); err != nil {
+				logrus.WithError(err).Warnf("failed to set up forwarding from %q (guest) to %q (host)", rule.GuestSocket, local)
+			}
 		}
 	}
 
-	a.onClose = append(a.onClose, func() error {
+	a.addOnClose(func() error {
 		logrus.Debugf("Stop forwarding unix sockets")
 		var mErr error
 		for _, rule := range a.y.PortForwards {
 			if rule.GuestSocket != "" {
 				local := hostAddress(rule, types.IPPort{})
 				// using ctx.Background() because ctx has already been cancelled
-				if err := forwardSSH(context.Background(), a.sshConfig, a.sshRemote, local, rule.GuestSocket, verbCancel); err != nil {
+				if err := a.portForwarder.forward(context.Background(), rule.Forwarder, rule.Proto, local, rule.GuestSocket, verbCancel); err != nil {
 					mErr = multierror.Append(mErr, err)
 				}
 			}
@@ -243,7 +399,7 @@ func (a *HostAgent) ForwardDefinedSockets(ctx context.Context) {
 	})
 
 	for {
-		//		_, _, err := ssh.ExecuteScript(a.sshRemote, 22, a.sshConfig, `#!/bin/bash
+		//		_, _, err := a.sshClient.ExecuteScript(ctx, `#!/bin/bash
 		//true`, "Ping to keep SSH Master alive")
 		//		if err != nil {
 		//			logrus.Error("SSH Ping to guest failed", err)
@@ -256,12 +412,126 @@ func (a *HostAgent) ForwardDefinedSockets(ctx context.Context) {
 	}
 }
 
+// Info returns the information served on GET /v1/info
+func (a *HostAgent) Info() *api.Info {
+	a.stateMu.RLock()
+	defer a.stateMu.RUnlock()
+	info := &api.Info{
+		Name:      a.instName,
+		Dir:       a.instDir,
+		Version:   version.Version,
+		VZPid:     os.Getpid(),
+		GatewayIP: a.gatewayIP,
+		Guest:     a.guestInfo,
+		Status:    a.status,
+	}
+	if a.guestAgent != nil {
+		info.GuestAgentVersion = a.guestAgent.Version
+	}
+	if ip, err := a.guestIP.Resolve(); err == nil {
+		info.GuestIP = ip
+	}
+	return info
+}
+
+// PortForwards returns the active forwards, served on GET /v1/port-forwards
+func (a *HostAgent) PortForwards() []api.PortForward {
+	return a.portForwarder.PortForwards()
+}
+
+// DNSHosts returns the static host table of the DNS handler, served on GET /v1/dns/hosts
+func (a *HostAgent) DNSHosts() map[string]string {
+	if a.dnsHandler == nil {
+		return map[string]string{}
+	}
+	return a.dnsHandler.Hosts()
+}
+
+// DNSCacheStats returns the statistics of the cache of the DNS handler, served on GET /v1/dns/cache
+func (a *HostAgent) DNSCacheStats() api.DNSCacheStats {
+	if a.dnsHandler == nil {
+		return api.DNSCacheStats{}
+	}
+	return a.dnsHandler.CacheStats()
+}
+
+// DNSQueryLog returns the latest queries of the DNS handler, served on GET /v1/dns/log
+func (a *HostAgent) DNSQueryLog() api.DNSQueryLog {
+	log := api.DNSQueryLog{Queries: []api.DNSQuery{}}
+	if a.dnsHandler != nil {
+		if queries := a.dnsHandler.QueryLog(); queries != nil {
+			log.Enabled = true
+			log.Queries = queries
+		}
+	}
+	return log
+}
+
+// DNSQuery resolves a name with the DNS handler, served on POST /v1/dns/query
+func (a *HostAgent) DNSQuery(req api.DNSQueryRequest) (*api.DNSQueryResponse, error) {
+	if a.dnsHandler == nil {
+		return nil, errors.New("the host resolver is disabled")
+	}
+	return a.dnsHandler.Query(req.Name, req.Type)
+}
+
+// Requirements returns the status of the requirements checked so far, served on GET /v1/requirements
+func (a *HostAgent) Requirements() []api.Requirement {
+	a.stateMu.RLock()
+	defer a.stateMu.RUnlock()
+	return append([]api.Requirement{}, a.requirements...)
+}
+
+// Stop requests the VM to stop, the same way as SIGINT does
+func (a *HostAgent) Stop() {
+	select {
+	case a.sigintCh <- os.Interrupt:
+	default:
+		// a stop request is already pending
+	}
+}
+
+// CancelForwards cancels the unix socket forwards of the instance and exits its SSH control master.
+// It is used to clean up after a host agent that could not do so by itself, e.g. because it was killed.
+// It must be called before the control socket under the instance directory is removed.
+func CancelForwards(ctx context.Context, inst *store.Instance) error {
+	y, err := inst.LoadYAML()
+	if err != nil {
+		return err
+	}
+	// The forwards of the native client are gone along with the host agent process, but not their sockets
+	sshClient, err := newSSHClient(inst.Dir, y, yaml.SSHClientExec, func() (string, error) {
+		return guestip.Lookup(inst.Dir, *y.MACAddress)
+	})
+	if err != nil {
+		return err
+	}
+
+	var mErr error
+	for _, rule := range y.PortForwards {
+		// The forwards over the guest agent are gone along with the host agent process
+		if rule.GuestSocket != "" && rule.Forwarder == yaml.ForwarderSSH {
+			local := hostAddress(rule, types.IPPort{})
+			if err := forwardSSH(ctx, sshClient, local, rule.GuestSocket, verbCancel); err != nil {
+				mErr = multierror.Append(mErr, err)
+			}
+		}
+	}
+	if err := sshClient.Close(); err != nil {
+		mErr = multierror.Append(mErr, err)
+	}
+	return mErr
+}
+
 func (a *HostAgent) emitEvent(ctx context.Context, ev events.Event) {
 	a.eventEncMu.Lock()
 	defer a.eventEncMu.Unlock()
 	if ev.Time.IsZero() {
 		ev.Time = time.Now()
 	}
+	a.stateMu.Lock()
+	a.status = ev.Status
+	a.stateMu.Unlock()
 	if err := a.eventEnc.Encode(ev); err != nil {
 		logrus.Println("Emit")
 		logrus.WithField("event", ev).WithError(err).Error("failed to emit an event")
@@ -273,47 +543,14 @@ const (
 	verbCancel  = "cancel"
 )
 
-func forwardSSH(ctx context.Context, sshConfig *ssh.SSHConfig, userAndIp string, local, remote string, verb string) error {
-	args := sshConfig.Args()
-	args = append(args,
-		"-T",
-		"-O", verb,
-		"-L", local+":"+remote,
-		"-N",
-		"-f",
-		userAndIp,
-		"--",
-	)
-	if strings.HasPrefix(local, "/") {
-		switch verb {
-		case verbForward:
-			logrus.Infof("Forwarding %q (guest) to %q (host)", remote, local)
-			if err := os.RemoveAll(local); err != nil {
-				logrus.WithError(err).Warnf("Failed to clean up %q (host) before setting up forwarding", local)
-			}
-			if err := os.MkdirAll(filepath.Dir(local), 0750); err != nil {
-				return fmt.Errorf("can't create directory for local socket %q: %w", local, err)
-			}
-		case verbCancel:
-			logrus.Infof("Stopping forwarding %q (guest) to %q (host)", remote, local)
-			defer func() {
-				if err := os.RemoveAll(local); err != nil {
-					logrus.WithError(err).Warnf("Failed to clean up %q (host) after stopping forwarding", local)
-				}
-			}()
-		default:
-			panic(fmt.Errorf("invalid verb %q", verb))
-		}
-	}
-	cmd := exec.CommandContext(ctx, sshConfig.Binary(), args...)
-	if out, err := cmd.Output(); err != nil {
-		if verb == verbForward && strings.HasPrefix(local, "/") {
-			logrus.WithError(err).Warnf("Failed to set up forward from %q (guest) to %q (host)", remote, local)
-			if removeErr := os.RemoveAll(local); err != nil {
-				logrus.WithError(removeErr).Warnf("Failed to clean up %q (host) after forwarding failed", local)
-			}
-		}
-		return fmt.Errorf("failed to run %v: %q: %w", cmd.Args, string(out), err)
+// forwardSSH sets up or cancels the forwarding from local (host) to remote (guest) over SSH
+func forwardSSH(ctx context.Context, sshClient sshclient.Client, local, remote string, verb string) error {
+	switch verb {
+	case verbForward:
+		return sshClient.Forward(ctx, local, remote)
+	case verbCancel:
+		return sshClient.CancelForward(ctx, local, remote)
+	default:
+		panic(fmt.Errorf("invalid verb %q", verb))
 	}
-	return nil
 }
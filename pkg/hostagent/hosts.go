@@ -0,0 +1,179 @@
+package hostagent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/mac-vz/macvz/pkg/hostagent/dns"
+	"github.com/mac-vz/macvz/pkg/store"
+	"github.com/mac-vz/macvz/pkg/store/dirnames"
+	"github.com/mac-vz/macvz/pkg/store/filenames"
+	"github.com/mac-vz/macvz/pkg/yaml"
+	"github.com/mitchellh/go-homedir"
+	"github.com/sirupsen/logrus"
+)
+
+// hostsPollInterval is the interval of the checks of the files of the DNS hosts
+const hostsPollInterval = 2 * time.Second
+
+// ErrDNSHostNotFound is returned by RemoveDNSHost for a name that was not added by AddDNSHost
+var ErrDNSHostNotFound = errors.New("not added through the host agent")
+
+// loadDNSHosts loads the static records of hostResolver from macvz.yaml, default.yaml and override.yaml,
+// along with its hosts file
+func (a *HostAgent) loadDNSHosts() error {
+	y, err := store.LoadYAMLByFilePath(filepath.Join(a.instDir, filenames.MacVZYAML))
+	if err != nil {
+		return err
+	}
+	fileHosts := map[string]string{}
+	if y.HostResolver.HostsFile != "" {
+		// validated by yaml.Validate
+		path, err := homedir.Expand(y.HostResolver.HostsFile)
+		if err != nil {
+			return err
+		}
+		f, err := os.Open(path)
+		if err == nil {
+			fileHosts, err = dns.ParseHostsFile(f)
+			f.Close()
+			if err != nil {
+				return fmt.Errorf("failed to parse %q: %w", path, err)
+			}
+		} else if !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	a.hostsMu.Lock()
+	a.hostResolver = y.HostResolver
+	a.fileHosts = fileHosts
+	a.hostsMu.Unlock()
+	a.updateDNSHosts()
+	return nil
+}
+
+// updateDNSHosts replaces the static records of the DNS handler. The hosts file is overridden by hostResolver.hosts,
+// which is overridden by the names of the host, which are overridden by the hosts added through the API.
+func (a *HostAgent) updateDNSHosts() {
+	if a.dnsHandler == nil {
+		return
+	}
+	a.stateMu.RLock()
+	gatewayIP := a.gatewayIP
+	a.stateMu.RUnlock()
+	a.hostsMu.Lock()
+	defer a.hostsMu.Unlock()
+	hosts := make(map[string]string)
+	for host, address := range a.fileHosts {
+		hosts[host] = address
+	}
+	for host, address := range a.hostResolver.Hosts {
+		hosts[host] = address
+	}
+	// the gateway is unknown until the guest agent reports it
+	if gatewayIP != "" {
+		hosts["host.macvz.internal."] = gatewayIP
+		hosts[fmt.Sprintf("macvz-%s.", a.instName)] = gatewayIP
+	}
+	for host, address := range a.addedHosts {
+		hosts[host] = address
+	}
+	a.dnsHandler.SetStatic(dns.Static{
+		Hosts: hosts,
+		SRV:   a.hostResolver.SRV,
+		TXT:   a.hostResolver.TXT,
+	})
+}
+
+// watchDNSHosts reloads the static records of the DNS handler as their files change, until ctx is done.
+// The files are polled, as the editors often replace them rather than write them in place.
+func (a *HostAgent) watchDNSHosts(ctx context.Context) {
+	last := a.statDNSHostsFiles()
+	ticker := time.NewTicker(hostsPollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		current := a.statDNSHostsFiles()
+		if current == last {
+			continue
+		}
+		last = current
+		if err := a.loadDNSHosts(); err != nil {
+			logrus.WithError(err).Warn("failed to reload the DNS hosts, keeping the previous ones")
+			continue
+		}
+		logrus.Info("Reloaded the DNS hosts")
+	}
+}
+
+// statDNSHostsFiles returns the modification times and sizes of the files of the DNS hosts, which may not exist
+func (a *HostAgent) statDNSHostsFiles() string {
+	paths := []string{filepath.Join(a.instDir, filenames.MacVZYAML)}
+	if configDir, err := dirnames.MacVZConfigDir(); err == nil {
+		paths = append(paths, filepath.Join(configDir, filenames.Default), filepath.Join(configDir, filenames.Override))
+	}
+	a.hostsMu.Lock()
+	hostsFile := a.hostResolver.HostsFile
+	a.hostsMu.Unlock()
+	if path, err := homedir.Expand(hostsFile); err == nil && path != "" {
+		paths = append(paths, path)
+	}
+	var s string
+	for _, path := range paths {
+		if st, err := os.Stat(path); err == nil {
+			s += fmt.Sprintf("%s %d %d\n", path, st.ModTime().UnixNano(), st.Size())
+		} else {
+			s += path + " -\n"
+		}
+	}
+	return s
+}
+
+// AddDNSHost adds or replaces the static host name, which maps to an IP or a CNAME, served on PUT /v1/dns/hosts/NAME.
+// The host is kept until the host agent exits, and overrides the ones of the files.
+func (a *HostAgent) AddDNSHost(name, address string) error {
+	if a.dnsHandler == nil {
+		return errors.New("the host resolver is disabled")
+	}
+	if name == "" || address == "" {
+		return errors.New("the name and the address must be set")
+	}
+	if err := yaml.ValidateHostName(name); err != nil {
+		return fmt.Errorf("host %w", err)
+	}
+	// a CNAME must not be a wildcard
+	if net.ParseIP(address) == nil && (strings.Contains(address, "*") || yaml.ValidateHostName(address) != nil) {
+		return fmt.Errorf("host %q has an invalid address %q, which must be an IP or a host name", name, address)
+	}
+	a.hostsMu.Lock()
+	if a.addedHosts == nil {
+		a.addedHosts = make(map[string]string)
+	}
+	a.addedHosts[yaml.Cname(name)] = address
+	a.hostsMu.Unlock()
+	a.updateDNSHosts()
+	return nil
+}
+
+// RemoveDNSHost removes the static host name added by AddDNSHost, served on DELETE /v1/dns/hosts/NAME
+func (a *HostAgent) RemoveDNSHost(name string) error {
+	a.hostsMu.Lock()
+	_, ok := a.addedHosts[yaml.Cname(name)]
+	delete(a.addedHosts, yaml.Cname(name))
+	a.hostsMu.Unlock()
+	if !ok {
+		return fmt.Errorf("host %q: %w", name, ErrDNSHostNotFound)
+	}
+	a.updateDNSHosts()
+	return nil
+}
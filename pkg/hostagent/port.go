@@ -2,25 +2,96 @@ package hostagent
 
 import (
 	"context"
+	"fmt"
 	"github.com/mac-vz/macvz/pkg/types"
 	"github.com/mac-vz/macvz/pkg/yaml"
 	"net"
+	"sort"
+	"strings"
+	"sync"
 
-	"github.com/lima-vm/sshocker/pkg/ssh"
 	"github.com/mac-vz/macvz/pkg/guestagent/api"
+	hostagentapi "github.com/mac-vz/macvz/pkg/hostagent/api"
+	"github.com/mac-vz/macvz/pkg/sshclient"
 	"github.com/sirupsen/logrus"
 )
 
 type portForwarder struct {
-	sshConfig *ssh.SSHConfig
+	sshClient sshclient.Client
 	rules     []yaml.PortForward
+	dialGuest guestDialer
+	// guestSupports reports the capabilities of the guest agent, to fall back to SSH for older guest agents
+	guestSupports func(types.Capability) bool
+
+	agentForwarders   map[string]agentListener
+	agentForwardersMu sync.Mutex
+
+	// forwards holds the active forwards, keyed by forwardKey
+	forwardsMu sync.Mutex
+	forwards   map[string]hostagentapi.PortForward
+
+	// guestPorts holds the guest ports forwarded by OnEvent, keyed by guestPortKey.
+	// eventMu serializes OnEvent and Reconcile, which update it.
+	eventMu    sync.Mutex
+	guestPorts map[string]types.IPPort
 }
 
-func newPortForwarder(sshConfig *ssh.SSHConfig, rules []yaml.PortForward) *portForwarder {
+func newPortForwarder(sshClient sshclient.Client, rules []yaml.PortForward, dialGuest guestDialer, guestSupports func(types.Capability) bool) *portForwarder {
 	return &portForwarder{
-		sshConfig: sshConfig,
-		rules:     rules,
+		sshClient:       sshClient,
+		rules:           rules,
+		dialGuest:       dialGuest,
+		guestSupports:   guestSupports,
+		agentForwarders: make(map[string]agentListener),
+		forwards:        make(map[string]hostagentapi.PortForward),
+		guestPorts:      make(map[string]types.IPPort),
+	}
+}
+
+func guestPortKey(guest types.IPPort) string {
+	return guest.Proto() + ":" + guest.String()
+}
+
+// forwardKey identifies a forward, as the same host port may be forwarded for both TCP and UDP
+func forwardKey(proto yaml.Proto, local string) string {
+	return proto + ":" + local
+}
+
+func (pf *portForwarder) register(proto yaml.Proto, local, remote string, forwarder yaml.Forwarder) {
+	pf.forwardsMu.Lock()
+	defer pf.forwardsMu.Unlock()
+	pf.forwards[forwardKey(proto, local)] = hostagentapi.PortForward{Protocol: proto, Guest: remote, Host: local, Forwarder: forwarder}
+}
+
+// registeredForwarder returns the forwarder of an active forward
+func (pf *portForwarder) registeredForwarder(proto yaml.Proto, local string) (yaml.Forwarder, bool) {
+	pf.forwardsMu.Lock()
+	defer pf.forwardsMu.Unlock()
+	f, ok := pf.forwards[forwardKey(proto, local)]
+	return f.Forwarder, ok
+}
+
+func (pf *portForwarder) unregister(proto yaml.Proto, local string) {
+	pf.forwardsMu.Lock()
+	defer pf.forwardsMu.Unlock()
+	delete(pf.forwards, forwardKey(proto, local))
+}
+
+// PortForwards returns the active forwards, sorted by the host address
+func (pf *portForwarder) PortForwards() []hostagentapi.PortForward {
+	pf.forwardsMu.Lock()
+	defer pf.forwardsMu.Unlock()
+	res := make([]hostagentapi.PortForward, 0, len(pf.forwards))
+	for _, f := range pf.forwards {
+		res = append(res, f)
 	}
+	sort.Slice(res, func(i, j int) bool {
+		if res[i].Host != res[j].Host {
+			return res[i].Host < res[j].Host
+		}
+		return res[i].Protocol < res[j].Protocol
+	})
+	return res
 }
 
 func hostAddress(rule yaml.PortForward, guest types.IPPort) string {
@@ -37,11 +108,15 @@ func hostAddress(rule yaml.PortForward, guest types.IPPort) string {
 	return host.String()
 }
 
-func (pf *portForwarder) forwardingAddresses(guest types.IPPort) (string, string) {
+// forwardingAddresses returns the host address, the guest address and the forwarder of the first rule matching guest
+func (pf *portForwarder) forwardingAddresses(guest types.IPPort) (string, string, yaml.Forwarder) {
 	for _, rule := range pf.rules {
 		if rule.GuestSocket != "" {
 			continue
 		}
+		if rule.Proto != guest.Proto() {
+			continue
+		}
 		if guest.Port < rule.GuestPortRange[0] || guest.Port > rule.GuestPortRange[1] {
 			continue
 		}
@@ -61,31 +136,108 @@ func (pf *portForwarder) forwardingAddresses(guest types.IPPort) (string, string
 			}
 			break
 		}
-		return hostAddress(rule, guest), guest.String()
+		return hostAddress(rule, guest), guest.String(), rule.Forwarder
 	}
-	return "", guest.String()
+	return "", guest.String(), ""
 }
 
-func (pf *portForwarder) OnEvent(ctx context.Context, sshRemote string, ev types.PortEvent) {
+// usableForwarder returns forwarder, or yaml.ForwarderSSH when the guest agent cannot forward proto
+func (pf *portForwarder) usableForwarder(forwarder yaml.Forwarder, proto yaml.Proto) yaml.Forwarder {
+	if forwarder == yaml.ForwarderSSH {
+		return forwarder
+	}
+	capability := types.CapabilityConnect
+	if proto == yaml.UDP {
+		capability = types.CapabilityConnectUDP
+	}
+	if pf.guestSupports(capability) {
+		return forwarder
+	}
+	logrus.Debugf("the guest agent lacks the capability %q, forwarding %s over SSH", capability, proto)
+	return yaml.ForwarderSSH
+}
+
+// forward sets up or cancels the forwarding from local (host) to remote (guest),
+// either over the session with the guest agent or over SSH
+func (pf *portForwarder) forward(ctx context.Context, forwarder yaml.Forwarder, proto yaml.Proto, local, remote, verb string) error {
+	if verb == verbForward {
+		forwarder = pf.usableForwarder(forwarder, proto)
+	} else if registered, ok := pf.registeredForwarder(proto, local); ok {
+		// the capabilities of the guest agent may have changed since the forward was set up
+		forwarder = registered
+	}
+	var err error
+	switch {
+	case forwarder != yaml.ForwarderSSH:
+		err = pf.forwardAgent(proto, local, remote, verb)
+	case proto == yaml.TCP:
+		err = forwardTCP(ctx, pf.sshClient, local, remote, verb)
+	default:
+		err = fmt.Errorf("cannot forward %s over SSH", proto)
+	}
+	switch {
+	case verb == verbCancel:
+		pf.unregister(proto, local)
+	case err == nil:
+		pf.register(proto, local, remote, forwarder)
+	}
+	return err
+}
+
+func (pf *portForwarder) OnEvent(ctx context.Context, ev types.PortEvent) {
+	pf.eventMu.Lock()
+	defer pf.eventMu.Unlock()
+	pf.onEvent(ctx, ev)
+}
+
+// Reconcile updates the forwards to match the snapshot of the guest ports sent by a guest agent once connected.
+// The forwards of the ports that are gone are cancelled, and the forwards that are missing are set up,
+// including the ones that failed before.
+func (pf *portForwarder) Reconcile(ctx context.Context, ports []types.IPPort) {
+	pf.eventMu.Lock()
+	defer pf.eventMu.Unlock()
+	snapshot := make(map[string]types.IPPort, len(ports))
+	for _, f := range ports {
+		snapshot[guestPortKey(f)] = f
+	}
+	var ev types.PortEvent
+	for k, f := range pf.guestPorts {
+		if _, ok := snapshot[k]; !ok {
+			ev.LocalPortsRemoved = append(ev.LocalPortsRemoved, f)
+		}
+	}
+	for k, f := range snapshot {
+		if _, ok := pf.guestPorts[k]; !ok {
+			ev.LocalPortsAdded = append(ev.LocalPortsAdded, f)
+		}
+	}
+	logrus.Debugf("reconciling the forwards: %d to cancel, %d to set up", len(ev.LocalPortsRemoved), len(ev.LocalPortsAdded))
+	pf.onEvent(ctx, ev)
+}
+
+func (pf *portForwarder) onEvent(ctx context.Context, ev types.PortEvent) {
 	for _, f := range ev.LocalPortsRemoved {
-		local, remote := pf.forwardingAddresses(f)
+		delete(pf.guestPorts, guestPortKey(f))
+		local, remote, forwarder := pf.forwardingAddresses(f)
 		if local == "" {
 			continue
 		}
-		logrus.Infof("Stopping forwarding TCP from %s to %s", remote, local)
-		if err := forwardTCP(ctx, pf.sshConfig, sshRemote, local, remote, verbCancel); err != nil {
-			logrus.WithError(err).Warnf("failed to stop forwarding tcp port %d", f.Port)
+		logrus.Infof("Stopping forwarding %s from %s to %s", strings.ToUpper(f.Proto()), remote, local)
+		if err := pf.forward(ctx, forwarder, f.Proto(), local, remote, verbCancel); err != nil {
+			logrus.WithError(err).Warnf("failed to stop forwarding %s port %d", f.Proto(), f.Port)
 		}
 	}
 	for _, f := range ev.LocalPortsAdded {
-		local, remote := pf.forwardingAddresses(f)
+		local, remote, forwarder := pf.forwardingAddresses(f)
 		if local == "" {
-			logrus.Infof("Not forwarding TCP %s", remote)
+			logrus.Infof("Not forwarding %s %s", strings.ToUpper(f.Proto()), remote)
 			continue
 		}
-		logrus.Infof("Forwarding TCP from %s to %s", remote, local)
-		if err := forwardTCP(ctx, pf.sshConfig, sshRemote, local, remote, verbForward); err != nil {
-			logrus.WithError(err).Warnf("failed to set up forwarding tcp port %d (negligible if already forwarded)", f.Port)
+		logrus.Infof("Forwarding %s from %s to %s", strings.ToUpper(f.Proto()), remote, local)
+		if err := pf.forward(ctx, forwarder, f.Proto(), local, remote, verbForward); err != nil {
+			logrus.WithError(err).Warnf("failed to set up forwarding %s port %d (negligible if already forwarded)", f.Proto(), f.Port)
+			continue
 		}
+		pf.guestPorts[guestPortKey(f)] = f
 	}
 }
@@ -9,16 +9,16 @@ import (
 	"strconv"
 	"strings"
 
-	"github.com/lima-vm/sshocker/pkg/ssh"
 	"github.com/mac-vz/macvz/pkg/guestagent/api"
+	"github.com/mac-vz/macvz/pkg/sshclient"
 	"github.com/norouter/norouter/pkg/agent/bicopy"
 	"github.com/sirupsen/logrus"
 )
 
 // forwardTCP is not thread-safe
-func forwardTCP(ctx context.Context, sshConfig *ssh.SSHConfig, sshRemote string, local, remote string, verb string) error {
+func forwardTCP(ctx context.Context, sshClient sshclient.Client, local, remote string, verb string) error {
 	if strings.HasPrefix(local, "/") {
-		return forwardSSH(ctx, sshConfig, sshRemote, local, remote, verb)
+		return forwardSSH(ctx, sshClient, local, remote, verb)
 	}
 	localIPStr, localPortStr, err := net.SplitHostPort(local)
 	if err != nil {
@@ -31,14 +31,14 @@ func forwardTCP(ctx context.Context, sshConfig *ssh.SSHConfig, sshRemote string,
 	}
 
 	if !localIP.Equal(api.IPv4loopback1) || localPort >= 1024 {
-		return forwardSSH(ctx, sshConfig, sshRemote, local, remote, verb)
+		return forwardSSH(ctx, sshClient, local, remote, verb)
 	}
 
 	// on macOS, listening on 127.0.0.1:80 requires root while 0.0.0.0:80 does not require root.
 	// https://twitter.com/_AkihiroSuda_/status/1403403845842075648
 	//
 	// We use "pseudoloopback" forwarder that listens on 0.0.0.0:80 but rejects connections from non-loopback src IP.
-	logrus.Debugf("using pseudoloopback sshRemote forwarder for %q", local)
+	logrus.Debugf("using pseudoloopback SSH forwarder for %q", local)
 
 	if verb == verbCancel {
 		plf, ok := pseudoLoopbackForwarders[local]
@@ -46,7 +46,7 @@ func forwardTCP(ctx context.Context, sshConfig *ssh.SSHConfig, sshRemote string,
 			localUnix := plf.unixAddr.Name
 			_ = plf.Close()
 			delete(pseudoLoopbackForwarders, local)
-			if err := forwardSSH(ctx, sshConfig, sshRemote, localUnix, remote, verb); err != nil {
+			if err := forwardSSH(ctx, sshClient, localUnix, remote, verb); err != nil {
 				return err
 			}
 		} else {
@@ -61,12 +61,12 @@ func forwardTCP(ctx context.Context, sshConfig *ssh.SSHConfig, sshRemote string,
 	}
 	localUnix := filepath.Join(localUnixDir, "sock")
 	logrus.Debugf("forwarding %q to %q", localUnix, remote)
-	if err := forwardSSH(ctx, sshConfig, sshRemote, localUnix, remote, verb); err != nil {
+	if err := forwardSSH(ctx, sshClient, localUnix, remote, verb); err != nil {
 		return err
 	}
 	plf, err := newPseudoLoopbackForwarder(localPort, localUnix)
 	if err != nil {
-		if cancelErr := forwardSSH(ctx, sshConfig, sshRemote, localUnix, remote, verbCancel); cancelErr != nil {
+		if cancelErr := forwardSSH(ctx, sshClient, localUnix, remote, verbCancel); cancelErr != nil {
 			logrus.WithError(cancelErr).Warnf("failed to cancel forwarding %q to %q", localUnix, remote)
 		}
 		return err
@@ -86,7 +86,7 @@ func forwardTCP(ctx context.Context, sshConfig *ssh.SSHConfig, sshRemote string,
 var pseudoLoopbackForwarders = make(map[string]*pseudoLoopbackForwarder)
 
 type pseudoLoopbackForwarder struct {
-	ln       *net.TCPListener
+	ln       *pseudoLoopbackListener
 	unixAddr *net.UnixAddr
 	onClose  func() error
 }
@@ -97,11 +97,7 @@ func newPseudoLoopbackForwarder(localPort int, unixSock string) (*pseudoLoopback
 		return nil, err
 	}
 
-	lnAddr, err := net.ResolveTCPAddr("tcp4", fmt.Sprintf("0.0.0.0:%d", localPort))
-	if err != nil {
-		return nil, err
-	}
-	ln, err := net.ListenTCP("tcp4", lnAddr)
+	ln, err := newPseudoLoopbackListener(localPort)
 	if err != nil {
 		return nil, err
 	}
@@ -117,23 +113,11 @@ func newPseudoLoopbackForwarder(localPort int, unixSock string) (*pseudoLoopback
 func (plf *pseudoLoopbackForwarder) Serve() error {
 	defer plf.ln.Close()
 	for {
-		ac, err := plf.ln.AcceptTCP()
+		ac, err := plf.ln.Accept()
 		if err != nil {
 			return err
 		}
-		remoteAddr := ac.RemoteAddr().String() // ip:port
-		remoteAddrIP, _, err := net.SplitHostPort(remoteAddr)
-		if err != nil {
-			logrus.WithError(err).Debugf("pseudoloopback forwarder: rejecting non-loopback remoteAddr %q (unparsable)", remoteAddr)
-			ac.Close()
-			continue
-		}
-		if remoteAddrIP != "127.0.0.1" {
-			logrus.WithError(err).Debugf("pseudoloopback forwarder: rejecting non-loopback remoteAddr %q", remoteAddr)
-			ac.Close()
-			continue
-		}
-		go func(ac *net.TCPConn) {
+		go func(ac net.Conn) {
 			if fErr := plf.forward(ac); fErr != nil {
 				logrus.Error(fErr)
 			}
@@ -141,7 +125,7 @@ func (plf *pseudoLoopbackForwarder) Serve() error {
 	}
 }
 
-func (plf *pseudoLoopbackForwarder) forward(ac *net.TCPConn) error {
+func (plf *pseudoLoopbackForwarder) forward(ac net.Conn) error {
 	defer ac.Close()
 	unixConn, err := net.DialUnix("unix", nil, plf.unixAddr)
 	if err != nil {
@@ -156,3 +140,101 @@ func (plf *pseudoLoopbackForwarder) Close() error {
 	_ = plf.ln.Close()
 	return plf.onClose()
 }
+
+// listenTCP listens on local for the forwarding over the guest agent.
+// Like forwardTCP, it uses a pseudoloopback listener for the privileged ports of 127.0.0.1.
+func listenTCP(local string) (net.Listener, error) {
+	localIPStr, localPortStr, err := net.SplitHostPort(local)
+	if err != nil {
+		return nil, err
+	}
+	localIP := net.ParseIP(localIPStr)
+	localPort, err := strconv.Atoi(localPortStr)
+	if err != nil {
+		return nil, err
+	}
+	if !localIP.Equal(api.IPv4loopback1) || localPort >= 1024 {
+		return net.Listen("tcp", local)
+	}
+	logrus.Debugf("using pseudoloopback agent forwarder for %q", local)
+	return newPseudoLoopbackListener(localPort)
+}
+
+// pseudoLoopbackListener listens on 0.0.0.0 but rejects connections from non-loopback src IP
+type pseudoLoopbackListener struct {
+	*net.TCPListener
+}
+
+func newPseudoLoopbackListener(localPort int) (*pseudoLoopbackListener, error) {
+	lnAddr, err := net.ResolveTCPAddr("tcp4", fmt.Sprintf("0.0.0.0:%d", localPort))
+	if err != nil {
+		return nil, err
+	}
+	ln, err := net.ListenTCP("tcp4", lnAddr)
+	if err != nil {
+		return nil, err
+	}
+	return &pseudoLoopbackListener{TCPListener: ln}, nil
+}
+
+func (l *pseudoLoopbackListener) Accept() (net.Conn, error) {
+	for {
+		ac, err := l.AcceptTCP()
+		if err != nil {
+			return nil, err
+		}
+		remoteAddr := ac.RemoteAddr().String() // ip:port
+		remoteAddrIP, _, err := net.SplitHostPort(remoteAddr)
+		if err != nil {
+			logrus.WithError(err).Debugf("pseudoloopback forwarder: rejecting non-loopback remoteAddr %q (unparsable)", remoteAddr)
+			ac.Close()
+			continue
+		}
+		if remoteAddrIP != "127.0.0.1" {
+			logrus.WithError(err).Debugf("pseudoloopback forwarder: rejecting non-loopback remoteAddr %q", remoteAddr)
+			ac.Close()
+			continue
+		}
+		return ac, nil
+	}
+}
+
+// listenUDP is the counterpart of listenTCP for UDP
+func listenUDP(local string) (net.PacketConn, error) {
+	localIPStr, localPortStr, err := net.SplitHostPort(local)
+	if err != nil {
+		return nil, err
+	}
+	localIP := net.ParseIP(localIPStr)
+	localPort, err := strconv.Atoi(localPortStr)
+	if err != nil {
+		return nil, err
+	}
+	if !localIP.Equal(api.IPv4loopback1) || localPort >= 1024 {
+		return net.ListenPacket("udp", local)
+	}
+	logrus.Debugf("using pseudoloopback agent forwarder for UDP %q", local)
+	pc, err := net.ListenPacket("udp4", fmt.Sprintf("0.0.0.0:%d", localPort))
+	if err != nil {
+		return nil, err
+	}
+	return &pseudoLoopbackPacketConn{PacketConn: pc}, nil
+}
+
+// pseudoLoopbackPacketConn listens on 0.0.0.0 but drops datagrams from non-loopback src IP
+type pseudoLoopbackPacketConn struct {
+	net.PacketConn
+}
+
+func (c *pseudoLoopbackPacketConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	for {
+		n, addr, err := c.PacketConn.ReadFrom(p)
+		if err != nil {
+			return n, addr, err
+		}
+		if udpAddr, ok := addr.(*net.UDPAddr); ok && udpAddr.IP.IsLoopback() {
+			return n, addr, nil
+		}
+		logrus.Debugf("pseudoloopback forwarder: dropping datagram from non-loopback remoteAddr %q", addr)
+	}
+}
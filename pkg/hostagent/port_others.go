@@ -5,10 +5,19 @@ package hostagent
 
 import (
 	"context"
+	"net"
 
-	"github.com/lima-vm/sshocker/pkg/ssh"
+	"github.com/mac-vz/macvz/pkg/sshclient"
 )
 
-func forwardTCP(ctx context.Context, sshConfig *ssh.SSHConfig, userAndIp string, local, remote string, verb string) error {
-	return forwardSSH(ctx, sshConfig, userAndIp, local, remote, verb)
+func forwardTCP(ctx context.Context, sshClient sshclient.Client, local, remote string, verb string) error {
+	return forwardSSH(ctx, sshClient, local, remote, verb)
+}
+
+func listenTCP(local string) (net.Listener, error) {
+	return net.Listen("tcp", local)
+}
+
+func listenUDP(local string) (net.PacketConn, error) {
+	return net.ListenPacket("udp", local)
 }
@@ -1,13 +1,11 @@
 package hostagent
 
 import (
-	"bytes"
 	"context"
+	"errors"
 	"fmt"
-	"github.com/lima-vm/sshocker/pkg/ssh"
-	"github.com/mac-vz/macvz/pkg/osutil"
-	"os/exec"
-	"strings"
+	"github.com/mac-vz/macvz/pkg/hostagent/api"
+	"github.com/mac-vz/macvz/pkg/types"
 	"time"
 
 	"github.com/hashicorp/go-multierror"
@@ -22,6 +20,7 @@ func (a *HostAgent) waitForRequirements(ctx context.Context, label string, requi
 	)
 	var mErr error
 
+	offset := a.addRequirements(label, requirements)
 	for i, req := range requirements {
 	retryLoop:
 		for j := 0; j < retries; j++ {
@@ -29,13 +28,16 @@ func (a *HostAgent) waitForRequirements(ctx context.Context, label string, requi
 			err := a.waitForRequirement(ctx, req)
 			if err == nil {
 				logrus.Infof("The %s requirement %d of %d is satisfied", label, i+1, len(requirements))
+				a.setRequirementStatus(offset+i, api.RequirementSatisfied, nil)
 				break retryLoop
 			}
 			if req.fatal {
 				logrus.Infof("No further %s requirements will be checked", label)
+				a.setRequirementStatus(offset+i, api.RequirementFailed, err)
 				return multierror.Append(mErr, fmt.Errorf("failed to satisfy the %s requirement %d of %d %q: %s; skipping further checks: %w", label, i+1, len(requirements), req.description, req.debugHint, err))
 			}
 			if j == retries-1 {
+				a.setRequirementStatus(offset+i, api.RequirementFailed, err)
 				mErr = multierror.Append(mErr, fmt.Errorf("failed to satisfy the %s requirement %d of %d %q: %s: %w", label, i+1, len(requirements), req.description, req.debugHint, err))
 				break retryLoop
 			}
@@ -45,24 +47,50 @@ func (a *HostAgent) waitForRequirements(ctx context.Context, label string, requi
 	return mErr
 }
 
+// addRequirements records requirements as pending for the host agent API, and returns the index of the first one
+func (a *HostAgent) addRequirements(label string, requirements []requirement) int {
+	a.stateMu.Lock()
+	defer a.stateMu.Unlock()
+	offset := len(a.requirements)
+	for _, req := range requirements {
+		a.requirements = append(a.requirements, api.Requirement{
+			Label:       label,
+			Description: req.description,
+			Status:      api.RequirementPending,
+		})
+	}
+	return offset
+}
+
+func (a *HostAgent) setRequirementStatus(i int, status api.RequirementStatus, err error) {
+	a.stateMu.Lock()
+	defer a.stateMu.Unlock()
+	a.requirements[i].Status = status
+	if err != nil {
+		a.requirements[i].Error = err.Error()
+	}
+}
+
 func (a *HostAgent) waitForRequirement(ctx context.Context, r requirement) error {
+	if r.fn != nil {
+		return r.fn(ctx)
+	}
 	logrus.Debugf("executing script %q", r.description)
-	if r.host {
-		bashCmd := exec.Command("bash")
-		bashCmd.Stdin = strings.NewReader(r.script)
-		var stderr bytes.Buffer
-		bashCmd.Stderr = &stderr
-		stdout, err := bashCmd.Output()
-		logrus.Debugf("stdout=%q, stderr=%q, err=%v", stdout, stderr, err)
-		if err != nil {
-			return fmt.Errorf("stdout=%q, stderr=%q: %w", stdout, stderr, err)
-		}
-	} else {
-		stdout, stderr, err := ssh.ExecuteScript(a.sshRemote, 22, a.sshConfig, r.script, r.description)
-		logrus.Debugf("stdout=%q, stderr=%q, err=%v", stdout, stderr, err)
-		if err != nil {
-			return fmt.Errorf("stdout=%q, stderr=%q: %w", stdout, stderr, err)
+	if !r.ssh && a.guestSupports(types.CapabilityExec) {
+		stdout, stderr, err := a.execScript(ctx, r.script)
+		if !errors.Is(err, errExecUnavailable) {
+			logrus.Debugf("stdout=%q, stderr=%q, err=%v", stdout, stderr, err)
+			if err != nil {
+				return fmt.Errorf("stdout=%q, stderr=%q: %w", stdout, stderr, err)
+			}
+			return nil
 		}
+		logrus.WithError(err).Debugf("executing script %q over SSH instead", r.description)
+	}
+	stdout, stderr, err := a.sshClient.ExecuteScript(ctx, r.script, r.description)
+	logrus.Debugf("stdout=%q, stderr=%q, err=%v", stdout, stderr, err)
+	if err != nil {
+		return fmt.Errorf("stdout=%q, stderr=%q: %w", stdout, stderr, err)
 	}
 	return nil
 }
@@ -72,7 +100,10 @@ type requirement struct {
 	script      string
 	debugHint   string
 	fatal       bool
-	host        bool
+	// fn is checked on the host, instead of executing the script in the guest
+	fn func(ctx context.Context) error
+	// ssh requires the script to be executed over SSH, instead of through the guest agent
+	ssh bool
 }
 
 func (a *HostAgent) hostRequirements() []requirement {
@@ -80,16 +111,16 @@ func (a *HostAgent) hostRequirements() []requirement {
 	req = append(req,
 		requirement{
 			description: "Host IP Bind",
-			script: fmt.Sprintf(`#!/bin/bash
-if [[ $( arp -a | grep -w -i '%s' | awk '{print $2}') ]]; then 
-  exit 0 
-else 
-  exit 1 
-fi
-`, osutil.TrimMACAddress(*a.y.MACAddress)),
+			fn: func(ctx context.Context) error {
+				ip, err := a.guestIP.Wait(ctx, time.Minute)
+				if err != nil {
+					return err
+				}
+				logrus.Infof("The IP address of the guest is %s", ip)
+				return nil
+			},
 			debugHint: `Failed to acquire host IP.
 `,
-			host: true,
 		})
 	return req
 }
@@ -105,6 +136,7 @@ true
 			debugHint: `Failed to SSH into the guest.
 If any private key under ~/.ssh is protected with a passphrase, you need to have ssh-agent to be running.
 `,
+			ssh: true,
 		})
 	req = append(req, requirement{
 		description: "user session is ready for ssh",
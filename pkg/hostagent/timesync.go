@@ -0,0 +1,86 @@
+package hostagent
+
+import (
+	"context"
+	"time"
+
+	"github.com/mac-vz/macvz/pkg/types"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// wakeCheckInterval is the interval for detecting that the host woke up from sleep
+	wakeCheckInterval = 5 * time.Second
+	// timeSyncTimeout is the timeout for the guest agent to reply to TimeEvent
+	timeSyncTimeout = 10 * time.Second
+)
+
+// syncGuestTime sends the host clock to the guest agent once connected, every timeSync.interval,
+// and after the host wakes up from sleep, which leaves the guest clock behind
+func (a *HostAgent) syncGuestTime(ctx context.Context) {
+	// validated by yaml.Validate
+	interval, _ := time.ParseDuration(*a.y.TimeSync.Interval)
+	threshold, _ := time.ParseDuration(*a.y.TimeSync.Threshold)
+
+	ticker := time.NewTicker(wakeCheckInterval)
+	defer ticker.Stop()
+	var lastSent time.Time
+	lastCheck := time.Now()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-a.timeSyncCh:
+		case now := <-ticker.C:
+			// The monotonic clock stops while the host sleeps, unlike the wall clock
+			slept := now.Round(0).Sub(lastCheck.Round(0)) - now.Sub(lastCheck)
+			lastCheck = now
+			if slept > time.Second {
+				logrus.Infof("the host woke up after sleeping for %v, synchronizing the guest clock", slept.Round(time.Second))
+			} else if now.Sub(lastSent) < interval {
+				continue
+			}
+		}
+		if a.sendTime(ctx, threshold) {
+			lastSent = time.Now()
+		}
+	}
+}
+
+// requestTimeSync makes syncGuestTime send the host clock, e.g. as the guest agent reconnected
+func (a *HostAgent) requestTimeSync() {
+	select {
+	case a.timeSyncCh <- struct{}{}:
+	default:
+		// a sync is already pending
+	}
+}
+
+// sendTime sends the host clock to the guest agent, and returns true if the guest agent handled it
+func (a *HostAgent) sendTime(ctx context.Context, threshold time.Duration) bool {
+	a.stateMu.RLock()
+	supported := a.guestAgent != nil && a.guestAgent.HasCapability(types.CapabilityTimeSync)
+	a.stateMu.RUnlock()
+	if !supported {
+		// the guest agent falls back to the RTC
+		return false
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeSyncTimeout)
+	defer cancel()
+	ev := types.TimeEvent{
+		Time:      time.Now().Format(time.RFC3339Nano),
+		Threshold: threshold,
+	}
+	ev.Kind = types.TimeMessage
+	var res types.TimeEventResponse
+	if err := a.guestClient.Call(ctx, types.TimeMessage, &ev, &res); err != nil {
+		logrus.WithError(err).Warn("failed to synchronize the guest clock")
+		return false
+	}
+	if res.Method == types.TimeMethodNone {
+		logrus.Debugf("the guest clock is off by %v, below the threshold", res.Skew)
+	} else {
+		logrus.Infof("the guest agent corrected the guest clock by %v (%s)", res.Skew, res.Method)
+	}
+	return true
+}
@@ -6,6 +6,7 @@ import (
 	"io"
 	"os"
 	"regexp"
+	"strconv"
 	"strings"
 )
 
@@ -27,13 +28,15 @@ type DHCPEntry struct {
 	Lease     string
 }
 
-// GetIPAddressByMACAddress gets the IP address of a MAC address
+// GetIPFromMac returns the IP address of the newest DHCP lease of mac in LeasesPath
 func GetIPFromMac(mac string) (string, error) {
-	mac = TrimMACAddress(mac)
-	return getIPAddressFromFile(mac, LeasesPath)
+	return GetIPFromLeasesFile(mac, LeasesPath)
 }
 
-func getIPAddressFromFile(mac, path string) (string, error) {
+// GetIPFromLeasesFile returns the IP address of the newest lease of mac in the dhcpd leases file at path.
+// The older leases of mac are stale, e.g. since the subnet of vmnet changed.
+func GetIPFromLeasesFile(mac, path string) (string, error) {
+	mac = TrimMACAddress(mac)
 	file, err := os.Open(path)
 	if err != nil {
 		return "", err
@@ -45,12 +48,27 @@ func getIPAddressFromFile(mac, path string) (string, error) {
 		return "", err
 	}
 
+	var (
+		ip     string
+		newest int64 = -1
+	)
 	for _, dhcpEntry := range dhcpEntries {
-		if dhcpEntry.HWAddress == mac {
-			return dhcpEntry.IPAddress, nil
+		if dhcpEntry.HWAddress != mac {
+			continue
+		}
+		// the lease is the hexadecimal expiration time, e.g. "0x62a1b2c3"
+		lease, err := strconv.ParseInt(strings.TrimPrefix(dhcpEntry.Lease, "0x"), 16, 64)
+		if err != nil {
+			lease = 0
 		}
+		if lease > newest {
+			ip, newest = dhcpEntry.IPAddress, lease
+		}
+	}
+	if ip == "" {
+		return "", fmt.Errorf("could not find an IP address for %s", mac)
 	}
-	return "", fmt.Errorf("could not find an IP address for %s", mac)
+	return ip, nil
 }
 
 func parseDHCPdLeasesFile(file io.Reader) ([]DHCPEntry, error) {
@@ -0,0 +1,13 @@
+//go:build !linux
+// +build !linux
+
+package osutil
+
+import (
+	"golang.org/x/sys/unix"
+)
+
+const (
+	ioctlGetTermios = unix.TIOCGETA
+	ioctlSetTermios = unix.TIOCSETA
+)
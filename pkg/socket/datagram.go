@@ -0,0 +1,35 @@
+package socket
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// MaxDatagramSize The largest payload of a UDP datagram
+const MaxDatagramSize = 65535
+
+// WriteDatagram Writes b to a stream as a datagram, prefixed by its length as uint16 big endian
+func WriteDatagram(w io.Writer, b []byte) error {
+	if len(b) > MaxDatagramSize {
+		return fmt.Errorf("datagram too large: %d bytes", len(b))
+	}
+	frame := make([]byte, 2+len(b))
+	binary.BigEndian.PutUint16(frame, uint16(len(b)))
+	copy(frame[2:], b)
+	_, err := w.Write(frame)
+	return err
+}
+
+// ReadDatagram Reads a datagram written by WriteDatagram into buf, which must hold MaxDatagramSize bytes
+func ReadDatagram(r io.Reader, buf []byte) (int, error) {
+	var header [2]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return 0, err
+	}
+	n := int(binary.BigEndian.Uint16(header[:]))
+	if n > len(buf) {
+		return 0, fmt.Errorf("datagram too large: %d bytes", n)
+	}
+	return io.ReadFull(r, buf[:n])
+}
@@ -0,0 +1,188 @@
+package socket
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// ExecStream identifies the stream of an exec frame
+type ExecStream = byte
+
+const (
+	// ExecStdin carries stdin from host to guest. An empty frame closes stdin
+	ExecStdin ExecStream = 0
+	// ExecStdout carries stdout from guest to host
+	ExecStdout ExecStream = 1
+	// ExecStderr carries stderr from guest to host, and is not used with a TTY
+	ExecStderr ExecStream = 2
+	// ExecExit carries the exit code as int32 big endian from guest to host, and is the last frame
+	ExecExit ExecStream = 3
+	// ExecResize carries the rows and the columns of the TTY as uint16 big endian from host to guest
+	ExecResize ExecStream = 4
+)
+
+// MaxExecFrameSize is the largest data of an exec frame
+const MaxExecFrameSize = 32 * 1024
+
+// ExecFrameWriter writes the frames that follow ExecEventResponse, each prefixed by its stream
+// and the length of its data as uint32 big endian. It is safe for concurrent use.
+type ExecFrameWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// NewExecFrameWriter creates an ExecFrameWriter
+func NewExecFrameWriter(w io.Writer) *ExecFrameWriter {
+	return &ExecFrameWriter{w: w}
+}
+
+// WriteFrame writes data to stream, splitting it in frames of MaxExecFrameSize
+func (w *ExecFrameWriter) WriteFrame(stream ExecStream, data []byte) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for {
+		n := len(data)
+		if n > MaxExecFrameSize {
+			n = MaxExecFrameSize
+		}
+		frame := make([]byte, 5+n)
+		frame[0] = stream
+		binary.BigEndian.PutUint32(frame[1:5], uint32(n))
+		copy(frame[5:], data[:n])
+		if _, err := w.w.Write(frame); err != nil {
+			return err
+		}
+		data = data[n:]
+		if len(data) == 0 {
+			return nil
+		}
+	}
+}
+
+// WriteExit writes the exit code
+func (w *ExecFrameWriter) WriteExit(code int) error {
+	var data [4]byte
+	binary.BigEndian.PutUint32(data[:], uint32(int32(code)))
+	return w.WriteFrame(ExecExit, data[:])
+}
+
+// WriteResize writes the size of the TTY
+func (w *ExecFrameWriter) WriteResize(rows, cols uint16) error {
+	var data [4]byte
+	binary.BigEndian.PutUint16(data[0:2], rows)
+	binary.BigEndian.PutUint16(data[2:4], cols)
+	return w.WriteFrame(ExecResize, data[:])
+}
+
+// Writer returns an io.Writer that writes to stream
+func (w *ExecFrameWriter) Writer(stream ExecStream) io.Writer {
+	return execStreamWriter{w: w, stream: stream}
+}
+
+type execStreamWriter struct {
+	w      *ExecFrameWriter
+	stream ExecStream
+}
+
+func (x execStreamWriter) Write(p []byte) (int, error) {
+	if len(p) == 0 {
+		// an empty frame would close stdin
+		return 0, nil
+	}
+	if err := x.w.WriteFrame(x.stream, p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// ReadExecFrame reads a frame written by ExecFrameWriter
+func ReadExecFrame(r io.Reader) (ExecStream, []byte, error) {
+	var header [5]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return 0, nil, err
+	}
+	n := binary.BigEndian.Uint32(header[1:5])
+	if n > MaxExecFrameSize {
+		return 0, nil, fmt.Errorf("exec frame too large: %d bytes", n)
+	}
+	data := make([]byte, n)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return 0, nil, err
+	}
+	return header[0], data, nil
+}
+
+// ParseExit parses the data of an ExecExit frame
+func ParseExit(data []byte) (int, error) {
+	if len(data) != 4 {
+		return 0, fmt.Errorf("invalid exit frame of %d bytes", len(data))
+	}
+	return int(int32(binary.BigEndian.Uint32(data))), nil
+}
+
+// ParseResize parses the data of an ExecResize frame
+func ParseResize(data []byte) (rows, cols uint16, err error) {
+	if len(data) != 4 {
+		return 0, 0, fmt.Errorf("invalid resize frame of %d bytes", len(data))
+	}
+	return binary.BigEndian.Uint16(data[0:2]), binary.BigEndian.Uint16(data[2:4]), nil
+}
+
+// ErrNoExitCode is returned by StreamExec when the stream ends without the exit code
+var ErrNoExitCode = errors.New("the command ended without an exit code")
+
+// StreamExec streams stdin to the command at the other end of rw, and its output to stdout and stderr,
+// until its exit code is received. The sizes received from resize are sent for the TTY.
+// stdin, stderr and resize may be nil.
+func StreamExec(rw io.ReadWriter, stdin io.Reader, stdout, stderr io.Writer, resize <-chan [2]uint16) (int, error) {
+	w := NewExecFrameWriter(rw)
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		if stdin != nil {
+			_, _ = io.Copy(w.Writer(ExecStdin), stdin)
+		}
+		// stdin is closed even when it fails, for the command not to wait for it
+		_ = w.WriteFrame(ExecStdin, nil)
+	}()
+	if resize != nil {
+		go func() {
+			for {
+				select {
+				case size := <-resize:
+					if err := w.WriteResize(size[0], size[1]); err != nil {
+						return
+					}
+				case <-done:
+					return
+				}
+			}
+		}()
+	}
+	for {
+		stream, data, err := ReadExecFrame(rw)
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return 0, ErrNoExitCode
+			}
+			return 0, err
+		}
+		switch stream {
+		case ExecStdout:
+			if _, err := stdout.Write(data); err != nil {
+				return 0, err
+			}
+		case ExecStderr:
+			if stderr != nil {
+				if _, err := stderr.Write(data); err != nil {
+					return 0, err
+				}
+			}
+		case ExecExit:
+			return ParseExit(data)
+		}
+	}
+}
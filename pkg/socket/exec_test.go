@@ -0,0 +1,96 @@
+package socket
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+
+	"gotest.tools/v3/assert"
+)
+
+// echoCommand serves the end of an exec stream like the guest agent would for `cat`, exiting with code
+func echoCommand(conn net.Conn, code int) {
+	defer conn.Close()
+	w := NewExecFrameWriter(conn)
+	for {
+		stream, data, err := ReadExecFrame(conn)
+		if err != nil {
+			return
+		}
+		switch stream {
+		case ExecStdin:
+			if len(data) == 0 {
+				_ = w.WriteExit(code)
+				return
+			}
+			_ = w.WriteFrame(ExecStdout, data)
+		case ExecResize:
+			rows, cols, _ := ParseResize(data)
+			_, _ = io.WriteString(w.Writer(ExecStderr), strings.Repeat("r", int(rows))+strings.Repeat("c", int(cols)))
+		}
+	}
+}
+
+func TestStreamExec(t *testing.T) {
+	c, s := net.Pipe()
+	defer c.Close()
+	go echoCommand(s, 42)
+
+	// larger than a frame
+	input := strings.Repeat("x", MaxExecFrameSize+1)
+	var stdout bytes.Buffer
+	code, err := StreamExec(c, strings.NewReader(input), &stdout, nil, nil)
+	assert.NilError(t, err)
+	assert.Equal(t, code, 42)
+	assert.Equal(t, stdout.String(), input)
+}
+
+func TestStreamExecResize(t *testing.T) {
+	c, s := net.Pipe()
+	defer c.Close()
+	go echoCommand(s, 0)
+
+	stdinR, stdinW := io.Pipe()
+	resize := make(chan [2]uint16, 1)
+	resize <- [2]uint16{2, 3}
+	stderr := &notifyWriter{written: make(chan struct{}, 1)}
+	go func() {
+		// close stdin once the resize was echoed
+		<-stderr.written
+		_ = stdinW.Close()
+	}()
+	var stdout bytes.Buffer
+	code, err := StreamExec(c, stdinR, &stdout, stderr, resize)
+	assert.NilError(t, err)
+	assert.Equal(t, code, 0)
+	assert.Equal(t, stderr.buf.String(), "rrccc")
+}
+
+func TestStreamExecNoExitCode(t *testing.T) {
+	c, s := net.Pipe()
+	go func() {
+		_ = NewExecFrameWriter(s).WriteFrame(ExecStdout, []byte("partial"))
+		_ = s.Close()
+	}()
+	var stdout bytes.Buffer
+	_, err := StreamExec(c, nil, &stdout, nil, nil)
+	assert.Assert(t, errors.Is(err, ErrNoExitCode), "unexpected error: %v", err)
+	assert.Equal(t, stdout.String(), "partial")
+}
+
+type notifyWriter struct {
+	buf     bytes.Buffer
+	written chan struct{}
+}
+
+func (w *notifyWriter) Write(p []byte) (int, error) {
+	n, err := w.buf.Write(p)
+	select {
+	case w.written <- struct{}{}:
+	default:
+	}
+	return n, err
+}
@@ -1,47 +1,29 @@
 package socket
 
 import (
-	"github.com/fxamacker/cbor/v2"
-	"github.com/hashicorp/yamux"
-	"github.com/mitchellh/mapstructure"
-	"github.com/sirupsen/logrus"
+	"io"
+	"net"
 )
 
-//GetIO Open a yamux connection and returns encoder and decoder
-func GetIO(sess *yamux.Session) (*cbor.Encoder, *cbor.Decoder) {
-	out, err := sess.Open()
-	if err != nil {
-		logrus.Error("error opening yamux session", err)
-		return nil, nil
-	}
-	return cbor.NewEncoder(out), cbor.NewDecoder(out)
-}
-
-//GetStreamIO Creates encoder and decoder for yamux stream
-func GetStreamIO(c *yamux.Stream) (*cbor.Encoder, *cbor.Decoder) {
-	return cbor.NewEncoder(c), cbor.NewDecoder(c)
+// byteReader reads a single byte at a time, as cbor.Decoder buffers whatever the reader returns
+type byteReader struct {
+	r io.Reader
 }
 
-//Write encodes the given obj
-func Write(enc *cbor.Encoder, obj interface{}) {
-	err := enc.Encode(obj)
-	if err != nil {
-		logrus.Error("error encoding value", err)
+func (b *byteReader) Read(p []byte) (int, error) {
+	if len(p) > 1 {
+		p = p[:1]
 	}
+	return b.r.Read(p)
 }
 
-//Read decodes the value to obj
-func Read(dec *cbor.Decoder, obj interface{}) {
-	err := dec.Decode(obj)
-	if err != nil {
-		logrus.Error("error encoding value", err)
-	}
+// StreamConn wraps the stream of a forwarded connection.
+// yamux streams only support half-close, so CloseWrite is the same as Close
+type StreamConn struct {
+	net.Conn
 }
 
-//ReadMap decodes src to dest interface
-func ReadMap(src map[string]interface{}, dest interface{}) {
-	err := mapstructure.Decode(src, dest)
-	if err != nil {
-		logrus.Error("error encoding value", err)
-	}
+// CloseWrite half-closes the stream, used by bicopy
+func (c StreamConn) CloseWrite() error {
+	return c.Conn.Close()
 }
@@ -0,0 +1,355 @@
+// Package socket implements the messages exchanged between the guest agent and the host agent
+// over the streams of their yamux session.
+//
+// Every stream carries a single request and its response, each wrapped in an envelope and framed by
+// its length as uint32 big endian. The response may be followed by raw bytes, see Request.Hijack.
+//
+// Agents older than the envelope send bare CBOR maps with a "kind" field, and expect bare CBOR responses.
+// The length of a frame never exceeds MaxFrameSize, so its first byte is zero and cannot be mistaken
+// for the first byte of a CBOR map, which is served as a legacy request.
+package socket
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/hashicorp/yamux"
+	"github.com/mac-vz/macvz/pkg/types"
+	"github.com/sirupsen/logrus"
+)
+
+// MaxFrameSize is the largest encoded envelope
+const MaxFrameSize = 1<<24 - 1
+
+// DefaultTimeout applies to the requests whose context has no deadline
+const DefaultTimeout = 30 * time.Second
+
+// requestReadTimeout is the timeout for reading a request from a new stream
+const requestReadTimeout = 30 * time.Second
+
+// envelope wraps every request and response
+type envelope struct {
+	Kind types.Kind `cbor:"kind"`
+	// ID correlates the response with the request
+	ID    uint64 `cbor:"id"`
+	Reply bool   `cbor:"reply,omitempty"`
+	// Timeout is the time left until the deadline of the request.
+	// It is relative, as the clocks of the guest and the host may differ
+	Timeout time.Duration   `cbor:"timeout,omitempty"`
+	Error   string          `cbor:"error,omitempty"`
+	Body    cbor.RawMessage `cbor:"body,omitempty"`
+}
+
+func writeEnvelope(w io.Writer, env *envelope) error {
+	b, err := cbor.Marshal(env)
+	if err != nil {
+		return err
+	}
+	if len(b) > MaxFrameSize {
+		return fmt.Errorf("%s message too large: %d bytes", env.Kind, len(b))
+	}
+	frame := make([]byte, 4+len(b))
+	binary.BigEndian.PutUint32(frame, uint32(len(b)))
+	copy(frame[4:], b)
+	_, err = w.Write(frame)
+	return err
+}
+
+// readEnvelope reads a frame written by writeEnvelope, or a bare CBOR map of a legacy agent.
+// It never reads past the message, as the stream may carry raw bytes after it.
+func readEnvelope(r io.Reader) (env *envelope, legacy bool, err error) {
+	var header [4]byte
+	if _, err := io.ReadFull(r, header[:1]); err != nil {
+		return nil, false, err
+	}
+	if header[0] != 0 {
+		if header[0]&0xe0 != 0xa0 {
+			return nil, false, fmt.Errorf("unexpected first byte 0x%02x, neither a frame nor a CBOR map", header[0])
+		}
+		// the decoder must not read ahead either
+		dec := cbor.NewDecoder(io.MultiReader(bytes.NewReader(header[:1]), &byteReader{r: r}))
+		var raw cbor.RawMessage
+		if err := dec.Decode(&raw); err != nil {
+			return nil, true, err
+		}
+		var ev types.Event
+		if err := cbor.Unmarshal(raw, &ev); err != nil {
+			return nil, true, err
+		}
+		return &envelope{Kind: ev.Kind, Body: raw}, true, nil
+	}
+	if _, err := io.ReadFull(r, header[1:]); err != nil {
+		return nil, false, err
+	}
+	b := make([]byte, binary.BigEndian.Uint32(header[:]))
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, false, err
+	}
+	env = &envelope{}
+	if err := cbor.Unmarshal(b, env); err != nil {
+		return nil, false, err
+	}
+	return env, false, nil
+}
+
+// RemoteError is an error returned by the handler of the peer
+type RemoteError struct {
+	Kind    types.Kind
+	Message string
+}
+
+func (e *RemoteError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Kind, e.Message)
+}
+
+// Opener opens a new stream to the peer, like yamux.Session.Open
+type Opener func() (net.Conn, error)
+
+// Client sends requests to the peer, each over a new stream
+type Client struct {
+	open   Opener
+	lastID uint64
+}
+
+// NewClient creates a Client
+func NewClient(open Opener) *Client {
+	return &Client{open: open}
+}
+
+// Call sends req as kind, and decodes the body of the response into res unless res is nil.
+// The deadline of ctx is sent along with the request, and DefaultTimeout applies when ctx has none.
+func (c *Client) Call(ctx context.Context, kind types.Kind, req, res interface{}) error {
+	conn, err := c.Open(ctx, kind, req, res)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+// Open is like Call, but returns the stream for the raw bytes that follow the response, see Request.Hijack.
+// The deadline of the stream is cleared once the response is received.
+func (c *Client) Open(ctx context.Context, kind types.Kind, req, res interface{}) (net.Conn, error) {
+	body, err := cbor.Marshal(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode the %s request: %w", kind, err)
+	}
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(DefaultTimeout)
+	}
+	conn, err := c.open()
+	if err != nil {
+		return nil, err
+	}
+	_ = conn.SetDeadline(deadline)
+
+	// Interrupt the stream when ctx is cancelled before the response
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		select {
+		case <-ctx.Done():
+			_ = conn.SetDeadline(time.Now())
+		case <-done:
+		}
+	}()
+	resEnv, err := c.roundTrip(conn, &envelope{
+		Kind:    kind,
+		ID:      atomic.AddUint64(&c.lastID, 1),
+		Timeout: time.Until(deadline),
+		Body:    body,
+	})
+	close(done)
+	wg.Wait()
+	if err != nil {
+		_ = conn.Close()
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return nil, fmt.Errorf("%s: %w", kind, ctxErr)
+		}
+		var netErr net.Error
+		if errors.As(err, &netErr) && netErr.Timeout() {
+			// the deadline of the stream may expire slightly before the one of ctx
+			return nil, fmt.Errorf("%s: %w", kind, context.DeadlineExceeded)
+		}
+		return nil, err
+	}
+	if resEnv.Error != "" {
+		_ = conn.Close()
+		return nil, &RemoteError{Kind: kind, Message: resEnv.Error}
+	}
+	if res != nil && len(resEnv.Body) > 0 {
+		if err := cbor.Unmarshal(resEnv.Body, res); err != nil {
+			_ = conn.Close()
+			return nil, fmt.Errorf("failed to decode the %s response: %w", kind, err)
+		}
+	}
+	_ = conn.SetDeadline(time.Time{})
+	return conn, nil
+}
+
+func (c *Client) roundTrip(conn net.Conn, env *envelope) (*envelope, error) {
+	if err := writeEnvelope(conn, env); err != nil {
+		return nil, fmt.Errorf("failed to send the %s request: %w", env.Kind, err)
+	}
+	resEnv, legacy, err := readEnvelope(conn)
+	if err != nil {
+		return nil, fmt.Errorf("failed to receive the %s response: %w", env.Kind, err)
+	}
+	if legacy || !resEnv.Reply || resEnv.ID != env.ID {
+		return nil, fmt.Errorf("unexpected response to the %s request %d: %s %d", env.Kind, env.ID, resEnv.Kind, resEnv.ID)
+	}
+	return resEnv, nil
+}
+
+// HandlerFunc handles a request, and returns the body of the response.
+// The error is sent to the peer, where Client returns it as RemoteError.
+type HandlerFunc func(ctx context.Context, req *Request) (interface{}, error)
+
+// Request is a request received by Mux
+type Request struct {
+	Kind types.Kind
+	ID   uint64
+	// Legacy is true for the bare CBOR maps of the agents older than the envelope
+	Legacy bool
+
+	body   cbor.RawMessage
+	hijack func(net.Conn)
+}
+
+// Decode decodes the body of the request into v
+func (r *Request) Decode(v interface{}) error {
+	if err := cbor.Unmarshal(r.body, v); err != nil {
+		return fmt.Errorf("failed to decode the %s request: %w", r.Kind, err)
+	}
+	return nil
+}
+
+// Hijack hands over the stream to fn once the response is sent, for the raw bytes that follow it.
+// fn is responsible for closing the stream. It is not called when the handler returns an error.
+// When the response cannot be sent, fn is called with the stream already closed, to release its resources.
+func (r *Request) Hijack(fn func(net.Conn)) {
+	r.hijack = fn
+}
+
+// Mux dispatches the requests to the handlers registered by kind
+type Mux struct {
+	mu       sync.RWMutex
+	handlers map[types.Kind]HandlerFunc
+}
+
+// NewMux creates a Mux with no handlers
+func NewMux() *Mux {
+	return &Mux{handlers: make(map[types.Kind]HandlerFunc)}
+}
+
+// Handle registers h for the requests of kind, replacing the previous handler
+func (m *Mux) Handle(kind types.Kind, h HandlerFunc) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.handlers[kind] = h
+}
+
+func (m *Mux) handler(kind types.Kind) HandlerFunc {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.handlers[kind]
+}
+
+// Serve serves the streams accepted from ln, e.g. a yamux.Session, until it is closed
+func (m *Mux) Serve(ctx context.Context, ln net.Listener) error {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if errors.Is(err, io.EOF) || errors.Is(err, io.ErrClosedPipe) || errors.Is(err, yamux.ErrSessionShutdown) || errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+		go m.ServeConn(ctx, conn)
+	}
+}
+
+// ServeConn serves the request of a stream, and closes it unless the handler hijacked it
+func (m *Mux) ServeConn(ctx context.Context, conn net.Conn) {
+	_ = conn.SetReadDeadline(time.Now().Add(requestReadTimeout))
+	env, legacy, err := readEnvelope(conn)
+	if err != nil {
+		logrus.WithError(err).Debug("failed to read the request")
+		_ = conn.Close()
+		return
+	}
+	_ = conn.SetReadDeadline(time.Time{})
+
+	req := &Request{
+		Kind:   env.Kind,
+		ID:     env.ID,
+		Legacy: legacy,
+		body:   env.Body,
+	}
+	var res interface{}
+	if h := m.handler(env.Kind); h == nil {
+		err = fmt.Errorf("unknown kind %q", env.Kind)
+	} else {
+		hctx := ctx
+		if env.Timeout > 0 {
+			var cancel context.CancelFunc
+			hctx, cancel = context.WithTimeout(ctx, env.Timeout)
+			defer cancel()
+		}
+		res, err = h(hctx, req)
+	}
+	if err != nil {
+		logrus.WithError(err).Debugf("failed to handle the %s request %d", env.Kind, env.ID)
+	}
+
+	if writeErr := writeResponse(conn, env, legacy, res, err); writeErr != nil {
+		logrus.WithError(writeErr).Debugf("failed to send the %s response %d", env.Kind, env.ID)
+		_ = conn.Close()
+		if err == nil && req.hijack != nil {
+			req.hijack(conn)
+		}
+		return
+	}
+	if err == nil && req.hijack != nil {
+		req.hijack(conn)
+		return
+	}
+	_ = conn.Close()
+}
+
+func writeResponse(w io.Writer, reqEnv *envelope, legacy bool, res interface{}, err error) error {
+	if legacy {
+		// legacy agents only expect a bare response when there is one, and cannot receive errors
+		if err != nil || res == nil {
+			return nil
+		}
+		return cbor.NewEncoder(w).Encode(res)
+	}
+	env := envelope{
+		Kind:  reqEnv.Kind,
+		ID:    reqEnv.ID,
+		Reply: true,
+	}
+	if err != nil {
+		env.Error = err.Error()
+	} else if res != nil {
+		body, err := cbor.Marshal(res)
+		if err != nil {
+			env.Error = fmt.Sprintf("failed to encode the response: %v", err)
+		} else {
+			env.Body = body
+		}
+	}
+	return writeEnvelope(w, &env)
+}
@@ -0,0 +1,192 @@
+package socket
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/hashicorp/yamux"
+	"github.com/mac-vz/macvz/pkg/types"
+	"gotest.tools/v3/assert"
+)
+
+// newPipeClient returns a Client whose streams are served by mux, each over its own net.Pipe
+func newPipeClient(mux *Mux) *Client {
+	return NewClient(func() (net.Conn, error) {
+		c, s := net.Pipe()
+		go mux.ServeConn(context.Background(), s)
+		return c, nil
+	})
+}
+
+// newSessionClient returns a Client whose streams are served by mux, over a yamux session on a net.Pipe,
+// like the session between the host agent (client) and the guest agent (server)
+func newSessionClient(t *testing.T, mux *Mux) *Client {
+	c, s := net.Pipe()
+	clientSess, err := yamux.Client(c, nil)
+	assert.NilError(t, err)
+	serverSess, err := yamux.Server(s, nil)
+	assert.NilError(t, err)
+	served := make(chan error, 1)
+	go func() {
+		served <- mux.Serve(context.Background(), serverSess)
+	}()
+	t.Cleanup(func() {
+		_ = clientSess.Close()
+		_ = serverSess.Close()
+		assert.NilError(t, <-served)
+	})
+	return NewClient(clientSess.Open)
+}
+
+func newDNSMux() *Mux {
+	mux := NewMux()
+	mux.Handle(types.DNSMessage, func(ctx context.Context, req *Request) (interface{}, error) {
+		var ev types.DNSEvent
+		if err := req.Decode(&ev); err != nil {
+			return nil, err
+		}
+		if len(ev.Msg) == 0 {
+			return nil, errors.New("empty message")
+		}
+		res := types.DNSEventResponse{Msg: append([]byte("re:"), ev.Msg...)}
+		res.Kind = types.DNSResponseMessage
+		return &res, nil
+	})
+	return mux
+}
+
+func TestCall(t *testing.T) {
+	for name, client := range map[string]*Client{
+		"pipe":    newPipeClient(newDNSMux()),
+		"session": newSessionClient(t, newDNSMux()),
+	} {
+		t.Run(name, func(t *testing.T) {
+			for i := 0; i < 3; i++ {
+				var res types.DNSEventResponse
+				err := client.Call(context.Background(), types.DNSMessage, &types.DNSEvent{Msg: []byte("query")}, &res)
+				assert.NilError(t, err)
+				assert.Equal(t, string(res.Msg), "re:query")
+				assert.Equal(t, res.Kind, types.DNSResponseMessage)
+			}
+		})
+	}
+}
+
+func TestCallHandlerError(t *testing.T) {
+	client := newPipeClient(newDNSMux())
+	var res types.DNSEventResponse
+	err := client.Call(context.Background(), types.DNSMessage, &types.DNSEvent{}, &res)
+	var remoteErr *RemoteError
+	assert.Assert(t, errors.As(err, &remoteErr))
+	assert.Equal(t, remoteErr.Kind, types.DNSMessage)
+	assert.Equal(t, remoteErr.Message, "empty message")
+}
+
+func TestCallUnknownKind(t *testing.T) {
+	client := newPipeClient(newDNSMux())
+	err := client.Call(context.Background(), types.PortMessage, &types.PortEvent{}, nil)
+	assert.ErrorContains(t, err, `unknown kind "port-event"`)
+}
+
+func TestCallDeadline(t *testing.T) {
+	mux := NewMux()
+	handlerDeadline := make(chan time.Duration, 1)
+	unblock := make(chan struct{})
+	defer close(unblock)
+	mux.Handle(types.DNSMessage, func(ctx context.Context, req *Request) (interface{}, error) {
+		deadline, ok := ctx.Deadline()
+		assert.Check(t, ok)
+		handlerDeadline <- time.Until(deadline)
+		// a slow handler, that does not respond before the deadline of the client
+		<-unblock
+		return nil, nil
+	})
+	client := newPipeClient(mux)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	err := client.Call(ctx, types.DNSMessage, &types.DNSEvent{}, nil)
+	assert.Assert(t, errors.Is(err, context.DeadlineExceeded), "unexpected error: %v", err)
+	assert.Assert(t, time.Since(start) < DefaultTimeout)
+	d := <-handlerDeadline
+	assert.Assert(t, d > 0 && d <= 100*time.Millisecond, "unexpected deadline of the handler: %v", d)
+}
+
+func TestCallCancel(t *testing.T) {
+	mux := NewMux()
+	mux.Handle(types.DNSMessage, func(ctx context.Context, req *Request) (interface{}, error) {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	})
+	client := newPipeClient(mux)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	err := client.Call(ctx, types.DNSMessage, &types.DNSEvent{}, nil)
+	assert.Assert(t, errors.Is(err, context.Canceled), "unexpected error: %v", err)
+}
+
+func TestOpenHijack(t *testing.T) {
+	mux := NewMux()
+	mux.Handle(types.ConnectMessage, func(ctx context.Context, req *Request) (interface{}, error) {
+		var ev types.ConnectEvent
+		if err := req.Decode(&ev); err != nil {
+			return nil, err
+		}
+		req.Hijack(func(conn net.Conn) {
+			defer conn.Close()
+			_, _ = conn.Write([]byte(ev.Address))
+			_, _ = io.Copy(conn, conn)
+		})
+		res := types.ConnectEventResponse{}
+		res.Kind = types.ConnectResponseMessage
+		return &res, nil
+	})
+	client := newSessionClient(t, mux)
+
+	var res types.ConnectEventResponse
+	conn, err := client.Open(context.Background(), types.ConnectMessage, &types.ConnectEvent{Network: "tcp", Address: "hello"}, &res)
+	assert.NilError(t, err)
+	defer conn.Close()
+	assert.Equal(t, res.Kind, types.ConnectResponseMessage)
+
+	_, err = conn.Write([]byte(" world"))
+	assert.NilError(t, err)
+	buf := make([]byte, len("hello world"))
+	_, err = io.ReadFull(conn, buf)
+	assert.NilError(t, err)
+	assert.Equal(t, string(buf), "hello world")
+}
+
+func TestServeLegacy(t *testing.T) {
+	c, s := net.Pipe()
+	defer c.Close()
+	go newDNSMux().ServeConn(context.Background(), s)
+
+	// agents older than the envelope send a bare CBOR map
+	ev := types.DNSEvent{Msg: []byte("query")}
+	ev.Kind = types.DNSMessage
+	go func() {
+		_ = cbor.NewEncoder(c).Encode(&ev)
+	}()
+	var res types.DNSEventResponse
+	assert.NilError(t, cbor.NewDecoder(c).Decode(&res))
+	assert.Equal(t, string(res.Msg), "re:query")
+	assert.Equal(t, res.Kind, types.DNSResponseMessage)
+}
+
+func TestReadEnvelopeInvalid(t *testing.T) {
+	c, s := net.Pipe()
+	defer c.Close()
+	go func() {
+		_, _ = c.Write([]byte{0x42})
+	}()
+	_, _, err := readEnvelope(s)
+	assert.ErrorContains(t, err, "unexpected first byte 0x42")
+}
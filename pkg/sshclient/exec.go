@@ -0,0 +1,109 @@
+package sshclient
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strconv"
+
+	"github.com/lima-vm/sshocker/pkg/ssh"
+	"github.com/sirupsen/logrus"
+)
+
+// execClient runs the ssh binary, with the forwards multiplexed over its control master
+type execClient struct {
+	sshConfig *ssh.SSHConfig
+	addr      AddrFunc
+}
+
+// NewExecClient creates a Client running the ssh binary with args, e.g. sshutil.SSHArgsFromOpts(sshutil.SSHOpts(...)).
+// The options must set up a control master, which outlives the ssh processes.
+func NewExecClient(args []string, addr AddrFunc) Client {
+	return &execClient{
+		sshConfig: &ssh.SSHConfig{
+			AdditionalArgs: args,
+		},
+		addr: addr,
+	}
+}
+
+func (c *execClient) Forward(ctx context.Context, local, remote string) error {
+	if isUnixSocket(local) {
+		if err := prepareUnixSocket(local, remote); err != nil {
+			return err
+		}
+	}
+	err := c.forward(ctx, local, remote, "forward")
+	if err != nil && isUnixSocket(local) {
+		logrus.WithError(err).Warnf("Failed to set up forward from %q (guest) to %q (host)", remote, local)
+		removeUnixSocket(local)
+	}
+	return err
+}
+
+func (c *execClient) CancelForward(ctx context.Context, local, remote string) error {
+	if isUnixSocket(local) {
+		logrus.Infof("Stopping forwarding %q (guest) to %q (host)", remote, local)
+		defer removeUnixSocket(local)
+	}
+	return c.forward(ctx, local, remote, "cancel")
+}
+
+// forward runs `ssh -O verb -L local:remote`
+func (c *execClient) forward(ctx context.Context, local, remote, verb string) error {
+	addr, err := c.addr()
+	if err != nil {
+		return err
+	}
+	host, port, err := splitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	args := c.sshConfig.Args()
+	args = append(args,
+		"-T",
+		"-O", verb,
+		"-L", local+":"+remote,
+		"-N",
+		"-f",
+		"-p", strconv.Itoa(port),
+		host,
+		"--",
+	)
+	cmd := exec.CommandContext(ctx, c.sshConfig.Binary(), args...)
+	if out, err := cmd.Output(); err != nil {
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			out = append(out, exitErr.Stderr...)
+		}
+		return fmt.Errorf("failed to run %v: %q: %w", cmd.Args, string(out), err)
+	}
+	return nil
+}
+
+func (c *execClient) ExecuteScript(ctx context.Context, script, description string) (string, string, error) {
+	addr, err := c.addr()
+	if err != nil {
+		return "", "", err
+	}
+	host, port, err := splitHostPort(addr)
+	if err != nil {
+		return "", "", err
+	}
+	return ssh.ExecuteScript(host, port, c.sshConfig, script, description)
+}
+
+// Close exits the control master, which also cancels the forwards.
+// The unix sockets of the forwards are left to be removed by CancelForward.
+func (c *execClient) Close() error {
+	addr, err := c.addr()
+	if err != nil {
+		return err
+	}
+	host, port, err := splitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	return ssh.ExitMaster(host, port, c.sshConfig)
+}
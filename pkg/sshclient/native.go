@@ -0,0 +1,305 @@
+package sshclient
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/go-multierror"
+	sshocker "github.com/lima-vm/sshocker/pkg/ssh"
+	"github.com/mac-vz/macvz/pkg/sshutil"
+	"github.com/mac-vz/macvz/pkg/store/filenames"
+	"github.com/norouter/norouter/pkg/agent/bicopy"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/crypto/ssh"
+)
+
+// dialTimeout is the timeout for establishing the SSH connection, including the handshake
+const dialTimeout = 10 * time.Second
+
+// nativeClient speaks SSH in-process, with the forwards and the scripts multiplexed over a single connection.
+// The connection is established on demand, and again after it is lost.
+type nativeClient struct {
+	config *ssh.ClientConfig
+	addr   AddrFunc
+
+	mu     sync.Mutex
+	client *ssh.Client
+	// forwards holds the listeners of the forwards, keyed by the local address
+	forwards map[string]net.Listener
+	closed   bool
+}
+
+// NewNativeClient creates a Client speaking SSH in-process with config, see NativeConfig
+func NewNativeClient(config *ssh.ClientConfig, addr AddrFunc) Client {
+	return &nativeClient{
+		config:   config,
+		addr:     addr,
+		forwards: make(map[string]net.Listener),
+	}
+}
+
+// NativeConfig returns the configuration of NewNativeClient for user in the instance in instDir,
+// equivalent to the options of sshutil.CommonOpts for the ssh binary.
+func NativeConfig(instDir, user string, useDotSSH bool) (*ssh.ClientConfig, error) {
+	identityFiles, err := sshutil.IdentityFiles(useDotSSH)
+	if err != nil {
+		return nil, err
+	}
+	var signers []ssh.Signer
+	for _, f := range identityFiles {
+		b, err := os.ReadFile(f)
+		if err != nil {
+			return nil, err
+		}
+		signer, err := ssh.ParsePrivateKey(b)
+		if err != nil {
+			// e.g. a key of ~/.ssh protected by a passphrase
+			logrus.WithError(err).Debugf("skipping the private key %q", f)
+			continue
+		}
+		signers = append(signers, signer)
+	}
+	hostKeyCallback, hostKeyAlgorithms, err := pinnedHostKey(filepath.Join(instDir, filenames.SSHKnownHosts), sshutil.HostAlias(filepath.Base(instDir)))
+	if err != nil {
+		return nil, err
+	}
+	return &ssh.ClientConfig{
+		User:              user,
+		Auth:              []ssh.AuthMethod{ssh.PublicKeys(signers...)},
+		HostKeyCallback:   hostKeyCallback,
+		HostKeyAlgorithms: hostKeyAlgorithms,
+		Timeout:           dialTimeout,
+	}, nil
+}
+
+// pinnedHostKey returns the callback accepting the host keys of alias in knownHosts, like HostKeyAlias of the ssh binary,
+// and their algorithms
+func pinnedHostKey(knownHosts, alias string) (ssh.HostKeyCallback, []string, error) {
+	b, err := os.ReadFile(knownHosts)
+	if errors.Is(err, os.ErrNotExist) {
+		// The guest of an instance started by an older version of macvz generated its own host key
+		logrus.Debugf("%q does not exist, the host key of the guest cannot be checked until the instance is restarted", knownHosts)
+		return ssh.InsecureIgnoreHostKey(), nil, nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	var (
+		keys       []ssh.PublicKey
+		algorithms []string
+	)
+	for {
+		_, hosts, key, _, rest, err := ssh.ParseKnownHosts(b)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to parse %q: %w", knownHosts, err)
+		}
+		b = rest
+		for _, h := range hosts {
+			if h == alias {
+				keys = append(keys, key)
+				algorithms = append(algorithms, key.Type())
+				break
+			}
+		}
+	}
+	if len(keys) == 0 {
+		return nil, nil, fmt.Errorf("no host key of %q in %q", alias, knownHosts)
+	}
+	callback := func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		for _, k := range keys {
+			if bytes.Equal(k.Marshal(), key.Marshal()) {
+				return nil
+			}
+		}
+		return fmt.Errorf("the host key %s of %s does not match the one of %q in %q", ssh.FingerprintSHA256(key), remote, alias, knownHosts)
+	}
+	return callback, algorithms, nil
+}
+
+// sshClient returns the connection, establishing it if needed.
+// The connection is established without c.mu held, as it may take up to dialTimeout while the guest is unreachable.
+func (c *nativeClient) sshClient() (*ssh.Client, error) {
+	c.mu.Lock()
+	closed, client := c.closed, c.client
+	c.mu.Unlock()
+	if closed {
+		return nil, net.ErrClosed
+	}
+	if client != nil {
+		return client, nil
+	}
+	addr, err := c.addr()
+	if err != nil {
+		return nil, err
+	}
+	client, err = ssh.Dial("tcp", addr, c.config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to %s over SSH: %w", addr, err)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		_ = client.Close()
+		return nil, net.ErrClosed
+	}
+	if c.client != nil {
+		// another caller connected meanwhile
+		_ = client.Close()
+		return c.client, nil
+	}
+	logrus.Debugf("connected to %s over SSH", addr)
+	c.client = client
+	go func() {
+		err := client.Wait()
+		logrus.WithError(err).Debugf("the SSH connection to %s is closed", addr)
+		c.mu.Lock()
+		if c.client == client {
+			c.client = nil
+		}
+		c.mu.Unlock()
+	}()
+	return client, nil
+}
+
+func (c *nativeClient) Forward(ctx context.Context, local, remote string) error {
+	// connect now, so that Forward fails like `ssh -O forward` when the guest is unreachable
+	if _, err := c.sshClient(); err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.forwards[local]; ok {
+		return fmt.Errorf("%q is already forwarded", local)
+	}
+	network := "tcp"
+	if isUnixSocket(local) {
+		if err := prepareUnixSocket(local, remote); err != nil {
+			return err
+		}
+		network = "unix"
+	}
+	ln, err := net.Listen(network, local)
+	if err != nil {
+		return err
+	}
+	c.forwards[local] = ln
+	go c.serve(ln, remote)
+	return nil
+}
+
+func (c *nativeClient) serve(ln net.Listener, remote string) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				logrus.WithError(err).Warnf("stopped forwarding %q to %q", ln.Addr(), remote)
+			}
+			return
+		}
+		go c.forwardConn(conn, remote)
+	}
+}
+
+func (c *nativeClient) forwardConn(conn net.Conn, remote string) {
+	defer conn.Close()
+	client, err := c.sshClient()
+	if err != nil {
+		logrus.WithError(err).Warnf("failed to forward a connection to %q", remote)
+		return
+	}
+	network := "tcp"
+	if isUnixSocket(remote) {
+		network = "unix"
+	}
+	remoteConn, err := client.Dial(network, remote)
+	if err != nil {
+		logrus.WithError(err).Warnf("failed to forward a connection to %q", remote)
+		return
+	}
+	defer remoteConn.Close()
+	bicopy.Bicopy(conn, remoteConn, nil)
+}
+
+// CancelForward stops accepting connections on local, while the connections already forwarded are kept like with `ssh -O cancel`
+func (c *nativeClient) CancelForward(ctx context.Context, local, remote string) error {
+	c.mu.Lock()
+	ln, ok := c.forwards[local]
+	delete(c.forwards, local)
+	c.mu.Unlock()
+	if isUnixSocket(local) {
+		logrus.Infof("Stopping forwarding %q (guest) to %q (host)", remote, local)
+		defer removeUnixSocket(local)
+	}
+	if !ok {
+		return fmt.Errorf("%q is not forwarded", local)
+	}
+	return ln.Close()
+}
+
+func (c *nativeClient) ExecuteScript(ctx context.Context, script, description string) (string, string, error) {
+	interpreter, err := sshocker.ParseScriptInterpreter(script)
+	if err != nil {
+		return "", "", err
+	}
+	client, err := c.sshClient()
+	if err != nil {
+		return "", "", err
+	}
+	session, err := client.NewSession()
+	if err != nil {
+		return "", "", err
+	}
+	defer session.Close()
+	var stdout, stderr bytes.Buffer
+	session.Stdin = strings.NewReader(script)
+	session.Stdout = &stdout
+	session.Stderr = &stderr
+	logrus.Debugf("executing script %q over SSH with %q", description, interpreter)
+	done := make(chan error, 1)
+	go func() {
+		done <- session.Run(interpreter)
+	}()
+	select {
+	case err = <-done:
+	case <-ctx.Done():
+		// the outputs may still be written to until the session is closed
+		return "", "", fmt.Errorf("failed to execute script %q: %w", description, ctx.Err())
+	}
+	if err != nil {
+		return stdout.String(), stderr.String(), fmt.Errorf("failed to execute script %q: stdout=%q, stderr=%q: %w",
+			description, stdout.String(), stderr.String(), err)
+	}
+	return stdout.String(), stderr.String(), nil
+}
+
+func (c *nativeClient) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closed = true
+	var mErr error
+	for local, ln := range c.forwards {
+		if err := ln.Close(); err != nil {
+			mErr = multierror.Append(mErr, err)
+		}
+		delete(c.forwards, local)
+	}
+	if c.client != nil {
+		if err := c.client.Close(); err != nil {
+			mErr = multierror.Append(mErr, err)
+		}
+		c.client = nil
+	}
+	return mErr
+}
@@ -0,0 +1,270 @@
+package sshclient
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/norouter/norouter/pkg/agent/bicopy"
+	"golang.org/x/crypto/ssh"
+	"gotest.tools/v3/assert"
+)
+
+func newSigner(t *testing.T) ssh.Signer {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	assert.NilError(t, err)
+	signer, err := ssh.NewSignerFromKey(key)
+	assert.NilError(t, err)
+	return signer
+}
+
+// startServer starts an SSH server accepting userKey, which runs the commands with sh
+// and supports the direct-tcpip and direct-streamlocal@openssh.com channels
+func startServer(t *testing.T, hostKey ssh.Signer, userKey ssh.PublicKey) string {
+	config := &ssh.ServerConfig{
+		PublicKeyCallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if !bytes.Equal(key.Marshal(), userKey.Marshal()) {
+				return nil, errors.New("unknown key")
+			}
+			return nil, nil
+		},
+	}
+	config.AddHostKey(hostKey)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NilError(t, err)
+	t.Cleanup(func() { _ = ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go serveConn(conn, config)
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func serveConn(conn net.Conn, config *ssh.ServerConfig) {
+	_, chans, reqs, err := ssh.NewServerConn(conn, config)
+	if err != nil {
+		return
+	}
+	go ssh.DiscardRequests(reqs)
+	for newChannel := range chans {
+		switch newChannel.ChannelType() {
+		case "session":
+			go serveSession(newChannel)
+		case "direct-tcpip":
+			var payload struct {
+				Host       string
+				Port       uint32
+				OriginHost string
+				OriginPort uint32
+			}
+			_ = ssh.Unmarshal(newChannel.ExtraData(), &payload)
+			go serveDirect(newChannel, "tcp", net.JoinHostPort(payload.Host, fmt.Sprint(payload.Port)))
+		case "direct-streamlocal@openssh.com":
+			var payload struct {
+				SocketPath string
+				Reserved0  string
+				Reserved1  uint32
+			}
+			_ = ssh.Unmarshal(newChannel.ExtraData(), &payload)
+			go serveDirect(newChannel, "unix", payload.SocketPath)
+		default:
+			_ = newChannel.Reject(ssh.UnknownChannelType, "unsupported")
+		}
+	}
+}
+
+func serveSession(newChannel ssh.NewChannel) {
+	ch, reqs, err := newChannel.Accept()
+	if err != nil {
+		return
+	}
+	defer ch.Close()
+	for req := range reqs {
+		if req.Type != "exec" {
+			_ = req.Reply(false, nil)
+			continue
+		}
+		var payload struct{ Command string }
+		_ = ssh.Unmarshal(req.Payload, &payload)
+		_ = req.Reply(true, nil)
+		cmd := exec.Command("sh", "-c", payload.Command)
+		cmd.Stdin, cmd.Stdout, cmd.Stderr = ch, ch, ch.Stderr()
+		status := struct{ Status uint32 }{}
+		if err := cmd.Run(); err != nil {
+			status.Status = uint32(cmd.ProcessState.ExitCode())
+		}
+		_, _ = ch.SendRequest("exit-status", false, ssh.Marshal(&status))
+		return
+	}
+}
+
+func serveDirect(newChannel ssh.NewChannel, network, address string) {
+	conn, err := net.Dial(network, address)
+	if err != nil {
+		_ = newChannel.Reject(ssh.ConnectionFailed, err.Error())
+		return
+	}
+	defer conn.Close()
+	ch, reqs, err := newChannel.Accept()
+	if err != nil {
+		return
+	}
+	go ssh.DiscardRequests(reqs)
+	defer ch.Close()
+	bicopy.Bicopy(conn, ch, nil)
+}
+
+// startEcho starts a server echoing the connections on network
+func startEcho(t *testing.T, network, address string) string {
+	ln, err := net.Listen(network, address)
+	assert.NilError(t, err)
+	t.Cleanup(func() { _ = ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				_, _ = io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func newTestClient(t *testing.T, hostKeyCallback ssh.HostKeyCallback) Client {
+	hostKey, userKey := newSigner(t), newSigner(t)
+	addr := startServer(t, hostKey, userKey.PublicKey())
+	if hostKeyCallback == nil {
+		hostKeyCallback = ssh.FixedHostKey(hostKey.PublicKey())
+	}
+	c := NewNativeClient(&ssh.ClientConfig{
+		User:            "user",
+		Auth:            []ssh.AuthMethod{ssh.PublicKeys(userKey)},
+		HostKeyCallback: hostKeyCallback,
+	}, func() (string, error) { return addr, nil })
+	t.Cleanup(func() { _ = c.Close() })
+	return c
+}
+
+func TestNativeClientExecuteScript(t *testing.T) {
+	c := newTestClient(t, nil)
+	stdout, stderr, err := c.ExecuteScript(context.Background(), "#!/bin/sh\necho hello\necho world >&2\n", "hello")
+	assert.NilError(t, err)
+	assert.Equal(t, stdout, "hello\n")
+	assert.Equal(t, stderr, "world\n")
+
+	_, _, err = c.ExecuteScript(context.Background(), "#!/bin/sh\nexit 3\n", "exit")
+	var exitErr *ssh.ExitError
+	assert.Assert(t, errors.As(err, &exitErr), "%v", err)
+	assert.Equal(t, exitErr.ExitStatus(), 3)
+
+	_, _, err = c.ExecuteScript(context.Background(), "exit 3\n", "no shebang")
+	assert.ErrorContains(t, err, "#!")
+}
+
+func TestNativeClientForward(t *testing.T) {
+	c := newTestClient(t, nil)
+	dir := t.TempDir()
+	for _, remote := range []string{
+		startEcho(t, "tcp", "127.0.0.1:0"),
+		startEcho(t, "unix", filepath.Join(dir, "echo.sock")),
+	} {
+		local := filepath.Join(dir, "forward", "local.sock")
+		assert.NilError(t, c.Forward(context.Background(), local, remote))
+		assert.ErrorContains(t, c.Forward(context.Background(), local, remote), "already forwarded")
+
+		conn, err := net.Dial("unix", local)
+		assert.NilError(t, err)
+		_, err = conn.Write([]byte("ping"))
+		assert.NilError(t, err)
+		buf := make([]byte, 4)
+		_, err = io.ReadFull(conn, buf)
+		assert.NilError(t, err)
+		assert.Equal(t, string(buf), "ping")
+		assert.NilError(t, conn.Close())
+
+		assert.NilError(t, c.CancelForward(context.Background(), local, remote))
+		_, err = os.Stat(local)
+		assert.Assert(t, errors.Is(err, os.ErrNotExist))
+		assert.ErrorContains(t, c.CancelForward(context.Background(), local, remote), "not forwarded")
+	}
+}
+
+func TestNativeClientHostKeyMismatch(t *testing.T) {
+	c := newTestClient(t, ssh.FixedHostKey(newSigner(t).PublicKey()))
+	err := c.Forward(context.Background(), filepath.Join(t.TempDir(), "local.sock"), "/run/remote.sock")
+	assert.ErrorContains(t, err, "host key mismatch")
+}
+
+func TestPinnedHostKey(t *testing.T) {
+	hostKey, otherKey := newSigner(t).PublicKey(), newSigner(t).PublicKey()
+	knownHosts := filepath.Join(t.TempDir(), "known_hosts")
+	content := "macvz-other " + string(ssh.MarshalAuthorizedKey(otherKey)) +
+		"macvz-default " + string(ssh.MarshalAuthorizedKey(hostKey))
+	assert.NilError(t, os.WriteFile(knownHosts, []byte(content), 0o644))
+
+	callback, algorithms, err := pinnedHostKey(knownHosts, "macvz-default")
+	assert.NilError(t, err)
+	assert.DeepEqual(t, algorithms, []string{ssh.KeyAlgoED25519})
+	addr := &net.TCPAddr{IP: net.IPv4(192, 168, 64, 2), Port: 22}
+	assert.NilError(t, callback("192.168.64.2:22", addr, hostKey))
+	assert.ErrorContains(t, callback("192.168.64.2:22", addr, otherKey), "does not match")
+
+	_, _, err = pinnedHostKey(knownHosts, "macvz-unknown")
+	assert.ErrorContains(t, err, "no host key")
+}
+
+func TestNativeClientCloseWhileDialing(t *testing.T) {
+	// the server accepts the connections but never completes the handshake
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NilError(t, err)
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err == nil {
+			accepted <- conn
+		}
+	}()
+	t.Cleanup(func() { _ = ln.Close() })
+	c := NewNativeClient(&ssh.ClientConfig{
+		User:            "user",
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	}, func() (string, error) { return ln.Addr().String(), nil })
+
+	errCh := make(chan error, 1)
+	go func() {
+		_, _, err := c.ExecuteScript(context.Background(), "#!/bin/sh\ntrue\n", "true")
+		errCh <- err
+	}()
+	conn := <-accepted
+	closed := make(chan struct{})
+	go func() {
+		_ = c.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Close blocked while the connection was being established")
+	}
+	_ = conn.Close()
+	assert.Assert(t, <-errCh != nil)
+}
@@ -0,0 +1,70 @@
+// Package sshclient connects the host agent to the SSH server of the guest, for forwarding local addresses
+// to the guest and for running scripts in the guest.
+//
+// The exec client runs the ssh binary over a control master, while the native client
+// speaks SSH in-process with golang.org/x/crypto/ssh.
+package sshclient
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Client is an SSH connection to the guest
+type Client interface {
+	// Forward forwards local to remote in the guest.
+	// Both may be either a TCP address or the path of a unix socket, which must be absolute.
+	Forward(ctx context.Context, local, remote string) error
+	// CancelForward cancels the forwarding of local to remote set up by Forward
+	CancelForward(ctx context.Context, local, remote string) error
+	// ExecuteScript runs script in the guest with the interpreter of its shebang, e.g. "#!/bin/bash".
+	// description is used only for the readability of the errors.
+	ExecuteScript(ctx context.Context, script, description string) (stdout, stderr string, err error)
+	// Close cancels the forwards and closes the connection
+	Close() error
+}
+
+// AddrFunc returns the address of the SSH server of the guest, e.g. "192.168.64.2:22".
+// It is called on each connection, as the address of the guest is only known once it has booted.
+type AddrFunc func() (string, error)
+
+func isUnixSocket(addr string) bool {
+	return strings.HasPrefix(addr, "/")
+}
+
+// prepareUnixSocket removes the socket left over at local, and creates its directory
+func prepareUnixSocket(local, remote string) error {
+	logrus.Infof("Forwarding %q (guest) to %q (host)", remote, local)
+	if err := os.RemoveAll(local); err != nil {
+		logrus.WithError(err).Warnf("Failed to clean up %q (host) before setting up forwarding", local)
+	}
+	if err := os.MkdirAll(filepath.Dir(local), 0750); err != nil {
+		return fmt.Errorf("can't create directory for local socket %q: %w", local, err)
+	}
+	return nil
+}
+
+// removeUnixSocket removes the socket at local once its forwarding is cancelled
+func removeUnixSocket(local string) {
+	if err := os.RemoveAll(local); err != nil {
+		logrus.WithError(err).Warnf("Failed to clean up %q (host) after stopping forwarding", local)
+	}
+}
+
+func splitHostPort(addr string) (string, int, error) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", 0, err
+	}
+	port, err := net.LookupPort("tcp", portStr)
+	if err != nil {
+		return "", 0, err
+	}
+	return host, port, nil
+}
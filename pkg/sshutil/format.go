@@ -0,0 +1,82 @@
+package sshutil
+
+import (
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/alessio/shellescape"
+)
+
+// FormatT is the format of the output of Format
+type FormatT = string
+
+const (
+	// FormatCmd prints the full ssh command line, e.g.
+	//  ssh -F /dev/null -o 'IdentityFile="/Users/example/.macvz/_config/user"' -o User=example -o Hostname=192.168.64.2 macvz-default
+	FormatCmd = FormatT("cmd")
+	// FormatArgs is like FormatCmd, but only prints the args, e.g.
+	//  -F /dev/null -o 'IdentityFile="/Users/example/.macvz/_config/user"' -o User=example -o Hostname=192.168.64.2
+	FormatArgs = FormatT("args")
+	// FormatOptions prints the options, one per line, e.g.
+	//  IdentityFile="/Users/example/.macvz/_config/user"
+	//  User=example
+	//  Hostname=192.168.64.2
+	FormatOptions = FormatT("options")
+	// FormatConfig prints a Host stanza of ssh_config(5), e.g.
+	//  Host macvz-default
+	//    IdentityFile "/Users/example/.macvz/_config/user"
+	//    User example
+	//    Hostname 192.168.64.2
+	FormatConfig = FormatT("config")
+)
+
+// Formats are the formats supported by Format
+var Formats = []FormatT{FormatCmd, FormatArgs, FormatOptions, FormatConfig}
+
+// HostAlias returns the name of the instance instName in the output of Format
+func HostAlias(instName string) string {
+	return "macvz-" + instName
+}
+
+// Format writes opts, as returned by SSHOpts along with the Hostname option, in format
+func Format(w io.Writer, instName string, format FormatT, opts []string) error {
+	switch format {
+	case FormatCmd, FormatArgs:
+		var args []string
+		if format == FormatCmd {
+			args = append(args, "ssh")
+		}
+		for _, arg := range SSHArgsFromOpts(opts) {
+			args = append(args, shellescape.Quote(arg))
+		}
+		if format == FormatCmd {
+			args = append(args, HostAlias(instName))
+		}
+		_, err := fmt.Fprintln(w, strings.Join(args, " "))
+		return err
+	case FormatOptions:
+		for _, o := range opts {
+			if _, err := fmt.Fprintln(w, o); err != nil {
+				return err
+			}
+		}
+		return nil
+	case FormatConfig:
+		if _, err := fmt.Fprintf(w, "Host %s\n", HostAlias(instName)); err != nil {
+			return err
+		}
+		for _, o := range opts {
+			kv := strings.SplitN(o, "=", 2)
+			if len(kv) != 2 {
+				return fmt.Errorf("unexpected option %q", o)
+			}
+			if _, err := fmt.Fprintf(w, "  %s %s\n", kv[0], kv[1]); err != nil {
+				return err
+			}
+		}
+		return nil
+	default:
+		return fmt.Errorf("unknown format %q, expected one of %v", format, Formats)
+	}
+}
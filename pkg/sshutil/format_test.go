@@ -0,0 +1,45 @@
+package sshutil
+
+import (
+	"bytes"
+	"testing"
+
+	"gotest.tools/v3/assert"
+)
+
+func TestFormat(t *testing.T) {
+	opts := []string{
+		`IdentityFile="/Users/example/.macvz/_config/user"`,
+		"User=example",
+		`ControlPath="/Users/example/.macvz/it's my $vm/ssh.sock"`,
+		"Hostname=192.168.64.2",
+	}
+	for format, expected := range map[FormatT]string{
+		FormatCmd: `ssh -F /dev/null -o 'IdentityFile="/Users/example/.macvz/_config/user"' -o User=example ` +
+			`-o 'ControlPath="/Users/example/.macvz/it'"'"'s my $vm/ssh.sock"' -o Hostname=192.168.64.2 macvz-default` + "\n",
+		FormatArgs: `-F /dev/null -o 'IdentityFile="/Users/example/.macvz/_config/user"' -o User=example ` +
+			`-o 'ControlPath="/Users/example/.macvz/it'"'"'s my $vm/ssh.sock"' -o Hostname=192.168.64.2` + "\n",
+		FormatOptions: `IdentityFile="/Users/example/.macvz/_config/user"
+User=example
+ControlPath="/Users/example/.macvz/it's my $vm/ssh.sock"
+Hostname=192.168.64.2
+`,
+		FormatConfig: `Host macvz-default
+  IdentityFile "/Users/example/.macvz/_config/user"
+  User example
+  ControlPath "/Users/example/.macvz/it's my $vm/ssh.sock"
+  Hostname 192.168.64.2
+`,
+	} {
+		t.Run(format, func(t *testing.T) {
+			var buf bytes.Buffer
+			assert.NilError(t, Format(&buf, "default", format, opts))
+			assert.Equal(t, buf.String(), expected)
+		})
+	}
+}
+
+func TestFormatUnknown(t *testing.T) {
+	var buf bytes.Buffer
+	assert.ErrorContains(t, Format(&buf, "default", "json", nil), `unknown format "json"`)
+}
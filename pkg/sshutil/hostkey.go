@@ -0,0 +1,60 @@
+package sshutil
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/mac-vz/macvz/pkg/store/filenames"
+	"github.com/sirupsen/logrus"
+)
+
+// HostKey is the SSH host key of the guest of an instance.
+// It is generated on the host, so that the guest can be authenticated even though its IP is recycled by DHCP.
+type HostKey struct {
+	// Private is in the OpenSSH format, as installed in the guest by cloud-init
+	Private string
+	// Public is in the authorized_keys format, e.g. "ssh-ed25519 AAAA... macvz-default"
+	Public string
+}
+
+// EnsureHostKey returns the host key of the instance in instDir, which is generated if it does not yet exist.
+// The key is pinned in filenames.SSHKnownHosts for HostAlias, see CommonOpts.
+func EnsureHostKey(instDir string) (*HostKey, error) {
+	instName := filepath.Base(instDir)
+	privateKeyPath := filepath.Join(instDir, filenames.SSHHostKey)
+	if _, err := os.Stat(privateKeyPath); err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			return nil, err
+		}
+		keygenCmd := exec.Command("ssh-keygen", "-t", "ed25519", "-q", "-N", "", "-C", HostAlias(instName), "-f", privateKeyPath)
+		logrus.Debugf("executing %v", keygenCmd.Args)
+		if out, err := keygenCmd.CombinedOutput(); err != nil {
+			return nil, fmt.Errorf("failed to run %v: %q: %w", keygenCmd.Args, string(out), err)
+		}
+	}
+	private, err := os.ReadFile(privateKeyPath)
+	if err != nil {
+		return nil, err
+	}
+	public, err := readPublicKey(filepath.Join(instDir, filenames.SSHHostKeyPub))
+	if err != nil {
+		return nil, err
+	}
+	fields := strings.Fields(public.Content)
+	if len(fields) < 2 {
+		return nil, fmt.Errorf("public key %q doesn't seem to be in ssh format", public.Filename)
+	}
+	// written every time, as the instances created by older versions of macvz have the key but not the file
+	knownHosts := fmt.Sprintf("%s %s %s\n", HostAlias(instName), fields[0], fields[1])
+	if err := os.WriteFile(filepath.Join(instDir, filenames.SSHKnownHosts), []byte(knownHosts), 0o644); err != nil {
+		return nil, err
+	}
+	return &HostKey{
+		Private: string(private),
+		Public:  public.Content,
+	}, nil
+}
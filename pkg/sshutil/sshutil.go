@@ -16,6 +16,7 @@ import (
 	"sync"
 
 	"github.com/coreos/go-semver/semver"
+	"github.com/mac-vz/macvz/pkg/guestip"
 	"github.com/mac-vz/macvz/pkg/lockutil"
 	"github.com/mac-vz/macvz/pkg/store/dirnames"
 	"github.com/mac-vz/macvz/pkg/store/filenames"
@@ -117,38 +118,32 @@ var sshInfo struct {
 	openSSHVersion semver.Version
 }
 
-func SSHRemoteUser(macaddr string) string {
-	ip, err := osutil.GetIPFromMac(macaddr)
+// SSHRemoteUser returns user@IP for the guest with macaddr of the instance in instDir, see guestip.Lookup
+func SSHRemoteUser(instDir, macaddr, user string) (string, error) {
+	ip, err := guestip.Lookup(instDir, macaddr)
 	if err != nil {
-		logrus.Error("Unable to get IP from mac", err)
+		return "", fmt.Errorf("failed to resolve the IP address of the guest: %w", err)
 	}
-	user, err := osutil.MacVZUser(true)
-	if err != nil {
-		logrus.Error("Unable to get current user", err)
-	}
-	return user.Username + "@" + ip
+	return user + "@" + ip, nil
 }
 
-// SSHOpts adds the following options to CommonOptions: User, ControlMaster, ControlPath, ControlPersist
-func SSHOpts(instDir string, useDotSSH, forwardAgent bool) ([]string, error) {
+// SSHOpts adds the following options to CommonOptions: User, Port, ControlMaster, ControlPath, ControlPersist.
+// user and port are the ones of `user.name` and `ssh.port` in macvz.yaml.
+func SSHOpts(instDir, user string, port int, useDotSSH, forwardAgent bool) ([]string, error) {
 	controlSock := filepath.Join(instDir, filenames.SSHSock)
 	if len(controlSock) >= osutil.UnixPathMax {
 		return nil, fmt.Errorf("socket path %q is too long: >= UNIX_PATH_MAX=%d", controlSock, osutil.UnixPathMax)
 	}
 
-	u, err := osutil.MacVZUser(false)
-	if err != nil {
-		return nil, err
-	}
-
 	//Run generation of public keys, so it can be used in common opts
 	_, _ = DefaultPubKeys(true)
-	opts, err := CommonOpts(useDotSSH)
+	opts, err := CommonOpts(instDir, useDotSSH)
 	if err != nil {
 		return nil, err
 	}
 	opts = append(opts,
-		fmt.Sprintf("User=%s", u.Username), // guest and host have the same username, but we should specify the username explicitly (#85)
+		fmt.Sprintf("User=%s", user), // guest and host have the same username by default, but we should specify the username explicitly (#85)
+		fmt.Sprintf("Port=%d", port),
 		"ControlMaster=auto",
 		fmt.Sprintf("ControlPath=\"%s\"", controlSock),
 		"ControlPersist=5m",
@@ -169,12 +164,8 @@ func SSHArgsFromOpts(opts []string) []string {
 	return args
 }
 
-// CommonOpts returns ssh option key-value pairs like {"IdentityFile=/path/to/id_foo"}.
-// The result may contain different values with the same key.
-//
-// The result always contains the IdentityFile option.
-// The result never contains the Port option.
-func CommonOpts(useDotSSH bool) ([]string, error) {
+// IdentityFiles returns the private key $MACVZ_HOME/_config/user, followed by the private keys of ~/.ssh/*.pub when useDotSSH is true
+func IdentityFiles(useDotSSH bool) ([]string, error) {
 	configDir, err := dirnames.MacVZConfigDir()
 	if err != nil {
 		return nil, err
@@ -184,7 +175,7 @@ func CommonOpts(useDotSSH bool) ([]string, error) {
 	if err != nil {
 		return nil, err
 	}
-	opts := []string{"IdentityFile=\"" + privateKeyPath + "\""}
+	res := []string{privateKeyPath}
 
 	// Append all private keys corresponding to ~/.ssh/*.pub to keep old instances working
 	// that had been created before lima started using an internal identity.
@@ -215,13 +206,46 @@ func CommonOpts(useDotSSH bool) ([]string, error) {
 				// Fail on permission-related and other path errors
 				return nil, err
 			}
-			opts = append(opts, "IdentityFile=\""+privateKeyPath+"\"")
+			res = append(res, privateKeyPath)
 		}
 	}
+	return res, nil
+}
+
+// CommonOpts returns ssh option key-value pairs like {"IdentityFile=/path/to/id_foo"}.
+// The result may contain different values with the same key.
+//
+// The result always contains the IdentityFile option.
+// The result never contains the Port option.
+//
+// The host key of the guest is checked against the one pinned by EnsureHostKey, for the alias of the instance,
+// as its IP address may have been leased to another guest before.
+func CommonOpts(instDir string, useDotSSH bool) ([]string, error) {
+	identityFiles, err := IdentityFiles(useDotSSH)
+	if err != nil {
+		return nil, err
+	}
+	var opts []string
+	for _, f := range identityFiles {
+		opts = append(opts, "IdentityFile=\""+f+"\"")
+	}
 
+	knownHosts := filepath.Join(instDir, filenames.SSHKnownHosts)
+	if _, err := os.Stat(knownHosts); err == nil {
+		opts = append(opts,
+			"StrictHostKeyChecking=yes",
+			fmt.Sprintf("UserKnownHostsFile=\"%s\"", knownHosts),
+			"HostKeyAlias="+HostAlias(filepath.Base(instDir)),
+		)
+	} else {
+		// The guest of an instance started by an older version of macvz generated its own host key
+		logrus.Debugf("%q does not exist, the host key of the guest cannot be checked until the instance is restarted", knownHosts)
+		opts = append(opts,
+			"StrictHostKeyChecking=no",
+			"UserKnownHostsFile=/dev/null",
+		)
+	}
 	opts = append(opts,
-		"StrictHostKeyChecking=no",
-		"UserKnownHostsFile=/dev/null",
 		"NoHostAuthenticationForLocalhost=yes",
 		"GSSAPIAuthentication=no",
 		"PreferredAuthentications=publickey",
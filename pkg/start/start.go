@@ -5,6 +5,7 @@ import (
 	"errors"
 	"fmt"
 	hostagentevents "github.com/mac-vz/macvz/pkg/hostagent/events"
+	"github.com/mac-vz/macvz/pkg/lockutil"
 	"os"
 	"os/exec"
 	"path/filepath"
@@ -18,7 +19,7 @@ import (
 )
 
 func ensureDisk(ctx context.Context, instName, instDir string, y *yaml.MacVZYaml) error {
-	vmCfg := vzrun.VM{
+	vmCfg := &vzrun.VM{
 		Name:        instName,
 		InstanceDir: instDir,
 		MacVZYaml:   y,
@@ -81,13 +82,17 @@ func Start(ctx context.Context, inst *store.Instance) error {
 	vzCmd.Stdout = haStdoutW
 	vzCmd.Stderr = haStderrW
 
-	// used for logrus propagation
-
-	if err := vzCmd.Start(); err != nil {
-		return err
-	}
-
-	if err := waitHostAgentStart(ctx, vzPid, haStderrPath); err != nil {
+	// Hold the lock of the instance directory until the pid file appears, so that
+	// `macvz delete` cannot remove the instance while it is being launched.
+	if err := lockutil.WithDirLock(inst.Dir, func() error {
+		if _, err := os.Stat(filepath.Join(inst.Dir, filenames.MacVZYAML)); err != nil {
+			return fmt.Errorf("instance %q seems deleted: %w", inst.Name, err)
+		}
+		if err := vzCmd.Start(); err != nil {
+			return err
+		}
+		return waitHostAgentStart(ctx, vzPid, haStderrPath)
+	}); err != nil {
 		return err
 	}
 	begin := time.Now() // used for logrus propagation
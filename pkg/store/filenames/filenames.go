@@ -32,13 +32,25 @@ const (
 
 	HaStdoutLog = "ha.stdout.log"
 	HaStderrLog = "ha.stderr.log"
+	HaSock      = "ha.sock"
 
 	VZPid       = "vz.pid"
 	VZStdoutLog = "vz.stdout.log"
 	VZStderrLog = "vz.stderr.log"
 
+	// GuestIP caches the IP address of the guest, resolved by the host agent
+	GuestIP = "guest_ip"
+	// GuestInfo is the latest types.GuestInfo reported by the guest agent, saved by the host agent
+	GuestInfo = "guest_info.json"
+
 	SSHSock   = "ssh.sock"
 	SocketDir = "sockets"
+
+	// SSHHostKey is the private host key of the guest, generated on the host and installed by cloud-init
+	SSHHostKey    = "ssh_host_ed25519_key"
+	SSHHostKeyPub = SSHHostKey + ".pub"
+	// SSHKnownHosts pins SSHHostKeyPub, see sshutil.CommonOpts
+	SSHKnownHosts = "ssh_known_hosts"
 )
 
 // LongestSock is the longest socket name.
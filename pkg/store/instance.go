@@ -1,12 +1,17 @@
 package store
 
 import (
+	"encoding/json"
 	"errors"
 	"github.com/docker/go-units"
+	"github.com/mac-vz/macvz/pkg/guestip"
+	"github.com/mac-vz/macvz/pkg/store/dirnames"
 	"github.com/mac-vz/macvz/pkg/store/filenames"
+	"github.com/mac-vz/macvz/pkg/types"
 	"github.com/mac-vz/macvz/pkg/yaml"
 	"os"
 	"path/filepath"
+	"runtime"
 	"strconv"
 	"strings"
 	"syscall"
@@ -29,10 +34,31 @@ type Instance struct {
 	Memory int64  `json:"memory,omitempty"` // bytes
 	Disk   int64  `json:"disk,omitempty"`   // bytes
 
+	// IPAddress is the guest address leased by the host DHCP server, only set while running
+	IPAddress string `json:"ipAddress,omitempty"`
+	// Guest is the latest information reported by the guest agent, only set while running
+	Guest *types.GuestInfo `json:"guest,omitempty"`
+
 	VZPid  int     `json:"VZPid,omitempty"`
 	Errors []error `json:"errors,omitempty"`
 }
 
+// MarshalJSON marshals the errors as their messages, as an error is usually marshaled as {}
+func (inst *Instance) MarshalJSON() ([]byte, error) {
+	type alias Instance
+	errs := make([]string, len(inst.Errors))
+	for i, err := range inst.Errors {
+		errs[i] = err.Error()
+	}
+	return json.Marshal(&struct {
+		*alias
+		Errors []string `json:"errors,omitempty"`
+	}{
+		alias:  (*alias)(inst),
+		Errors: errs,
+	})
+}
+
 func (inst *Instance) LoadYAML() (*yaml.MacVZYaml, error) {
 	if inst.Dir == "" {
 		return nil, errors.New("inst.Dir is empty")
@@ -86,17 +112,56 @@ func Inspect(instName string) (*Instance, error) {
 		}
 	}
 
+	if inst.Status == StatusRunning {
+		// The lease may not be available yet while the guest is still booting
+		inst.IPAddress, _ = guestip.Lookup(instDir, *y.MACAddress)
+		inst.Guest = readGuestInfo(instDir)
+	}
+
 	return inst, nil
 }
 
+// readGuestInfo returns the info saved by the host agent, or nil until the guest agent reports it
+func readGuestInfo(instDir string) *types.GuestInfo {
+	b, err := os.ReadFile(filepath.Join(instDir, filenames.GuestInfo))
+	if err != nil {
+		return nil
+	}
+	var info types.GuestInfo
+	if err := json.Unmarshal(b, &info); err != nil {
+		return nil
+	}
+	return &info
+}
+
+// FormatData is the data passed to the Go templates of `macvz list --format`
 type FormatData struct {
 	Instance
 	HostOS       string
 	HostArch     string
-	LimaHome     string
+	MacVZHome    string
 	IdentityFile string
 }
 
+// AddGlobalFields wraps the instance with the host-wide fields of FormatData
+func AddGlobalFields(inst *Instance) (FormatData, error) {
+	var data FormatData
+	data.Instance = *inst
+	data.HostOS = runtime.GOOS
+	data.HostArch = yaml.NewArch(runtime.GOARCH)
+	macvzHome, err := dirnames.MacVZDir()
+	if err != nil {
+		return data, err
+	}
+	data.MacVZHome = macvzHome
+	configDir, err := dirnames.MacVZConfigDir()
+	if err != nil {
+		return data, err
+	}
+	data.IdentityFile = filepath.Join(configDir, filenames.UserPrivateKey)
+	return data, nil
+}
+
 func ReadPIDFile(path string) (int, error) {
 	b, err := os.ReadFile(path)
 	if err != nil {
@@ -0,0 +1,268 @@
+// Package tarutil streams files as tar archives, preserving their permissions and modification times,
+// for copying them between the host and the guest.
+package tarutil
+
+import (
+	"archive/tar"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Writer writes files to a tar archive
+type Writer struct {
+	tw *tar.Writer
+}
+
+// NewWriter creates a Writer
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{tw: tar.NewWriter(w)}
+}
+
+// Add writes src to the archive as name, along with its content when it is a directory and recursive is true.
+// Regular files, directories and symbolic links are supported.
+func (w *Writer) Add(src, name string, recursive bool) error {
+	fi, err := os.Lstat(src)
+	if err != nil {
+		return err
+	}
+	if fi.IsDir() && !recursive {
+		return fmt.Errorf("%q is a directory (not copied)", src)
+	}
+	if !fi.IsDir() {
+		return w.addFile(src, name, fi)
+	}
+	return filepath.Walk(src, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, p)
+		if err != nil {
+			return err
+		}
+		return w.addFile(p, path.Join(name, filepath.ToSlash(rel)), fi)
+	})
+}
+
+func (w *Writer) addFile(src, name string, fi os.FileInfo) error {
+	var link string
+	switch {
+	case fi.Mode().IsRegular(), fi.IsDir():
+	case fi.Mode()&os.ModeSymlink != 0:
+		var err error
+		if link, err = os.Readlink(src); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("%q is not a regular file, a directory or a symbolic link", src)
+	}
+	hdr, err := tar.FileInfoHeader(fi, link)
+	if err != nil {
+		return err
+	}
+	hdr.Name = name
+	if fi.IsDir() {
+		hdr.Name += "/"
+	}
+	// rounding up would set the time in the future
+	hdr.ModTime = hdr.ModTime.Truncate(time.Second)
+	// the owner is that of the user extracting the archive
+	hdr.Uid, hdr.Gid, hdr.Uname, hdr.Gname = 0, 0, "", ""
+	if err := w.tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	if !fi.Mode().IsRegular() {
+		return nil
+	}
+	f, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.Copy(w.tw, f)
+	return err
+}
+
+// Close writes the end of the archive
+func (w *Writer) Close() error {
+	return w.tw.Close()
+}
+
+// ExtractOptions are the options of Extract
+type ExtractOptions struct {
+	// Name replaces the first element of the names of the entries, unless empty
+	Name string
+	// NoDirectories fails on directories, for copying files only
+	NoDirectories bool
+}
+
+// Extract extracts the archive read from r under dir, preserving the permissions and the modification times.
+// The entries must not escape dir.
+func Extract(r io.Reader, dir string, opts ExtractOptions) error {
+	root, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return err
+	}
+	type dirTimes struct {
+		path    string
+		mode    os.FileMode
+		modTime time.Time
+	}
+	// the permissions and the times of the directories are set once their content is extracted
+	var dirs []dirTimes
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		name, err := entryName(hdr.Name, opts.Name)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(root, filepath.FromSlash(name))
+		if err := checkParent(root, target); err != nil {
+			return err
+		}
+		mode := hdr.FileInfo().Mode()
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if opts.NoDirectories {
+				return fmt.Errorf("%q is a directory (not copied)", hdr.Name)
+			}
+			if err := mkdir(target); err != nil {
+				return err
+			}
+			dirs = append(dirs, dirTimes{path: target, mode: mode.Perm(), modTime: hdr.ModTime})
+		case tar.TypeReg:
+			// do not write through a symbolic link
+			if fi, err := os.Lstat(target); err == nil && fi.Mode()&os.ModeSymlink != 0 {
+				if err := os.Remove(target); err != nil {
+					return err
+				}
+			}
+			if err := extractFile(tr, target, mode.Perm()); err != nil {
+				return err
+			}
+			if err := os.Chtimes(target, hdr.ModTime, hdr.ModTime); err != nil {
+				return err
+			}
+		case tar.TypeSymlink:
+			if err := os.Remove(target); err != nil && !errors.Is(err, os.ErrNotExist) {
+				return err
+			}
+			if err := os.Symlink(hdr.Linkname, target); err != nil {
+				return err
+			}
+		case tar.TypeLink:
+			// tar -c archives the hard links of a tree as links to their first entry
+			if err := extractLink(root, target, hdr.Linkname, opts.Name); err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("%q is not a regular file, a directory, a symbolic link or a hard link", hdr.Name)
+		}
+	}
+	for i := len(dirs) - 1; i >= 0; i-- {
+		if err := os.Chmod(dirs[i].path, dirs[i].mode); err != nil {
+			return err
+		}
+		if err := os.Chtimes(dirs[i].path, dirs[i].modTime, dirs[i].modTime); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// entryName returns the relative name of an entry, with its first element replaced by rename unless empty
+func entryName(name, rename string) (string, error) {
+	cleaned := path.Clean(strings.TrimPrefix(name, "./"))
+	if path.IsAbs(cleaned) || cleaned == ".." || strings.HasPrefix(cleaned, "../") {
+		return "", fmt.Errorf("entry %q escapes the destination", name)
+	}
+	if rename == "" {
+		return cleaned, nil
+	}
+	if i := strings.Index(cleaned, "/"); i >= 0 {
+		return rename + cleaned[i:], nil
+	}
+	return rename, nil
+}
+
+// checkParent fails if the parent of target resolves out of root, e.g. through a symbolic link of the archive
+func checkParent(root, target string) error {
+	parent, err := filepath.EvalSymlinks(filepath.Dir(target))
+	if err != nil {
+		return err
+	}
+	if parent != root && !strings.HasPrefix(parent, root+string(filepath.Separator)) {
+		return fmt.Errorf("%q escapes the destination through a symbolic link", target)
+	}
+	return nil
+}
+
+// mkdir creates the directory target, unless it exists.
+// An existing symbolic link is replaced, as the permissions of the directory would be set through it.
+func mkdir(target string) error {
+	fi, err := os.Lstat(target)
+	switch {
+	case err == nil && fi.IsDir():
+		return nil
+	case err == nil && fi.Mode()&os.ModeSymlink != 0:
+		if err := os.Remove(target); err != nil {
+			return err
+		}
+	case err == nil:
+		return fmt.Errorf("%q exists and is not a directory", target)
+	case !errors.Is(err, os.ErrNotExist):
+		return err
+	}
+	return os.Mkdir(target, 0o700)
+}
+
+// extractLink creates target as a hard link to the regular file linkname of the archive, which must be under root
+func extractLink(root, target, linkname, rename string) error {
+	name, err := entryName(linkname, rename)
+	if err != nil {
+		return err
+	}
+	source := filepath.Join(root, filepath.FromSlash(name))
+	if err := checkParent(root, source); err != nil {
+		return err
+	}
+	fi, err := os.Lstat(source)
+	if err != nil {
+		return err
+	}
+	if !fi.Mode().IsRegular() {
+		return fmt.Errorf("%q links to %q, which is not a regular file", target, linkname)
+	}
+	if err := os.Remove(target); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return os.Link(source, target)
+}
+
+func extractFile(r io.Reader, target string, perm os.FileMode) error {
+	f, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, r); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	// the file may already exist with other permissions
+	return os.Chmod(target, perm)
+}
@@ -0,0 +1,137 @@
+package tarutil
+
+import (
+	"archive/tar"
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"gotest.tools/v3/assert"
+)
+
+func TestRoundTrip(t *testing.T) {
+	src := t.TempDir()
+	modTime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	assert.NilError(t, os.MkdirAll(filepath.Join(src, "dir", "sub"), 0o755))
+	assert.NilError(t, os.WriteFile(filepath.Join(src, "dir", "script.sh"), []byte("#!/bin/sh\n"), 0o750))
+	assert.NilError(t, os.WriteFile(filepath.Join(src, "dir", "sub", "secret"), []byte("secret"), 0o600))
+	assert.NilError(t, os.Symlink("script.sh", filepath.Join(src, "dir", "link")))
+	assert.NilError(t, os.Chtimes(filepath.Join(src, "dir", "script.sh"), modTime, modTime))
+	assert.NilError(t, os.Chmod(filepath.Join(src, "dir", "sub"), 0o711))
+
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	assert.NilError(t, w.Add(filepath.Join(src, "dir"), "dir", true))
+	assert.NilError(t, w.Close())
+
+	dst := t.TempDir()
+	assert.NilError(t, Extract(&buf, dst, ExtractOptions{Name: "renamed"}))
+
+	fi, err := os.Stat(filepath.Join(dst, "renamed", "script.sh"))
+	assert.NilError(t, err)
+	assert.Equal(t, fi.Mode().Perm(), os.FileMode(0o750))
+	assert.Assert(t, fi.ModTime().Equal(modTime))
+	b, err := os.ReadFile(filepath.Join(dst, "renamed", "sub", "secret"))
+	assert.NilError(t, err)
+	assert.Equal(t, string(b), "secret")
+	fi, err = os.Stat(filepath.Join(dst, "renamed", "sub"))
+	assert.NilError(t, err)
+	assert.Equal(t, fi.Mode().Perm(), os.FileMode(0o711))
+	link, err := os.Readlink(filepath.Join(dst, "renamed", "link"))
+	assert.NilError(t, err)
+	assert.Equal(t, link, "script.sh")
+}
+
+func TestAddDirectoryNotRecursive(t *testing.T) {
+	var buf bytes.Buffer
+	err := NewWriter(&buf).Add(t.TempDir(), "dir", false)
+	assert.ErrorContains(t, err, "is a directory")
+}
+
+func TestExtractNoDirectories(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	assert.NilError(t, w.Add(t.TempDir(), "dir", true))
+	assert.NilError(t, w.Close())
+	err := Extract(&buf, t.TempDir(), ExtractOptions{NoDirectories: true})
+	assert.ErrorContains(t, err, "is a directory")
+}
+
+func TestExtractEscape(t *testing.T) {
+	for name, entries := range map[string][]tar.Header{
+		"dotdot": {
+			{Typeflag: tar.TypeReg, Name: "../escaped", Mode: 0o644},
+		},
+		"symlink": {
+			{Typeflag: tar.TypeSymlink, Name: "link", Linkname: "/tmp"},
+			{Typeflag: tar.TypeReg, Name: "link/escaped", Mode: 0o644},
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			var buf bytes.Buffer
+			tw := tar.NewWriter(&buf)
+			for _, hdr := range entries {
+				hdr := hdr
+				assert.NilError(t, tw.WriteHeader(&hdr))
+			}
+			assert.NilError(t, tw.Close())
+			err := Extract(&buf, t.TempDir(), ExtractOptions{})
+			assert.ErrorContains(t, err, "escapes the destination")
+		})
+	}
+}
+
+func writeArchive(t *testing.T, entries []tar.Header) *bytes.Buffer {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, hdr := range entries {
+		hdr := hdr
+		assert.NilError(t, tw.WriteHeader(&hdr))
+		if hdr.Typeflag == tar.TypeReg {
+			_, err := tw.Write(make([]byte, hdr.Size))
+			assert.NilError(t, err)
+		}
+	}
+	assert.NilError(t, tw.Close())
+	return &buf
+}
+
+func TestExtractDirectoryOverSymlink(t *testing.T) {
+	victim := t.TempDir()
+	assert.NilError(t, os.Chmod(victim, 0o700))
+	dst := t.TempDir()
+	err := Extract(writeArchive(t, []tar.Header{
+		{Typeflag: tar.TypeSymlink, Name: "d", Linkname: victim},
+		{Typeflag: tar.TypeDir, Name: "d/", Mode: 0o777},
+	}), dst, ExtractOptions{})
+	assert.NilError(t, err)
+
+	fi, err := os.Stat(victim)
+	assert.NilError(t, err)
+	assert.Equal(t, fi.Mode().Perm(), os.FileMode(0o700))
+	fi, err = os.Lstat(filepath.Join(dst, "d"))
+	assert.NilError(t, err)
+	assert.Assert(t, fi.IsDir())
+}
+
+func TestExtractHardLink(t *testing.T) {
+	dst := t.TempDir()
+	err := Extract(writeArchive(t, []tar.Header{
+		{Typeflag: tar.TypeDir, Name: "dir/", Mode: 0o755},
+		{Typeflag: tar.TypeReg, Name: "dir/file", Mode: 0o644, Size: 4},
+		{Typeflag: tar.TypeLink, Name: "dir/link", Linkname: "dir/file"},
+	}), dst, ExtractOptions{Name: "renamed"})
+	assert.NilError(t, err)
+	file, err := os.Stat(filepath.Join(dst, "renamed", "file"))
+	assert.NilError(t, err)
+	link, err := os.Stat(filepath.Join(dst, "renamed", "link"))
+	assert.NilError(t, err)
+	assert.Assert(t, os.SameFile(file, link))
+
+	err = Extract(writeArchive(t, []tar.Header{
+		{Typeflag: tar.TypeLink, Name: "link", Linkname: "../escaped"},
+	}), t.TempDir(), ExtractOptions{})
+	assert.ErrorContains(t, err, "escapes the destination")
+}
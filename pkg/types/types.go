@@ -3,6 +3,7 @@ package types
 import (
 	"net"
 	"strconv"
+	"time"
 )
 
 //Kind Enum that defines the type of message
@@ -17,6 +18,46 @@ const (
 	DNSMessage Kind = "dns-event"
 	//DNSResponseMessage DNSEventResponse kind
 	DNSResponseMessage Kind = "dns-event-response"
+	//ConnectMessage ConnectEvent kind
+	ConnectMessage Kind = "connect-event"
+	//ConnectResponseMessage ConnectEventResponse kind
+	ConnectResponseMessage Kind = "connect-event-response"
+	//HelloMessage HelloEvent kind, sent by guest
+	HelloMessage Kind = "hello"
+	//HelloResponseMessage HelloEvent kind, sent by host in reply to HelloMessage
+	HelloResponseMessage Kind = "hello-response"
+	//ExecMessage ExecEvent kind
+	ExecMessage Kind = "exec-event"
+	//ExecResponseMessage ExecEventResponse kind
+	ExecResponseMessage Kind = "exec-event-response"
+	//StatsMessage StatsEvent kind, sent by guest to host agents that list it in their HelloEvent
+	StatsMessage Kind = "stats-event"
+	//TimeMessage TimeEvent kind, sent by host to guest agents with CapabilityTimeSync
+	TimeMessage Kind = "time-event"
+	//TimeResponseMessage TimeEventResponse kind
+	TimeResponseMessage Kind = "time-event-response"
+)
+
+//ProtocolVersion Version of the protocol between guest agent and host agent.
+//Incremented on incompatible changes only; new features are negotiated with Capability.
+//Version 2 wraps the messages in the envelope of pkg/socket
+const ProtocolVersion = 2
+
+//Capability Enum that defines an optional feature of an agent
+type Capability = string
+
+const (
+	//CapabilityConnect Guest agent handles ConnectEvent for TCP and unix sockets
+	CapabilityConnect Capability = "connect"
+	//CapabilityConnectUDP Guest agent handles ConnectEvent for UDP, with datagrams framed by socket.WriteDatagram
+	CapabilityConnectUDP Capability = "connect-udp"
+	//CapabilityUDPPorts Guest agent reports UDP ports in PortEvent
+	CapabilityUDPPorts Capability = "udp-ports"
+	//CapabilityExec Guest agent handles ExecEvent
+	CapabilityExec Capability = "exec"
+	//CapabilityTimeSync Guest agent handles TimeEvent, and host agent sends it.
+	//The guest agent falls back to the RTC while connected to a host agent without it
+	CapabilityTimeSync Capability = "time-sync"
 )
 
 //Event base type for all event
@@ -24,11 +65,103 @@ type Event struct {
 	Kind Kind `json:"kind"`
 }
 
-//InfoEvent used by guest to send negotitation request
+//InfoEvent used by guest to send negotitation request, once connected.
+//LocalPorts is the snapshot of the ports, which host reconciles its forwards against
 type InfoEvent struct {
 	Event
 	GatewayIP  string   `json:"gatewayIP"`
+	GuestIP    string   `json:"guestIP,omitempty"`
 	LocalPorts []IPPort `json:"localPorts"`
+	//GuestInfo is empty for older guest agents
+	GuestInfo
+}
+
+//GuestInfo describes the system of the guest
+type GuestInfo struct {
+	OSRelease *OSRelease `json:"osRelease,omitempty"`
+	//Kernel is the release of the kernel, as in `uname -r`
+	Kernel    string           `json:"kernel,omitempty"`
+	Addresses []InterfaceAddrs `json:"addresses,omitempty"`
+	CPUs      int              `json:"cpus,omitempty"`
+	//Stats is the snapshot of the resources, updated by StatsEvent
+	Stats *Stats `json:"stats,omitempty"`
+}
+
+//OSRelease fields of /etc/os-release, see os-release(5)
+type OSRelease struct {
+	ID         string `json:"id,omitempty"`
+	VersionID  string `json:"versionID,omitempty"`
+	PrettyName string `json:"prettyName,omitempty"`
+}
+
+//InterfaceAddrs addresses of a network interface, in CIDR notation
+type InterfaceAddrs struct {
+	Name  string   `json:"name"`
+	Addrs []string `json:"addrs"`
+}
+
+//Stats resources of the guest, in bytes
+type Stats struct {
+	Time            string `json:"time"`
+	MemoryTotal     uint64 `json:"memoryTotal"`
+	MemoryAvailable uint64 `json:"memoryAvailable"`
+	//DiskTotal and DiskAvailable are the ones of the root filesystem
+	DiskTotal     uint64 `json:"diskTotal"`
+	DiskAvailable uint64 `json:"diskAvailable"`
+	//TimeCorrection is the last correction of the guest clock, if any
+	TimeCorrection *TimeCorrection `json:"timeCorrection,omitempty"`
+}
+
+//TimeSource Enum that defines the clock the guest clock is synchronized with
+type TimeSource = string
+
+const (
+	//TimeSourceHost the clock of the host, sent by TimeEvent
+	TimeSourceHost TimeSource = "host"
+	//TimeSourceRTC the RTC of the VM, with a precision of one second
+	TimeSourceRTC TimeSource = "rtc"
+)
+
+//TimeMethod Enum that defines how the guest clock is corrected
+type TimeMethod = string
+
+const (
+	//TimeMethodNone the skew is below the threshold
+	TimeMethodNone TimeMethod = "none"
+	//TimeMethodSlew the clock is gradually sped up or slowed down, with adjtimex(2)
+	TimeMethodSlew TimeMethod = "slew"
+	//TimeMethodStep the clock is set at once, with settimeofday(2)
+	TimeMethodStep TimeMethod = "step"
+)
+
+//TimeCorrection a correction of the guest clock
+type TimeCorrection struct {
+	Time   string     `json:"time"`
+	Source TimeSource `json:"source"`
+	Method TimeMethod `json:"method"`
+	//Skew is the reference clock minus the guest clock, in nanoseconds
+	Skew time.Duration `json:"skew"`
+}
+
+//TimeEvent used by host to send its clock, once the guest agent connected, periodically and after the host wakes up
+type TimeEvent struct {
+	Event
+	//Time is the host clock, in RFC3339 with nanoseconds
+	Time string `json:"time"`
+	//Threshold is the skew below which the guest clock is left as is
+	Threshold time.Duration `json:"threshold"`
+}
+
+//TimeEventResponse used by guest to report the correction of TimeEvent
+type TimeEventResponse struct {
+	Event
+	TimeCorrection
+}
+
+//StatsEvent used by guest to send the resources periodically
+type StatsEvent struct {
+	Event
+	Stats Stats `json:"stats"`
 }
 
 //PortEvent used by guest to send port binding events
@@ -52,10 +185,91 @@ type DNSEventResponse struct {
 	Msg []byte `json:"msg"`
 }
 
+//HelloEvent used by guest to open the session, and by host to reply.
+//Guest agents older than the handshake send InfoEvent first instead
+type HelloEvent struct {
+	Event
+	//Version of macvz the agent was built from, see pkg/version
+	Version         string       `json:"version"`
+	ProtocolVersion int          `json:"protocolVersion"`
+	Kinds           []Kind       `json:"kinds"`
+	Capabilities    []Capability `json:"capabilities"`
+	//Error is set by host when it refuses the guest agent
+	Error string `json:"error,omitempty"`
+}
+
+//HasCapability Returns true if the agent advertised c
+func (x *HelloEvent) HasCapability(c Capability) bool {
+	for _, cc := range x.Capabilities {
+		if cc == c {
+			return true
+		}
+	}
+	return false
+}
+
+//ConnectEvent used by host to request the guest to connect to a guest-local address.
+//Once acknowledged by ConnectEventResponse, the stream carries the raw bytes of the connection.
+//The failure to connect is the error of the response
+type ConnectEvent struct {
+	Event
+	Network string `json:"network"`
+	Address string `json:"address"`
+}
+
+//ConnectEventResponse used by guest to acknowledge ConnectEvent
+type ConnectEventResponse struct {
+	Event
+}
+
+//ExecEvent used by host to run a command in the guest.
+//Once acknowledged by ExecEventResponse, the stream carries the frames of socket.ExecFrameWriter,
+//until the exit code of the command.
+//The failure to start the command is the error of the response
+type ExecEvent struct {
+	Event
+	//Args is the command and its arguments, looked up in the PATH of the guest
+	Args []string `json:"args"`
+	//Env is appended to the environment of the user, in the form "KEY=value"
+	Env []string `json:"env,omitempty"`
+	//Dir defaults to the home of the user
+	Dir string `json:"dir,omitempty"`
+	//User defaults to root
+	User string `json:"user,omitempty"`
+	//TTY allocates a pseudo-terminal for stdin, stdout and stderr, of Rows and Cols
+	TTY  bool   `json:"tty,omitempty"`
+	Rows uint16 `json:"rows,omitempty"`
+	Cols uint16 `json:"cols,omitempty"`
+}
+
+//ExecEventResponse used by guest to acknowledge ExecEvent
+type ExecEventResponse struct {
+	Event
+}
+
+//Protocol Enum that defines the transport protocol of IPPort
+type Protocol = string
+
+const (
+	//TCP is also assumed when Protocol is empty, as sent by older guest agents
+	TCP Protocol = "tcp"
+	//UDP Protocol for datagram sockets
+	UDP Protocol = "udp"
+)
+
 //IPPort Used by PortEvent for IP and Port representation
 type IPPort struct {
-	IP   net.IP `json:"ip"`
-	Port int    `json:"port"`
+	IP       net.IP   `json:"ip"`
+	Port     int      `json:"port"`
+	Protocol Protocol `json:"protocol,omitempty"`
+}
+
+//Proto Returns the protocol, defaulting to TCP
+func (x *IPPort) Proto() Protocol {
+	if x.Protocol == "" {
+		return TCP
+	}
+	return x.Protocol
 }
 
 func (x *IPPort) String() string {
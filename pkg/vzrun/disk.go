@@ -19,7 +19,7 @@ import (
 )
 
 //EnsureDisk Creates. and verifies if the VM Disk are present
-func EnsureDisk(ctx context.Context, cfg VM) error {
+func EnsureDisk(ctx context.Context, cfg *VM) error {
 	kernelCompressed := filepath.Join(cfg.InstanceDir, filenames.KernelCompressed)
 	initrd := filepath.Join(cfg.InstanceDir, filenames.Initrd)
 	baseDisk := filepath.Join(cfg.InstanceDir, filenames.BaseDisk)
@@ -10,16 +10,15 @@ import (
 	"github.com/mac-vz/macvz/pkg/socket"
 	"github.com/mac-vz/macvz/pkg/store"
 	"github.com/mac-vz/macvz/pkg/store/filenames"
-	"github.com/mac-vz/macvz/pkg/types"
 	"github.com/mac-vz/macvz/pkg/yaml"
 	"github.com/mitchellh/go-homedir"
 	"github.com/sirupsen/logrus"
-	"io"
 	"net"
 	"os"
 	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
 )
 
 // VM VirtualMachine instance
@@ -27,14 +26,19 @@ type VM struct {
 	Name        string
 	InstanceDir string
 	MacVZYaml   *yaml.MacVZYaml
-	Handlers    map[types.Kind]func(ctx context.Context, stream *yamux.Stream, event interface{})
-	sigintCh    chan os.Signal
+	// Mux handles the requests of the guest agent
+	Mux      *socket.Mux
+	sigintCh chan os.Signal
+
+	// sess is the session with the guest agent, replaced when the guest agent reconnects
+	sess   *yamux.Session
+	sessMu sync.RWMutex
 }
 
 // InitializeVM Create a virtual machine instance
 func InitializeVM(
 	instName string,
-	handlers map[types.Kind]func(ctx context.Context, stream *yamux.Stream, event interface{}),
+	mux *socket.Mux,
 	sigintCh chan os.Signal,
 ) (*VM, error) {
 	inst, err := store.Inspect(instName)
@@ -51,14 +55,14 @@ func InitializeVM(
 		MacVZYaml:   y,
 		InstanceDir: inst.Dir,
 		Name:        inst.Name,
-		Handlers:    handlers,
+		Mux:         mux,
 		sigintCh:    sigintCh,
 	}
 	return a, nil
 }
 
 // Run Starts the VM instance
-func (vm VM) Run() error {
+func (vm *VM) Run() error {
 	y := vm.MacVZYaml
 
 	kernelCommandLineArguments := []string{
@@ -177,7 +181,7 @@ func (vm VM) Run() error {
 			result, err := machine.RequestStop()
 			if err != nil {
 				logrus.Println("request stop error:", err)
-				return nil
+				return fmt.Errorf("failed to request the guest to stop: %w", err)
 			}
 			logrus.Println("recieved signal", result)
 		case newState := <-machine.StateChangedNotify():
@@ -218,7 +222,7 @@ func (vm VM) Run() error {
 	}
 }
 
-func (vm VM) createVSockListener(ctx context.Context) (*vz.VirtioSocketListener, error) {
+func (vm *VM) createVSockListener(ctx context.Context) (*vz.VirtioSocketListener, error) {
 	connCh := make(chan *vz.VirtioSocketConnection)
 
 	go func() {
@@ -241,6 +245,9 @@ func (vm VM) createVSockListener(ctx context.Context) (*vz.VirtioSocketListener,
 				cfg.AcceptBacklog = 10
 
 				sess, _ = yamux.Client(conn, cfg)
+				vm.sessMu.Lock()
+				vm.sess = sess
+				vm.sessMu.Unlock()
 
 				go vm.handleFromGuest(ctx, sess)
 			}
@@ -257,40 +264,19 @@ func (vm VM) createVSockListener(ctx context.Context) (*vz.VirtioSocketListener,
 	return listener, nil
 }
 
-func (vm VM) handleFromGuest(ctx context.Context, sess *yamux.Session) {
-	for {
-		c, err := sess.AcceptStream()
-		if err != nil {
-			if !errors.Is(err, io.EOF) {
-				logrus.Warn("unable to accept new incoming yamux streams", "error", err)
-			}
-			return
-		}
-
-		go vm.handleGuestConn(ctx, c)
+// OpenStream opens a new stream to the guest agent, see socket.Opener
+func (vm *VM) OpenStream() (net.Conn, error) {
+	vm.sessMu.RLock()
+	sess := vm.sess
+	vm.sessMu.RUnlock()
+	if sess == nil {
+		return nil, errors.New("the guest agent is not connected")
 	}
+	return sess.Open()
 }
 
-func (vm VM) handleGuestConn(ctx context.Context, c *yamux.Stream) {
-	defer c.Close()
-
-	_, dec := socket.GetStreamIO(c)
-
-	var genericMap map[string]interface{}
-
-	socket.Read(dec, &genericMap)
-	switch genericMap["kind"] {
-	case types.InfoMessage:
-		info := types.InfoEvent{}
-		socket.ReadMap(genericMap, &info)
-		vm.Handlers[types.InfoMessage](ctx, c, info)
-	case types.PortMessage:
-		event := types.PortEvent{}
-		socket.ReadMap(genericMap, &event)
-		vm.Handlers[types.PortMessage](ctx, c, event)
-	case types.DNSMessage:
-		dns := types.DNSEvent{}
-		socket.ReadMap(genericMap, &dns)
-		vm.Handlers[types.DNSMessage](ctx, c, dns)
+func (vm *VM) handleFromGuest(ctx context.Context, sess *yamux.Session) {
+	if err := vm.Mux.Serve(ctx, sess); err != nil {
+		logrus.WithError(err).Warn("unable to accept new incoming yamux streams")
 	}
 }
@@ -14,6 +14,7 @@ import (
 	osuser "os/user"
 	"path/filepath"
 	"runtime"
+	"strconv"
 	"strings"
 	"text/template"
 )
@@ -63,6 +64,8 @@ func FillDefault(y, d, o *MacVZYaml, filePath string) {
 		y.MACAddress = pointer.String(vz.NewRandomLocallyAdministeredMACAddress().String())
 	}
 
+	fillUserDefaults(&y.User, d.User, o.User)
+
 	hosts := make(map[string]string)
 	// Values can be either names or IP addresses. Name values are canonicalized in the hostResolver.
 	for k, v := range d.HostResolver.Hosts {
@@ -76,6 +79,44 @@ func FillDefault(y, d, o *MacVZYaml, filePath string) {
 	}
 	y.HostResolver.Hosts = hosts
 
+	srv := make(map[string][]SRVRecord)
+	for _, m := range []map[string][]SRVRecord{d.HostResolver.SRV, y.HostResolver.SRV, o.HostResolver.SRV} {
+		for k, v := range m {
+			srv[Cname(k)] = v
+		}
+	}
+	y.HostResolver.SRV = srv
+
+	txt := make(map[string][]string)
+	for _, m := range []map[string][]string{d.HostResolver.TXT, y.HostResolver.TXT, o.HostResolver.TXT} {
+		for k, v := range m {
+			txt[Cname(k)] = v
+		}
+	}
+	y.HostResolver.TXT = txt
+
+	if y.HostResolver.HostsFile == "" {
+		y.HostResolver.HostsFile = d.HostResolver.HostsFile
+	}
+	if o.HostResolver.HostsFile != "" {
+		y.HostResolver.HostsFile = o.HostResolver.HostsFile
+	}
+
+	if len(y.HostResolver.Upstreams) == 0 {
+		y.HostResolver.Upstreams = d.HostResolver.Upstreams
+	}
+	if len(o.HostResolver.Upstreams) > 0 {
+		y.HostResolver.Upstreams = o.HostResolver.Upstreams
+	}
+
+	domains := make(map[string][]string)
+	for _, m := range []map[string][]string{d.HostResolver.Domains, y.HostResolver.Domains, o.HostResolver.Domains} {
+		for k, v := range m {
+			domains[Cname(k)] = v
+		}
+	}
+	y.HostResolver.Domains = domains
+
 	y.Provision = append(append(o.Provision, y.Provision...), d.Provision...)
 	for i := range y.Provision {
 		provision := &y.Provision[i]
@@ -98,7 +139,7 @@ func FillDefault(y, d, o *MacVZYaml, filePath string) {
 	y.PortForwards = append(append(o.PortForwards, y.PortForwards...), d.PortForwards...)
 	instDir := filepath.Dir(filePath)
 	for i := range y.PortForwards {
-		FillPortForwardDefaults(&y.PortForwards[i], instDir)
+		FillPortForwardDefaults(&y.PortForwards[i], instDir, y.User)
 		// After defaults processing the singular HostPort and GuestPort values should not be used again.
 	}
 
@@ -112,6 +153,16 @@ func FillDefault(y, d, o *MacVZYaml, filePath string) {
 		// y.SSH.LocalPort value is not filled here (filled by the hostagent)
 		y.SSH.LocalPort = pointer.Int(0)
 	}
+	if y.SSH.Port == nil {
+		y.SSH.Port = d.SSH.Port
+	}
+	if o.SSH.Port != nil {
+		y.SSH.Port = o.SSH.Port
+	}
+	if y.SSH.Port == nil || *y.SSH.Port == 0 {
+		y.SSH.Port = pointer.Int(22)
+	}
+
 	if y.SSH.LoadDotSSHPubKeys == nil {
 		y.SSH.LoadDotSSHPubKeys = d.SSH.LoadDotSSHPubKeys
 	}
@@ -132,6 +183,36 @@ func FillDefault(y, d, o *MacVZYaml, filePath string) {
 		y.SSH.ForwardAgent = pointer.Bool(false)
 	}
 
+	if y.SSH.Client == nil {
+		y.SSH.Client = d.SSH.Client
+	}
+	if o.SSH.Client != nil {
+		y.SSH.Client = o.SSH.Client
+	}
+	if y.SSH.Client == nil {
+		y.SSH.Client = pointer.String(SSHClientExec)
+	}
+
+	if y.TimeSync.Interval == nil {
+		y.TimeSync.Interval = d.TimeSync.Interval
+	}
+	if o.TimeSync.Interval != nil {
+		y.TimeSync.Interval = o.TimeSync.Interval
+	}
+	if y.TimeSync.Interval == nil {
+		y.TimeSync.Interval = pointer.String("60s")
+	}
+
+	if y.TimeSync.Threshold == nil {
+		y.TimeSync.Threshold = d.TimeSync.Threshold
+	}
+	if o.TimeSync.Threshold != nil {
+		y.TimeSync.Threshold = o.TimeSync.Threshold
+	}
+	if y.TimeSync.Threshold == nil {
+		y.TimeSync.Threshold = pointer.String("100ms")
+	}
+
 	// If both `useHostResolved` and `HostResolver.Enabled` are defined in the same config,
 	// then the deprecated `useHostResolved` setting is silently ignored.
 	if y.HostResolver.IPv6 == nil {
@@ -144,6 +225,76 @@ func FillDefault(y, d, o *MacVZYaml, filePath string) {
 		y.HostResolver.IPv6 = pointer.Bool(false)
 	}
 
+	if y.HostResolver.Timeout == nil {
+		y.HostResolver.Timeout = d.HostResolver.Timeout
+	}
+	if o.HostResolver.Timeout != nil {
+		y.HostResolver.Timeout = o.HostResolver.Timeout
+	}
+	if y.HostResolver.Timeout == nil {
+		y.HostResolver.Timeout = pointer.String("2s")
+	}
+
+	if y.HostResolver.Cache.Enabled == nil {
+		y.HostResolver.Cache.Enabled = d.HostResolver.Cache.Enabled
+	}
+	if o.HostResolver.Cache.Enabled != nil {
+		y.HostResolver.Cache.Enabled = o.HostResolver.Cache.Enabled
+	}
+	if y.HostResolver.Cache.Enabled == nil {
+		y.HostResolver.Cache.Enabled = pointer.Bool(true)
+	}
+
+	if y.HostResolver.Cache.Size == nil {
+		y.HostResolver.Cache.Size = d.HostResolver.Cache.Size
+	}
+	if o.HostResolver.Cache.Size != nil {
+		y.HostResolver.Cache.Size = o.HostResolver.Cache.Size
+	}
+	if y.HostResolver.Cache.Size == nil {
+		y.HostResolver.Cache.Size = pointer.Int(10000)
+	}
+
+	if y.HostResolver.Cache.SystemTTL == nil {
+		y.HostResolver.Cache.SystemTTL = d.HostResolver.Cache.SystemTTL
+	}
+	if o.HostResolver.Cache.SystemTTL != nil {
+		y.HostResolver.Cache.SystemTTL = o.HostResolver.Cache.SystemTTL
+	}
+	if y.HostResolver.Cache.SystemTTL == nil {
+		y.HostResolver.Cache.SystemTTL = pointer.String("30s")
+	}
+
+	if y.HostResolver.Cache.NegativeTTL == nil {
+		y.HostResolver.Cache.NegativeTTL = d.HostResolver.Cache.NegativeTTL
+	}
+	if o.HostResolver.Cache.NegativeTTL != nil {
+		y.HostResolver.Cache.NegativeTTL = o.HostResolver.Cache.NegativeTTL
+	}
+	if y.HostResolver.Cache.NegativeTTL == nil {
+		y.HostResolver.Cache.NegativeTTL = pointer.String("5s")
+	}
+
+	if y.HostResolver.QueryLog.Enabled == nil {
+		y.HostResolver.QueryLog.Enabled = d.HostResolver.QueryLog.Enabled
+	}
+	if o.HostResolver.QueryLog.Enabled != nil {
+		y.HostResolver.QueryLog.Enabled = o.HostResolver.QueryLog.Enabled
+	}
+	if y.HostResolver.QueryLog.Enabled == nil {
+		y.HostResolver.QueryLog.Enabled = pointer.Bool(false)
+	}
+
+	if y.HostResolver.QueryLog.Size == nil {
+		y.HostResolver.QueryLog.Size = d.HostResolver.QueryLog.Size
+	}
+	if o.HostResolver.QueryLog.Size != nil {
+		y.HostResolver.QueryLog.Size = o.HostResolver.QueryLog.Size
+	}
+	if y.HostResolver.QueryLog.Size == nil {
+		y.HostResolver.QueryLog.Size = pointer.Int(1000)
+	}
+
 	// Combine all mounts; highest priority entry determines writable status.
 	// Only works for exact matches; does not normalize case or resolve symlinks.
 	mounts := make([]Mount, 0, len(d.Mounts)+len(y.Mounts)+len(o.Mounts))
@@ -184,10 +335,65 @@ func ResolveArch() Arch {
 	return NewArch(runtime.GOARCH)
 }
 
-func FillPortForwardDefaults(rule *PortForward, instDir string) {
+// fillUserDefaults fills the user in the guest, which defaults to the host user
+func fillUserDefaults(y *User, d, o User) {
+	hostUser, err := osutil.MacVZUser(false)
+	if err != nil {
+		logrus.WithError(err).Warn("failed to get the host user")
+	}
+
+	if y.Name == nil {
+		y.Name = d.Name
+	}
+	if o.Name != nil {
+		y.Name = o.Name
+	}
+	if (y.Name == nil || *y.Name == "") && hostUser != nil {
+		y.Name = pointer.String(hostUser.Username)
+	}
+
+	if y.UID == nil {
+		y.UID = d.UID
+	}
+	if o.UID != nil {
+		y.UID = o.UID
+	}
+	if y.UID == nil && hostUser != nil {
+		if uid, err := strconv.Atoi(hostUser.Uid); err == nil {
+			y.UID = pointer.Int(uid)
+		}
+	}
+
+	if y.Home == nil {
+		y.Home = d.Home
+	}
+	if o.Home != nil {
+		y.Home = o.Home
+	}
+	if (y.Home == nil || *y.Home == "") && y.Name != nil {
+		y.Home = pointer.String(fmt.Sprintf("/home/%s.linux", *y.Name))
+	}
+
+	if y.Shell == nil {
+		y.Shell = d.Shell
+	}
+	if o.Shell != nil {
+		y.Shell = o.Shell
+	}
+	if y.Shell == nil || *y.Shell == "" {
+		y.Shell = pointer.String("/bin/bash")
+	}
+}
+
+// FillPortForwardDefaults fills the defaults of rule, and expands the templates of its sockets,
+// with the ones of guestSocket referring to user in the guest
+func FillPortForwardDefaults(rule *PortForward, instDir string, user User) {
 	if rule.Proto == "" {
 		rule.Proto = TCP
 	}
+	if rule.Forwarder == "" {
+		rule.Forwarder = ForwarderAgent
+	}
 	if rule.GuestIP == nil {
 		if rule.GuestIPMustBeZero {
 			rule.GuestIP = net.IPv4zero
@@ -218,11 +424,16 @@ func FillPortForwardDefaults(rule *PortForward, instDir string) {
 	if rule.GuestSocket != "" {
 		tmpl, err := template.New("").Parse(rule.GuestSocket)
 		if err == nil {
-			user, _ := osutil.MacVZUser(false)
-			data := map[string]string{
-				"Home": fmt.Sprintf("/home/%s.linux", user.Username),
-				"UID":  user.Uid,
-				"User": user.Username,
+			// the fields of user are only nil when the host user is unknown
+			data := map[string]string{}
+			if user.Home != nil {
+				data["Home"] = *user.Home
+			}
+			if user.UID != nil {
+				data["UID"] = strconv.Itoa(*user.UID)
+			}
+			if user.Name != nil {
+				data["User"] = *user.Name
 			}
 			var out bytes.Buffer
 			if err := tmpl.Execute(&out, data); err == nil {
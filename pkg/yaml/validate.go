@@ -5,7 +5,10 @@ import (
 	"net"
 	"os"
 	"path/filepath"
+	"regexp"
+	"strconv"
 	"strings"
+	"time"
 
 	"errors"
 
@@ -55,12 +58,11 @@ func Validate(y MacVZYaml, warn bool) error {
 		return fmt.Errorf("field `memory` has an invalid value: %w", err)
 	}
 
-	u, err := osutil.MacVZUser(false)
-	if err != nil {
-		return fmt.Errorf("internal error (not an error of YAML): %w", err)
+	if err := validateUser(y.User); err != nil {
+		return err
 	}
 	// reservedHome is the home directory defined in "cidata.iso:/user-data"
-	reservedHome := fmt.Sprintf("/home/%s.linux", u.Username)
+	reservedHome := *y.User.Home
 
 	for i, f := range y.Mounts {
 		if !filepath.IsAbs(f.Location) && !strings.HasPrefix(f.Location, "~") {
@@ -106,6 +108,34 @@ func Validate(y MacVZYaml, warn bool) error {
 		}
 	}
 
+	if err := validatePort("ssh.port", *y.SSH.Port, 0); err != nil {
+		return err
+	}
+	switch *y.SSH.Client {
+	case SSHClientExec, SSHClientNative:
+	default:
+		return fmt.Errorf("field `ssh.client` must be %q or %q, got %q", SSHClientExec, SSHClientNative, *y.SSH.Client)
+	}
+
+	interval, err := time.ParseDuration(*y.TimeSync.Interval)
+	if err != nil {
+		return fmt.Errorf("field `timeSync.interval` has an invalid value: %w", err)
+	}
+	if interval < time.Second {
+		return fmt.Errorf("field `timeSync.interval` must be >= 1s, got %q", *y.TimeSync.Interval)
+	}
+	threshold, err := time.ParseDuration(*y.TimeSync.Threshold)
+	if err != nil {
+		return fmt.Errorf("field `timeSync.threshold` has an invalid value: %w", err)
+	}
+	if threshold <= 0 {
+		return fmt.Errorf("field `timeSync.threshold` must be > 0, got %q", *y.TimeSync.Threshold)
+	}
+
+	if err := validateHostResolver(y.HostResolver); err != nil {
+		return err
+	}
+
 	for i, rule := range y.PortForwards {
 		field := fmt.Sprintf("portForwards[%d]", i)
 		if rule.GuestIPMustBeZero && !rule.GuestIP.Equal(net.IPv4zero) {
@@ -119,7 +149,7 @@ func Validate(y MacVZYaml, warn bool) error {
 				return fmt.Errorf("field `%s.guestPort` must match field `%s.guestPortRange[0]`", field, field)
 			}
 			// redundant validation to make sure the error contains the correct field name
-			if err := validatePort(field+".guestPort", rule.GuestPort); err != nil {
+			if err := validatePort(field+".guestPort", rule.GuestPort, *y.SSH.Port); err != nil {
 				return err
 			}
 		}
@@ -131,15 +161,15 @@ func Validate(y MacVZYaml, warn bool) error {
 				return fmt.Errorf("field `%s.hostPort` must match field `%s.hostPortRange[0]`", field, field)
 			}
 			// redundant validation to make sure the error contains the correct field name
-			if err := validatePort(field+".hostPort", rule.HostPort); err != nil {
+			if err := validatePort(field+".hostPort", rule.HostPort, 22); err != nil {
 				return err
 			}
 		}
 		for j := 0; j < 2; j++ {
-			if err := validatePort(fmt.Sprintf("%s.guestPortRange[%d]", field, j), rule.GuestPortRange[j]); err != nil {
+			if err := validatePort(fmt.Sprintf("%s.guestPortRange[%d]", field, j), rule.GuestPortRange[j], *y.SSH.Port); err != nil {
 				return err
 			}
-			if err := validatePort(fmt.Sprintf("%s.hostPortRange[%d]", field, j), rule.HostPortRange[j]); err != nil {
+			if err := validatePort(fmt.Sprintf("%s.hostPortRange[%d]", field, j), rule.HostPortRange[j], 22); err != nil {
 				return err
 			}
 		}
@@ -173,8 +203,22 @@ func Validate(y MacVZYaml, warn bool) error {
 			return fmt.Errorf("field `%s.hostSocket` must be less than UNIX_PATH_MAX=%d characters, but is %d",
 				field, osutil.UnixPathMax, len(rule.HostSocket))
 		}
-		if rule.Proto != TCP {
-			return fmt.Errorf("field `%s.proto` must be %q", field, TCP)
+		switch rule.Proto {
+		case TCP:
+		case UDP:
+			if rule.GuestSocket != "" || rule.HostSocket != "" {
+				return fmt.Errorf("field `%s.proto` must be %q when field `%s.guestSocket` or `%s.hostSocket` is set", field, TCP, field, field)
+			}
+			if rule.Forwarder == ForwarderSSH {
+				return fmt.Errorf("field `%s.proto` must be %q when field `%s.forwarder` is %q, as SSH cannot forward UDP", field, TCP, field, ForwarderSSH)
+			}
+		default:
+			return fmt.Errorf("field `%s.proto` must be %q or %q", field, TCP, UDP)
+		}
+		switch rule.Forwarder {
+		case ForwarderAgent, ForwarderSSH:
+		default:
+			return fmt.Errorf("field `%s.forwarder` must be %q or %q", field, ForwarderAgent, ForwarderSSH)
 		}
 		// Not validating that the various GuestPortRanges and HostPortRanges are not overlapping. Rules will be
 		// processed sequentially and the first matching rule for a guest port determines forwarding behavior.
@@ -183,14 +227,149 @@ func Validate(y MacVZYaml, warn bool) error {
 	return nil
 }
 
-func validatePort(field string, port int) error {
+// validUserName is the pattern of the user and group names allowed by `useradd`
+var validUserName = regexp.MustCompile("^[a-z_][a-z0-9_-]*$")
+
+func validateUser(u User) error {
+	if u.Name == nil || u.UID == nil || u.Home == nil || u.Shell == nil {
+		return errors.New("internal error (not an error of YAML): the host user is unknown")
+	}
+	if !validUserName.MatchString(*u.Name) {
+		return fmt.Errorf("field `user.name` must match %q, got %q", validUserName, *u.Name)
+	}
+	if *u.Name == "root" {
+		return errors.New("field `user.name` must not be \"root\"")
+	}
+	if *u.UID <= 0 {
+		return fmt.Errorf("field `user.uid` must be > 0, got %d", *u.UID)
+	}
+	if !filepath.IsAbs(*u.Home) {
+		return fmt.Errorf("field `user.home` must be an absolute path, got %q", *u.Home)
+	}
+	if !filepath.IsAbs(*u.Shell) {
+		return fmt.Errorf("field `user.shell` must be an absolute path, got %q", *u.Shell)
+	}
+	return nil
+}
+
+func validateHostResolver(h HostResolver) error {
+	for _, f := range []struct {
+		field string
+		value string
+		min   time.Duration
+	}{
+		{"hostResolver.timeout", *h.Timeout, time.Millisecond},
+		// a TTL is a number of seconds
+		{"hostResolver.cache.systemTTL", *h.Cache.SystemTTL, time.Second},
+		{"hostResolver.cache.negativeTTL", *h.Cache.NegativeTTL, time.Second},
+	} {
+		d, err := time.ParseDuration(f.value)
+		if err != nil {
+			return fmt.Errorf("field `%s` has an invalid value: %w", f.field, err)
+		}
+		if d < f.min {
+			return fmt.Errorf("field `%s` must be >= %v, got %q", f.field, f.min, f.value)
+		}
+	}
+	if *h.Cache.Size <= 0 {
+		return fmt.Errorf("field `hostResolver.cache.size` must be > 0, got %d", *h.Cache.Size)
+	}
+	if *h.QueryLog.Size <= 0 {
+		return fmt.Errorf("field `hostResolver.queryLog.size` must be > 0, got %d", *h.QueryLog.Size)
+	}
+	for host := range h.Hosts {
+		if err := ValidateHostName(host); err != nil {
+			return fmt.Errorf("field `hostResolver.hosts` %w", err)
+		}
+	}
+	if f := h.HostsFile; f != "" {
+		if !filepath.IsAbs(f) && !strings.HasPrefix(f, "~") {
+			return fmt.Errorf("field `hostResolver.hostsFile` must be an absolute path, got %q", f)
+		}
+		if _, err := homedir.Expand(f); err != nil {
+			return fmt.Errorf("field `hostResolver.hostsFile` refers to an unexpandable path: %q: %w", f, err)
+		}
+	}
+	for name, records := range h.SRV {
+		if err := ValidateHostName(name); err != nil {
+			return fmt.Errorf("field `hostResolver.srv` %w", err)
+		}
+		for i, r := range records {
+			if r.Target == "" || strings.Contains(r.Target, "*") {
+				return fmt.Errorf("field `hostResolver.srv[%q][%d].target` must be a host name, got %q", name, i, r.Target)
+			}
+			if r.Port == 0 {
+				return fmt.Errorf("field `hostResolver.srv[%q][%d].port` must be set", name, i)
+			}
+		}
+	}
+	for name, txt := range h.TXT {
+		if err := ValidateHostName(name); err != nil {
+			return fmt.Errorf("field `hostResolver.txt` %w", err)
+		}
+		for i, s := range txt {
+			// RFC 1035, Section 3.3.14
+			if len(s) > 255 {
+				return fmt.Errorf("field `hostResolver.txt[%q][%d]` must be <= 255 bytes, got %d", name, i, len(s))
+			}
+		}
+	}
+	for i, server := range h.Upstreams {
+		if err := validateDNSServer(server); err != nil {
+			return fmt.Errorf("field `hostResolver.upstreams[%d]` %w", i, err)
+		}
+	}
+	for domain, servers := range h.Domains {
+		if domain == "." || strings.ContainsAny(domain, " *") {
+			return fmt.Errorf("field `hostResolver.domains` has an invalid domain %q", domain)
+		}
+		if len(servers) == 0 {
+			return fmt.Errorf("field `hostResolver.domains[%q]` must have at least one server", domain)
+		}
+		for i, server := range servers {
+			if err := validateDNSServer(server); err != nil {
+				return fmt.Errorf("field `hostResolver.domains[%q][%d]` %w", domain, i, err)
+			}
+		}
+	}
+	return nil
+}
+
+// ValidateHostName validates a name of hostResolver, which may be a wildcard, e.g. "*.dev.test"
+func ValidateHostName(name string) error {
+	if name == "." || strings.Contains(name, " ") || strings.Contains(strings.TrimPrefix(name, "*."), "*") {
+		return fmt.Errorf("has an invalid name %q, a wildcard must be the leftmost label, e.g. \"*.dev.test\"", name)
+	}
+	return nil
+}
+
+// validateDNSServer validates "IP" or "IP:PORT"
+func validateDNSServer(server string) error {
+	host, port := server, "53"
+	if net.ParseIP(server) == nil {
+		var err error
+		if host, port, err = net.SplitHostPort(server); err != nil {
+			return fmt.Errorf("must be an IP address, optionally with a port, got %q", server)
+		}
+	}
+	if net.ParseIP(host) == nil {
+		return fmt.Errorf("must be an IP address, optionally with a port, got %q", server)
+	}
+	if p, err := strconv.Atoi(port); err != nil || p <= 0 || p > 65535 {
+		return fmt.Errorf("has an invalid port, got %q", server)
+	}
+	return nil
+}
+
+// validatePort validates the port of field, which must not be reserved, unless 0
+func validatePort(field string, port, reserved int) error {
 	switch {
 	case port < 0:
 		return fmt.Errorf("field `%s` must be > 0", field)
 	case port == 0:
 		return fmt.Errorf("field `%s` must be set", field)
-	case port == 22:
-		return fmt.Errorf("field `%s` must not be 22", field)
+	case reserved != 0 && port == reserved:
+		return fmt.Errorf("field `%s` must not be %d", field, reserved)
 	case port > 65535:
 		return fmt.Errorf("field `%s` must be < 65536", field)
 	}
@@ -9,12 +9,14 @@ type MacVZYaml struct {
 	Disk       *string `yaml:"disk,omitempty" json:"disk,omitempty"`     // go-units.RAMInBytes
 	Mounts     []Mount `yaml:"mounts,omitempty" json:"mounts,omitempty"`
 	MACAddress *string `yaml:"MACAddress,omitempty" json:"MACAddress,omitempty"`
+	User       User    `yaml:"user,omitempty" json:"user,omitempty"`
 
 	SSH          SSH           `yaml:"ssh,omitempty" json:"ssh,omitempty"` // REQUIRED
 	PortForwards []PortForward `yaml:"portForwards,omitempty" json:"portForwards,omitempty"`
 	Provision    []Provision   `yaml:"provision,omitempty" json:"provision,omitempty"`
 	Probes       []Probe       `yaml:"probes,omitempty" json:"probes,omitempty"`
 	HostResolver HostResolver  `yaml:"hostResolver,omitempty" json:"hostResolver,omitempty"`
+	TimeSync     TimeSync      `yaml:"timeSync,omitempty" json:"timeSync,omitempty"`
 }
 
 type Image struct {
@@ -31,6 +33,14 @@ const (
 	AARCH64 Arch = "aarch64"
 )
 
+// User is the user in the guest, which the host user logs in as
+type User struct {
+	Name  *string `yaml:"name,omitempty" json:"name,omitempty"`   // default: the host username, or "macvz" if it is not a valid Linux username
+	UID   *int    `yaml:"uid,omitempty" json:"uid,omitempty"`     // default: the host UID
+	Home  *string `yaml:"home,omitempty" json:"home,omitempty"`   // default: "/home/{{.Name}}.linux"
+	Shell *string `yaml:"shell,omitempty" json:"shell,omitempty"` // default: "/bin/bash"
+}
+
 type Mount struct {
 	Location string `yaml:"location" json:"location"` // REQUIRED
 	Writable *bool  `yaml:"writable,omitempty" json:"writable,omitempty"`
@@ -63,34 +73,111 @@ type Probe struct {
 
 type SSH struct {
 	LocalPort *int `yaml:"localPort,omitempty" json:"localPort,omitempty"`
+	// Port is the port of sshd in the guest
+	Port *int `yaml:"port,omitempty" json:"port,omitempty"` // default: 22
 
 	// LoadDotSSHPubKeys loads ~/.ssh/*.pub in addition to $MACVZ_HOME/_config/user.pub .
 	LoadDotSSHPubKeys *bool `yaml:"loadDotSSHPubKeys,omitempty" json:"loadDotSSHPubKeys,omitempty"` // default: true
 	ForwardAgent      *bool `yaml:"forwardAgent,omitempty" json:"forwardAgent,omitempty"`           // default: false
+	// Client is the SSH client of the host agent, for the forwards over SSH and the requirements
+	Client *SSHClient `yaml:"client,omitempty" json:"client,omitempty"` // default: "exec"
 }
 
+type SSHClient = string
+
+const (
+	// SSHClientExec runs the ssh binary over a control master
+	SSHClientExec SSHClient = "exec"
+	// SSHClientNative speaks SSH in-process with golang.org/x/crypto/ssh
+	SSHClientNative SSHClient = "native"
+)
+
 type Proto = string
 
 const (
 	TCP Proto = "tcp"
+	UDP Proto = "udp"
+)
+
+type Forwarder = string
+
+const (
+	// ForwarderAgent forwards connections over the vsock session with the guest agent
+	ForwarderAgent Forwarder = "agent"
+	// ForwarderSSH forwards connections with `ssh -L` over the SSH control master
+	ForwarderSSH Forwarder = "ssh"
 )
 
 type PortForward struct {
-	GuestIPMustBeZero bool   `yaml:"guestIPMustBeZero,omitempty" json:"guestIPMustBeZero,omitempty"`
-	GuestIP           net.IP `yaml:"guestIP,omitempty" json:"guestIP,omitempty"`
-	GuestPort         int    `yaml:"guestPort,omitempty" json:"guestPort,omitempty"`
-	GuestPortRange    [2]int `yaml:"guestPortRange,omitempty" json:"guestPortRange,omitempty"`
-	GuestSocket       string `yaml:"guestSocket,omitempty" json:"guestSocket,omitempty"`
-	HostIP            net.IP `yaml:"hostIP,omitempty" json:"hostIP,omitempty"`
-	HostPort          int    `yaml:"hostPort,omitempty" json:"hostPort,omitempty"`
-	HostPortRange     [2]int `yaml:"hostPortRange,omitempty" json:"hostPortRange,omitempty"`
-	HostSocket        string `yaml:"hostSocket,omitempty" json:"hostSocket,omitempty"`
-	Proto             Proto  `yaml:"proto,omitempty" json:"proto,omitempty"`
-	Ignore            bool   `yaml:"ignore,omitempty" json:"ignore,omitempty"`
+	GuestIPMustBeZero bool      `yaml:"guestIPMustBeZero,omitempty" json:"guestIPMustBeZero,omitempty"`
+	GuestIP           net.IP    `yaml:"guestIP,omitempty" json:"guestIP,omitempty"`
+	GuestPort         int       `yaml:"guestPort,omitempty" json:"guestPort,omitempty"`
+	GuestPortRange    [2]int    `yaml:"guestPortRange,omitempty" json:"guestPortRange,omitempty"`
+	GuestSocket       string    `yaml:"guestSocket,omitempty" json:"guestSocket,omitempty"`
+	HostIP            net.IP    `yaml:"hostIP,omitempty" json:"hostIP,omitempty"`
+	HostPort          int       `yaml:"hostPort,omitempty" json:"hostPort,omitempty"`
+	HostPortRange     [2]int    `yaml:"hostPortRange,omitempty" json:"hostPortRange,omitempty"`
+	HostSocket        string    `yaml:"hostSocket,omitempty" json:"hostSocket,omitempty"`
+	Proto             Proto     `yaml:"proto,omitempty" json:"proto,omitempty"`
+	Forwarder         Forwarder `yaml:"forwarder,omitempty" json:"forwarder,omitempty"` // default: "agent"
+	Ignore            bool      `yaml:"ignore,omitempty" json:"ignore,omitempty"`
+}
+
+// TimeSync is the synchronization of the guest clock with the host clock, over the guest agent.
+// The durations are in the format of time.ParseDuration, e.g. "100ms".
+type TimeSync struct {
+	// Interval is the interval of the host clock sent to the guest, which is also sent when the host wakes up
+	Interval *string `yaml:"interval,omitempty" json:"interval,omitempty"` // default: "60s"
+	// Threshold is the skew below which the guest clock is left as is
+	Threshold *string `yaml:"threshold,omitempty" json:"threshold,omitempty"` // default: "100ms"
 }
 
 type HostResolver struct {
-	Enabled *bool             `yaml:"enabled,omitempty" json:"enabled,omitempty"`
-	IPv6    *bool             `yaml:"ipv6,omitempty" json:"ipv6,omitempty"`
-	Hosts   map[string]string `yaml:"hosts,omitempty" json:"hosts,omitempty"`
+	Enabled *bool `yaml:"enabled,omitempty" json:"enabled,omitempty"`
+	IPv6    *bool `yaml:"ipv6,omitempty" json:"ipv6,omitempty"`
+	// Hosts maps the names to an IP or a CNAME, and the IPs are answered to the PTR queries too.
+	// A name may be a wildcard, e.g. "*.dev.test", which matches the names under dev.test but not dev.test itself.
+	Hosts map[string]string `yaml:"hosts,omitempty" json:"hosts,omitempty"`
+	// SRV are the SRV records of the names, e.g. {_http._tcp.app.test: [{target: app.test, port: 8080}]}
+	SRV map[string][]SRVRecord `yaml:"srv,omitempty" json:"srv,omitempty"`
+	// TXT are the TXT records of the names
+	TXT map[string][]string `yaml:"txt,omitempty" json:"txt,omitempty"`
+	// HostsFile is a file in the format of /etc/hosts, whose entries are overridden by Hosts.
+	// The file is optional, and reloaded along with macvz.yaml as it changes.
+	HostsFile string `yaml:"hostsFile,omitempty" json:"hostsFile,omitempty"` // default: none
+	// Upstreams are the servers ("IP" or "IP:PORT") the queries are forwarded to, instead of the system resolver of the host
+	Upstreams []string `yaml:"upstreams,omitempty" json:"upstreams,omitempty"` // default: none, i.e. the system resolver
+	// Domains are the servers the queries of the names under a domain are forwarded to, e.g. {corp.example: [10.0.0.53]}.
+	// The longest matching domain wins over Upstreams.
+	Domains map[string][]string `yaml:"domains,omitempty" json:"domains,omitempty"`
+	// Timeout is the timeout of a query to an upstream server, in the format of time.ParseDuration
+	Timeout *string           `yaml:"timeout,omitempty" json:"timeout,omitempty"` // default: "2s"
+	Cache   HostResolverCache `yaml:"cache,omitempty" json:"cache,omitempty"`
+	// QueryLog keeps the latest queries in the host agent, for `macvz dns log`
+	QueryLog HostResolverQueryLog `yaml:"queryLog,omitempty" json:"queryLog,omitempty"`
+}
+
+type SRVRecord struct {
+	Target   string `yaml:"target" json:"target"`
+	Port     uint16 `yaml:"port" json:"port"`
+	Priority uint16 `yaml:"priority,omitempty" json:"priority,omitempty"` // default: 0
+	Weight   uint16 `yaml:"weight,omitempty" json:"weight,omitempty"`     // default: 0
+}
+
+type HostResolverQueryLog struct {
+	Enabled *bool `yaml:"enabled,omitempty" json:"enabled,omitempty"` // default: false
+	// Size is the maximum number of queries kept, the older ones are discarded
+	Size *int `yaml:"size,omitempty" json:"size,omitempty"` // default: 1000
+}
+
+// HostResolverCache caches the answers of the system resolver and the upstream servers, for their TTL.
+// The durations are in the format of time.ParseDuration.
+type HostResolverCache struct {
+	Enabled *bool `yaml:"enabled,omitempty" json:"enabled,omitempty"` // default: true
+	// Size is the maximum number of cached answers
+	Size *int `yaml:"size,omitempty" json:"size,omitempty"` // default: 10000
+	// SystemTTL is the TTL of the answers of the system resolver, which does not tell the TTL of the records
+	SystemTTL *string `yaml:"systemTTL,omitempty" json:"systemTTL,omitempty"` // default: "30s"
+	// NegativeTTL is the TTL of the answers without records, unless the upstream server tells it with SOA
+	NegativeTTL *string `yaml:"negativeTTL,omitempty" json:"negativeTTL,omitempty"` // default: "5s"
 }